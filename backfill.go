@@ -373,6 +373,7 @@ type BackfillPartMetadata struct {
 	Sender       int64
 	PartIndex    int
 	EditCount    int64
+	Subtype      database.MessageSubtype
 	Reactions    []*table.LSUpsertReaction
 	InBatchReact *table.LSUpsertReaction
 }
@@ -528,6 +529,7 @@ func (portal *Portal) convertAndSendBackfill(ctx context.Context, source *User,
 				Sender:    msg.SenderId,
 				PartIndex: i,
 				EditCount: msg.EditCount,
+				Subtype:   part.Subtype,
 				Reactions: reactionsToSendSeparately,
 			})
 			reactionsToSendSeparately = nil
@@ -593,7 +595,7 @@ func (portal *Portal) sendBackfillLegacy(ctx context.Context, source *User, even
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Int("evt_index", i).Msg("Failed to send event")
 		} else {
-			portal.storeMessageInDB(ctx, resp.EventID, metas[i].MessageID, metas[i].OTID, metas[i].Sender, time.UnixMilli(evt.Timestamp), metas[i].PartIndex)
+			portal.storeMessageInDB(ctx, resp.EventID, metas[i].MessageID, metas[i].OTID, metas[i].Sender, time.UnixMilli(evt.Timestamp), metas[i].PartIndex, metas[i].Subtype)
 			lastEventID = resp.EventID
 		}
 		for _, react := range metas[i].Reactions {
@@ -652,6 +654,7 @@ func (portal *Portal) sendBackfillBeeper(ctx context.Context, source *User, even
 				MXID:      evtID,
 				Timestamp: time.UnixMilli(events[i].Timestamp),
 				EditCount: meta.EditCount,
+				Subtype:   meta.Subtype,
 			})
 		}
 	}
@@ -60,6 +60,7 @@ func (br *MetaBridge) RegisterCommands() {
 		cmdSyncSpace,
 		cmdDeleteSession,
 		cmdToggleEncryption,
+		cmdToggleTranscoding,
 		cmdSetRelay,
 		cmdUnsetRelay,
 		cmdDeletePortal,
@@ -144,6 +145,32 @@ func fnToggleEncryption(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdToggleTranscoding = &commands.FullHandler{
+	Func: wrapCommand(fnToggleTranscoding),
+	Name: "toggle-transcoding",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Toggle converting GIFs and voice messages before sending them in the current room",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnToggleTranscoding(ce *WrappedCommandEvent) {
+	ce.Portal.DisableTranscoding = !ce.Portal.DisableTranscoding
+	err := ce.Portal.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to update portal in database")
+		ce.Reply("Failed to save setting")
+		return
+	}
+	if ce.Portal.DisableTranscoding {
+		ce.Reply("GIFs and voice messages will now be sent in their original format in this room")
+	} else {
+		ce.Reply("GIFs and voice messages will now be converted according to the bridge config in this room")
+	}
+}
+
 var cmdSetRelay = &commands.FullHandler{
 	Func: wrapCommand(fnSetRelay),
 	Name: "set-relay",
@@ -46,6 +46,7 @@ type BridgeConfig struct {
 	CaptionInMessage        bool   `yaml:"caption_in_message"`
 	FederateRooms           bool   `yaml:"federate_rooms"`
 	MuteBridging            string `yaml:"mute_bridging"`
+	SpoilerStyle            string `yaml:"spoiler_style"`
 
 	DoublePuppetConfig bridgeconfig.DoublePuppetConfig `yaml:",inline"`
 
@@ -74,6 +75,57 @@ type BridgeConfig struct {
 	} `yaml:"backfill"`
 	DisableXMA bool `yaml:"disable_xma"`
 
+	ThumbnailMaxDimension int           `yaml:"thumbnail_max_dimension"`
+	ImageMaxDimension     int           `yaml:"image_max_dimension"`
+	ThumbnailQuality      int           `yaml:"thumbnail_quality"`
+	MediaUploadRetries    int           `yaml:"media_upload_retries"`
+	ConversionTimeout     time.Duration `yaml:"conversion_timeout"`
+	MaxScheduleDelay      time.Duration `yaml:"max_schedule_delay"`
+
+	SendUnsupportedAsText bool   `yaml:"send_unsupported_as_text"`
+	EmotePrefix           string `yaml:"emote_prefix"`
+	NoticePrefix          string `yaml:"notice_prefix"`
+	LocationAddress       string `yaml:"location_address"`
+
+	MediaCache struct {
+		TTL        time.Duration `yaml:"ttl"`
+		MaxEntries int           `yaml:"max_entries"`
+	} `yaml:"media_cache"`
+
+	URLPreviews struct {
+		Enabled bool          `yaml:"enabled"`
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"url_previews"`
+
+	NativeGIFs struct {
+		Enabled      bool  `yaml:"enabled"`
+		MaxSize      int64 `yaml:"max_size"`
+		MaxDimension int   `yaml:"max_dimension"`
+	} `yaml:"native_gifs"`
+
+	StickerLikeImages struct {
+		Enabled      bool  `yaml:"enabled"`
+		MaxSize      int64 `yaml:"max_size"`
+		MaxDimension int   `yaml:"max_dimension"`
+	} `yaml:"sticker_like_images"`
+	CustomEmojiStickers bool `yaml:"custom_emoji_stickers"`
+	SplitLongMessages   bool `yaml:"split_long_messages"`
+
+	TranscodeVoiceMessages bool   `yaml:"transcode_voice_messages"`
+	VoiceCodec             string `yaml:"voice_codec"`
+	AddSilentAudio         bool   `yaml:"add_silent_audio"`
+	RouteFilesByMimetype   bool   `yaml:"route_files_by_mimetype"`
+	ThreadsAsReplies       bool   `yaml:"threads_as_replies"`
+	CaptionPlacement       string `yaml:"caption_placement"`
+
+	AlbumWindow time.Duration `yaml:"album_window"`
+
+	FFmpegArgs struct {
+		GIFToMP4   FFmpegArgs `yaml:"gif_to_mp4"`
+		VoiceToM4A FFmpegArgs `yaml:"voice_to_m4a"`
+		VoiceToOgg FFmpegArgs `yaml:"voice_to_ogg"`
+	} `yaml:"ffmpeg_args"`
+
 	ManagementRoomText bridgeconfig.ManagementRoomTexts `yaml:"management_room_text"`
 
 	Encryption bridgeconfig.EncryptionConfig `yaml:"encryption"`
@@ -92,6 +144,12 @@ type BridgeConfig struct {
 	displaynameTemplate *template.Template `yaml:"-"`
 }
 
+// FFmpegArgs contains the arguments passed to ffmpeg before and after the input file for a media conversion.
+type FFmpegArgs struct {
+	Input  []string `yaml:"input"`
+	Output []string `yaml:"output"`
+}
+
 func (bc *BridgeConfig) GetResendBridgeInfo() bool {
 	return bc.ResendBridgeInfo
 }
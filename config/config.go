@@ -54,6 +54,11 @@ type Config struct {
 		ForceRefreshIntervalSeconds     int        `yaml:"force_refresh_interval_seconds"`
 	} `yaml:"meta"`
 
+	Metrics struct {
+		Enabled bool   `yaml:"enabled"`
+		Listen  string `yaml:"listen"`
+	} `yaml:"metrics"`
+
 	Bridge BridgeConfig `yaml:"bridge"`
 }
 
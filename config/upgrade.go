@@ -71,6 +71,9 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str|up.Null, "meta", "proxy")
 	helper.Copy(up.Str|up.Null, "meta", "get_proxy_from")
 
+	helper.Copy(up.Bool, "metrics", "enabled")
+	helper.Copy(up.Str, "metrics", "listen")
+
 	if usernameTemplate, ok := helper.Get(up.Str, "bridge", "username_template"); ok && strings.Contains(usernameTemplate, "{userid}") {
 		helper.Set(up.Str, strings.ReplaceAll(usernameTemplate, "{userid}", "{{.}}"), "bridge", "username_template")
 	} else {
@@ -99,6 +102,13 @@ func DoUpgrade(helper *up.Helper) {
 	default:
 		// Don't copy invalid values
 	}
+	spoilerStyleVal, _ := helper.Get(up.Str, "bridge", "spoiler_style")
+	switch spoilerStyleVal {
+	case "marker", "hidden":
+		helper.Copy(up.Str, "bridge", "spoiler_style")
+	default:
+		// Don't copy invalid values
+	}
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
 	helper.Copy(up.Map, "bridge", "double_puppet_server_map")
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
@@ -114,6 +124,55 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str, "bridge", "backfill", "queue", "sleep_between_tasks")
 	helper.Copy(up.Bool, "bridge", "backfill", "queue", "dont_fetch_xma")
 	helper.Copy(up.Bool, "bridge", "disable_xma")
+	helper.Copy(up.Int, "bridge", "thumbnail_max_dimension")
+	helper.Copy(up.Int, "bridge", "image_max_dimension")
+	helper.Copy(up.Int, "bridge", "thumbnail_quality")
+	helper.Copy(up.Int, "bridge", "media_upload_retries")
+	helper.Copy(up.Str, "bridge", "conversion_timeout")
+	helper.Copy(up.Str, "bridge", "max_schedule_delay")
+	helper.Copy(up.Bool, "bridge", "send_unsupported_as_text")
+	helper.Copy(up.Str, "bridge", "emote_prefix")
+	helper.Copy(up.Str, "bridge", "notice_prefix")
+	helper.Copy(up.Str, "bridge", "location_address")
+	helper.Copy(up.Str, "bridge", "media_cache", "ttl")
+	helper.Copy(up.Int, "bridge", "media_cache", "max_entries")
+	helper.Copy(up.Bool, "bridge", "url_previews", "enabled")
+	helper.Copy(up.Str, "bridge", "url_previews", "timeout")
+	helper.Copy(up.Bool, "bridge", "native_gifs", "enabled")
+	helper.Copy(up.Int, "bridge", "native_gifs", "max_size")
+	helper.Copy(up.Int, "bridge", "native_gifs", "max_dimension")
+	helper.Copy(up.Bool, "bridge", "sticker_like_images", "enabled")
+	helper.Copy(up.Int, "bridge", "sticker_like_images", "max_size")
+	helper.Copy(up.Int, "bridge", "sticker_like_images", "max_dimension")
+	helper.Copy(up.Bool, "bridge", "custom_emoji_stickers")
+	helper.Copy(up.Bool, "bridge", "split_long_messages")
+	helper.Copy(up.Bool, "bridge", "transcode_voice_messages")
+	voiceCodecVal, _ := helper.Get(up.Str, "bridge", "voice_codec")
+	switch voiceCodecVal {
+	case "aac", "opus":
+		helper.Copy(up.Str, "bridge", "voice_codec")
+	default:
+		// Don't copy invalid values
+	}
+	helper.Copy(up.Bool, "bridge", "add_silent_audio")
+	helper.Copy(up.Bool, "bridge", "route_files_by_mimetype")
+	helper.Copy(up.Bool, "bridge", "threads_as_replies")
+	captionPlacementVal, _ := helper.Get(up.Str, "bridge", "caption_placement")
+	switch captionPlacementVal {
+	case "attached", "before", "after":
+		helper.Copy(up.Str, "bridge", "caption_placement")
+	default:
+		if separateCaptions, ok := helper.Get(up.Bool, "bridge", "separate_captions"); ok && separateCaptions == "true" {
+			helper.Set(up.Str, "after", "bridge", "caption_placement")
+		}
+	}
+	helper.Copy(up.Str, "bridge", "album_window")
+	helper.Copy(up.List, "bridge", "ffmpeg_args", "gif_to_mp4", "input")
+	helper.Copy(up.List, "bridge", "ffmpeg_args", "gif_to_mp4", "output")
+	helper.Copy(up.List, "bridge", "ffmpeg_args", "voice_to_m4a", "input")
+	helper.Copy(up.List, "bridge", "ffmpeg_args", "voice_to_m4a", "output")
+	helper.Copy(up.List, "bridge", "ffmpeg_args", "voice_to_ogg", "input")
+	helper.Copy(up.List, "bridge", "ffmpeg_args", "voice_to_ogg", "output")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_connected")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_unconnected")
@@ -167,6 +226,7 @@ var SpacedBlocks = [][]string{
 	{"appservice", "ephemeral_events"},
 	{"appservice", "as_token"},
 	{"meta"},
+	{"metrics"},
 	{"bridge"},
 	{"bridge", "personal_filtering_spaces"},
 	{"bridge", "command_prefix"},
@@ -34,6 +34,7 @@ type Database struct {
 	Puppet       *PuppetQuery
 	Message      *MessageQuery
 	Reaction     *ReactionQuery
+	Poll         *PollQuery
 	BackfillTask *BackfillTaskQuery
 }
 
@@ -46,6 +47,7 @@ func New(db *dbutil.Database) *Database {
 		Puppet:       &PuppetQuery{dbutil.MakeQueryHelper(db, newPuppet)},
 		Message:      &MessageQuery{dbutil.MakeQueryHelper(db, newMessage)},
 		Reaction:     &ReactionQuery{dbutil.MakeQueryHelper(db, newReaction)},
+		Poll:         &PollQuery{dbutil.MakeQueryHelper(db, newPoll)},
 		BackfillTask: &BackfillTaskQuery{dbutil.MakeQueryHelper(db, newBackfillTask)},
 	}
 }
@@ -30,29 +30,29 @@ import (
 
 const (
 	getMessageByMXIDQuery = `
-		SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count FROM message
+		SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count, subtype FROM message
 		WHERE mxid=$1
 	`
 	getMessagePartByIDQuery = `
-        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count FROM message
+        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count, subtype FROM message
         WHERE id=$1 AND part_index=$2 AND thread_receiver=$3
 	`
 	getLastMessagePartByIDQuery = `
-        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count FROM message
+        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count, subtype FROM message
         WHERE id=$1 AND thread_receiver=$2
         ORDER BY part_index DESC LIMIT 1
 	`
 	getLastPartByTimestampQuery = `
-        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count FROM message
+        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count, subtype FROM message
         WHERE thread_id=$1 AND thread_receiver=$2 AND timestamp<=$3
         ORDER BY timestamp DESC, part_index DESC LIMIT 1
 	`
 	getAllMessagePartsByIDQuery = `
-        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count FROM message
+        SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count, subtype FROM message
         WHERE id=$1 AND thread_receiver=$2
 	`
 	getMessagesBetweenTimeQuery = `
-		SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count FROM message
+		SELECT id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count, subtype FROM message
 		WHERE thread_id=$1 AND thread_receiver=$2 AND timestamp>$3 AND timestamp<=$4 AND part_index=0
 		ORDER BY timestamp ASC
 	`
@@ -61,11 +61,11 @@ const (
         WHERE id=$1 AND (thread_receiver=$2 OR thread_receiver=0) AND part_index=0
 	`
 	insertMessageQuery = `
-		INSERT INTO message (id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO message (id, part_index, thread_id, thread_receiver, msg_sender, otid, mxid, mx_room, timestamp, edit_count, subtype)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 	`
-	insertQueryValuePlaceholder   = `($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-	bulkInsertPlaceholderTemplate = `($%d, $%d, $1, $2, $%d, $%d, $%d, $3, $%d, $%d)`
+	insertQueryValuePlaceholder   = `($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	bulkInsertPlaceholderTemplate = `($%d, $%d, $1, $2, $%d, $%d, $%d, $3, $%d, $%d, $%d)`
 	deleteMessageQuery            = `
         DELETE FROM message
         WHERE id=$1 AND thread_receiver=$2 AND part_index=$3
@@ -100,8 +100,22 @@ type Message struct {
 
 	Timestamp time.Time
 	EditCount int64
+	Subtype   MessageSubtype
 }
 
+// MessageSubtype is used to mark messages that need to be handled differently from normal messages,
+// e.g. when replying to them.
+type MessageSubtype int
+
+const (
+	MessageSubtypeNone MessageSubtype = iota
+	// MessageSubtypeStory is an Instagram story that was shared in the chat.
+	MessageSubtypeStory
+	// MessageSubtypeAdmin is a message generated by Meta rather than sent by a user,
+	// e.g. a business or ad notice, which can't be quoted in replies.
+	MessageSubtypeAdmin
+)
+
 func newMessage(qh *dbutil.QueryHelper[*Message]) *Message {
 	return &Message{qh: qh}
 }
@@ -173,13 +187,13 @@ func (mq *MessageQuery) BulkInsertChunk(ctx context.Context, thread PortalKey, r
 		return nil
 	}
 	placeholders := make([]string, len(messages))
-	values := make([]any, 3+len(messages)*7)
+	values := make([]any, 3+len(messages)*8)
 	values[0] = thread.ThreadID
 	values[1] = thread.Receiver
 	values[2] = roomID
 	for i, msg := range messages {
-		baseIndex := 3 + i*7
-		placeholders[i] = fmt.Sprintf(bulkInsertPlaceholderTemplate, baseIndex+1, baseIndex+2, baseIndex+3, baseIndex+4, baseIndex+5, baseIndex+6, baseIndex+7)
+		baseIndex := 3 + i*8
+		placeholders[i] = fmt.Sprintf(bulkInsertPlaceholderTemplate, baseIndex+1, baseIndex+2, baseIndex+3, baseIndex+4, baseIndex+5, baseIndex+6, baseIndex+7, baseIndex+8)
 		values[baseIndex] = msg.ID
 		values[baseIndex+1] = msg.PartIndex
 		values[baseIndex+2] = msg.Sender
@@ -187,6 +201,7 @@ func (mq *MessageQuery) BulkInsertChunk(ctx context.Context, thread PortalKey, r
 		values[baseIndex+4] = msg.MXID
 		values[baseIndex+5] = msg.Timestamp.UnixMilli()
 		values[baseIndex+6] = msg.EditCount
+		values[baseIndex+7] = msg.Subtype
 	}
 	query := strings.ReplaceAll(insertMessageQuery, insertQueryValuePlaceholder, strings.Join(placeholders, ","))
 	return mq.Exec(ctx, query, values...)
@@ -195,7 +210,7 @@ func (mq *MessageQuery) BulkInsertChunk(ctx context.Context, thread PortalKey, r
 func (msg *Message) Scan(row dbutil.Scannable) (*Message, error) {
 	var timestamp int64
 	err := row.Scan(
-		&msg.ID, &msg.PartIndex, &msg.ThreadID, &msg.ThreadReceiver, &msg.Sender, &msg.OTID, &msg.MXID, &msg.RoomID, &timestamp, &msg.EditCount,
+		&msg.ID, &msg.PartIndex, &msg.ThreadID, &msg.ThreadReceiver, &msg.Sender, &msg.OTID, &msg.MXID, &msg.RoomID, &timestamp, &msg.EditCount, &msg.Subtype,
 	)
 	if err != nil {
 		return nil, err
@@ -205,7 +220,7 @@ func (msg *Message) Scan(row dbutil.Scannable) (*Message, error) {
 }
 
 func (msg *Message) sqlVariables() []any {
-	return []any{msg.ID, msg.PartIndex, msg.ThreadID, msg.ThreadReceiver, msg.Sender, msg.OTID, msg.MXID, msg.RoomID, msg.Timestamp.UnixMilli(), msg.EditCount}
+	return []any{msg.ID, msg.PartIndex, msg.ThreadID, msg.ThreadReceiver, msg.Sender, msg.OTID, msg.MXID, msg.RoomID, msg.Timestamp.UnixMilli(), msg.EditCount, msg.Subtype}
 }
 
 func (msg *Message) Insert(ctx context.Context) error {
@@ -232,3 +247,8 @@ func (msg *Message) UpdateEditTimestamp(ctx context.Context, ts int64) error {
 func (msg *Message) IsUnencrypted() bool {
 	return strings.HasPrefix(msg.ID, "mid.$")
 }
+
+// PortalKey returns the key of the portal the message was bridged in.
+func (msg *Message) PortalKey() PortalKey {
+	return PortalKey{ThreadID: msg.ThreadID, Receiver: msg.ThreadReceiver}
+}
@@ -0,0 +1,67 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/util/dbutil"
+)
+
+const (
+	getPollByMessageIDQuery = `
+		SELECT message_id, thread_receiver, enc_key, options FROM poll WHERE message_id=$1 AND thread_receiver=$2
+	`
+	insertPollQuery = `
+		INSERT INTO poll (message_id, thread_receiver, enc_key, options)
+		VALUES ($1, $2, $3, $4)
+	`
+)
+
+type PollQuery struct {
+	*dbutil.QueryHelper[*Poll]
+}
+
+func newPoll(qh *dbutil.QueryHelper[*Poll]) *Poll {
+	return &Poll{qh: qh}
+}
+
+// Poll stores the encryption key and option hashes of a poll bridged from Matrix, which are needed to send votes.
+type Poll struct {
+	qh *dbutil.QueryHelper[*Poll]
+
+	MessageID      string
+	ThreadReceiver int64
+
+	EncKey []byte
+	// OptionHashes maps Matrix answer IDs to the hashes WhatsApp uses to refer to the options in votes.
+	OptionHashes map[string][]byte
+}
+
+func (pq *PollQuery) GetByMessageID(ctx context.Context, msgID string, threadReceiver int64) (*Poll, error) {
+	return pq.QueryOne(ctx, getPollByMessageIDQuery, msgID, threadReceiver)
+}
+
+func (p *Poll) Scan(row dbutil.Scannable) (*Poll, error) {
+	return dbutil.ValueOrErr(p, row.Scan(
+		&p.MessageID, &p.ThreadReceiver, &p.EncKey, dbutil.JSON{Data: &p.OptionHashes},
+	))
+}
+
+func (p *Poll) Insert(ctx context.Context) error {
+	return p.qh.Exec(ctx, insertPollQuery, p.MessageID, p.ThreadReceiver, p.EncKey, dbutil.JSON{Data: p.OptionHashes})
+}
@@ -32,8 +32,8 @@ const (
 	portalBaseSelect = `
 		SELECT thread_id, receiver, thread_type, mxid,
 		       name, avatar_id, avatar_url, name_set, avatar_set,
-		       whatsapp_server, encrypted, relay_user_id,
-		       oldest_message_id, oldest_message_ts, more_to_backfill
+		       whatsapp_server, disappear_timer, encrypted, relay_user_id,
+		       oldest_message_id, oldest_message_ts, more_to_backfill, disable_transcoding
 		FROM portal
 	`
 	getPortalByMXIDQuery       = portalBaseSelect + `WHERE mxid=$1`
@@ -50,16 +50,16 @@ const (
 		INSERT INTO portal (
 			thread_id, receiver, thread_type, mxid,
 			name, avatar_id, avatar_url, name_set, avatar_set,
-			whatsapp_server, encrypted, relay_user_id,
-			oldest_message_id, oldest_message_ts, more_to_backfill
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			whatsapp_server, disappear_timer, encrypted, relay_user_id,
+			oldest_message_id, oldest_message_ts, more_to_backfill, disable_transcoding
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 	`
 	updatePortalQuery = `
 		UPDATE portal SET
 			thread_type=$3, mxid=$4,
 			name=$5, avatar_id=$6, avatar_url=$7, name_set=$8, avatar_set=$9,
-			whatsapp_server=$10, encrypted=$11, relay_user_id=$12,
-			oldest_message_id=$13, oldest_message_ts=$14, more_to_backfill=$15
+			whatsapp_server=$10, disappear_timer=$11, encrypted=$12, relay_user_id=$13,
+			oldest_message_id=$14, oldest_message_ts=$15, more_to_backfill=$16, disable_transcoding=$17
 		WHERE thread_id=$1 AND receiver=$2
 	`
 	deletePortalQuery = `DELETE FROM portal WHERE thread_id=$1 AND receiver=$2`
@@ -87,12 +87,15 @@ type Portal struct {
 	AvatarSet  bool
 
 	WhatsAppServer string
+	DisappearTimer uint32
 	Encrypted      bool
 	RelayUserID    id.UserID
 
 	OldestMessageID string
 	OldestMessageTS int64
 	MoreToBackfill  bool
+
+	DisableTranscoding bool
 }
 
 func newPortal(qh *dbutil.QueryHelper[*Portal]) *Portal {
@@ -135,6 +138,11 @@ func (p *Portal) IsPrivateChat() bool {
 	return p.ThreadType.IsOneToOne()
 }
 
+// IsSelfChat returns whether the portal is a private chat with the user themselves (i.e. "Note to Self").
+func (p *Portal) IsSelfChat() bool {
+	return p.IsPrivateChat() && p.ThreadID == p.Receiver
+}
+
 func (p *Portal) JID() types.JID {
 	jid := types.JID{
 		User:   strconv.FormatInt(p.ThreadID, 10),
@@ -166,11 +174,13 @@ func (p *Portal) Scan(row dbutil.Scannable) (*Portal, error) {
 		&p.NameSet,
 		&p.AvatarSet,
 		&p.WhatsAppServer,
+		&p.DisappearTimer,
 		&p.Encrypted,
 		&p.RelayUserID,
 		&p.OldestMessageID,
 		&p.OldestMessageTS,
 		&p.MoreToBackfill,
+		&p.DisableTranscoding,
 	)
 	if err != nil {
 		return nil, err
@@ -191,11 +201,13 @@ func (p *Portal) sqlVariables() []any {
 		p.NameSet,
 		p.AvatarSet,
 		p.WhatsAppServer,
+		p.DisappearTimer,
 		p.Encrypted,
 		p.RelayUserID,
 		p.OldestMessageID,
 		p.OldestMessageTS,
 		p.MoreToBackfill,
+		p.DisableTranscoding,
 	}
 }
 
@@ -1,4 +1,4 @@
--- v0 -> v6 (compatible with v3+): Latest revision
+-- v0 -> v10 (compatible with v3+): Latest revision
 
 CREATE TABLE portal (
     thread_id   BIGINT  NOT NULL,
@@ -12,7 +12,10 @@ CREATE TABLE portal (
     name_set    BOOLEAN NOT NULL DEFAULT false,
     avatar_set  BOOLEAN NOT NULL DEFAULT false,
 
-    whatsapp_server TEXT NOT NULL DEFAULT '',
+    whatsapp_server TEXT   NOT NULL DEFAULT '',
+    disappear_timer BIGINT NOT NULL DEFAULT 0,
+
+    disable_transcoding BOOLEAN NOT NULL DEFAULT false,
 
     encrypted     BOOLEAN NOT NULL DEFAULT false,
     relay_user_id TEXT    NOT NULL,
@@ -104,6 +107,7 @@ CREATE TABLE message (
 
     timestamp  BIGINT NOT NULL,
     edit_count BIGINT NOT NULL,
+    subtype    INTEGER NOT NULL DEFAULT 0,
 
     PRIMARY KEY (id, part_index, thread_receiver),
     CONSTRAINT message_portal_fkey FOREIGN KEY (thread_id, thread_receiver)
@@ -135,3 +139,18 @@ CREATE TABLE reaction (
         REFERENCES portal(thread_id, receiver) ON DELETE CASCADE ON UPDATE CASCADE,
     CONSTRAINT reaction_mxid_unique UNIQUE (mxid)
 );
+
+CREATE TABLE poll (
+    message_id      TEXT    NOT NULL,
+    -- Part index is not used by polls, but is required for the foreign key
+    _part_index     INTEGER NOT NULL DEFAULT 0,
+    thread_receiver BIGINT  NOT NULL,
+
+    enc_key bytea NOT NULL,
+    -- JSON object from Matrix answer IDs to the option hashes used in WhatsApp votes
+    options TEXT  NOT NULL,
+
+    PRIMARY KEY (message_id, thread_receiver),
+    CONSTRAINT poll_message_fkey FOREIGN KEY (message_id, _part_index, thread_receiver)
+        REFERENCES message (id, part_index, thread_receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
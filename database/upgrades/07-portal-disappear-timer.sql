@@ -0,0 +1,2 @@
+-- v7 (compatible with v3+): Store disappearing message timer for portals
+ALTER TABLE portal ADD COLUMN disappear_timer BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- v8 (compatible with v3+): Store message subtypes
+ALTER TABLE message ADD COLUMN subtype INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- v9 (compatible with v3+): Store whether media transcoding is disabled for portals
+ALTER TABLE portal ADD COLUMN disable_transcoding BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,15 @@
+-- v10 (compatible with v3+): Store poll keys and options for bridging votes
+CREATE TABLE poll (
+    message_id      TEXT    NOT NULL,
+    -- Part index is not used by polls, but is required for the foreign key
+    _part_index     INTEGER NOT NULL DEFAULT 0,
+    thread_receiver BIGINT  NOT NULL,
+
+    enc_key bytea NOT NULL,
+    -- JSON object from Matrix answer IDs to the option hashes used in WhatsApp votes
+    options TEXT  NOT NULL,
+
+    PRIMARY KEY (message_id, thread_receiver),
+    CONSTRAINT poll_message_fkey FOREIGN KEY (message_id, _part_index, thread_receiver)
+        REFERENCES message (id, part_index, thread_receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -26,6 +26,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/configupgrade"
+	"go.mau.fi/util/ffmpeg"
 	flag "maunium.net/go/mauflag"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridge"
@@ -86,6 +87,9 @@ type MetaBridge struct {
 	puppets             map[int64]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+
+	MediaCache *msgconv.MediaCache
+	Metrics    *MetricsHandler
 }
 
 var _ bridge.ChildOverride = (*MetaBridge)(nil)
@@ -160,6 +164,16 @@ func (br *MetaBridge) Init() {
 	}
 	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
 	br.RegisterCommands()
+	br.EventProcessor.On(msgconv.EventUnstablePollStart, br.MatrixHandler.HandleMessage)
+	br.EventProcessor.On(msgconv.EventUnstablePollResponse, br.MatrixHandler.HandleMessage)
+	br.EventProcessor.On(msgconv.EventUnstableBeacon, br.MatrixHandler.HandleMessage)
+	br.MediaCache = msgconv.NewMediaCache(br.Config.Bridge.MediaCache.TTL, br.Config.Bridge.MediaCache.MaxEntries)
+	if br.Config.Metrics.Enabled {
+		br.Metrics = NewMetricsHandler(br.Config.Metrics.Listen, br.ZLog.With().Str("component", "metrics").Logger())
+	}
+	if !ffmpeg.Supported() {
+		br.ZLog.Warn().Msg("ffmpeg not found, GIFs will be sent to WhatsApp as static images and voice messages won't be converted")
+	}
 
 	br.DeviceStore = sqlstore.NewWithDB(br.DB.RawDB, br.DB.Dialect.String(), waLog.Zerolog(br.ZLog.With().Str("db_section", "whatsmeow").Logger()))
 
@@ -178,14 +192,25 @@ func (br *MetaBridge) Start() {
 		br.ZLog.Debug().Msg("Initializing provisioning API")
 		br.provisioning.Init()
 	}
+	if br.Metrics != nil {
+		go br.Metrics.Start()
+	}
 	go br.StartUsers()
 }
 
 func (br *MetaBridge) Stop() {
+	if br.Metrics != nil {
+		br.Metrics.Stop()
+	}
 	for _, user := range br.usersByMXID {
 		user.log.Debug().Msg("Disconnecting user")
 		user.Disconnect()
 	}
+	br.portalsLock.Lock()
+	for _, portal := range br.portalsByID {
+		portal.stopScheduledMessages(portal.log.WithContext(context.Background()))
+	}
+	br.portalsLock.Unlock()
 }
 
 func (br *MetaBridge) GetIPortal(mxid id.RoomID) bridge.Portal {
@@ -38,25 +38,34 @@ var (
 	errUserNotLoggedIn             = errors.New("user is not logged in and chat has no relay bot")
 	errRelaybotNotLoggedIn         = errors.New("neither user nor relay bot of chat are logged in")
 	errCantRelayReactions          = errors.New("user is not logged in and reactions can't be relayed")
+	errCantRelayPollVotes          = errors.New("user is not logged in and poll votes can't be relayed")
 	errMNoticeDisabled             = errors.New("bridging m.notice messages is disabled")
 	errUnexpectedParsedContentType = errors.New("unexpected parsed content type")
+	errDryRunMessage               = errors.New("message was converted in dry run mode")
 
-	errServerRejected = errors.New("server rejected message")
+	errServerRejected  = errors.New("server rejected message")
+	errMediaNotAllowed = errors.New("media is not allowed in this business thread")
 
 	errRedactionTargetNotFound          = errors.New("redaction target message was not found")
 	errRedactionTargetSentBySomeoneElse = errors.New("redaction target message was sent by someone else")
 	errUnreactTargetSentBySomeoneElse   = errors.New("redaction target reaction was sent by someone else")
 	errReactionTargetNotFound           = errors.New("reaction target message not found")
+	errPollTargetNotFound               = errors.New("poll response target poll not found")
 	errEditUnknownTarget                = errors.New("unknown edit target message")
 	errFailedToGetEditTarget            = errors.New("failed to get edit target message")
 	errEditDifferentSender              = errors.New("can't edit message sent by another user")
 	errEditTooOld                       = errors.New("message is too old to be edited")
 	errEditCountExceeded                = errors.New("message has been edited too many times")
 	errEditReverted                     = errors.New("server reverted the edit")
+	errEditCaptionUnsupported           = errors.New("editing media captions is not supported")
+	errEditScheduledMessage             = errors.New("scheduled messages can't be edited before they're sent")
 
 	errMessageTakingLong     = errors.New("bridging the message is taking longer than usual")
 	errTimeoutBeforeHandling = errors.New("message timed out before handling was started")
 
+	errScheduledTooFar          = errors.New("message is scheduled too far in the future")
+	errScheduledSendInterrupted = errors.New("the bridge was stopped before the scheduled send time")
+
 	errReloading = errors.New("refresh error; please retry in a few minutes")
 	errLoggedOut = errors.New("logged out; please relogin to send the message")
 )
@@ -67,14 +76,39 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		errors.Is(err, msgconv.ErrUnsupportedMsgType),
 		errors.Is(err, msgconv.ErrInvalidGeoURI):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, msgconv.ErrConversionTimeout):
+		// Checked before the media errors, as timeouts during media processing also wrap the media error
+		return event.MessageStatusTooOld, event.MessageStatusRetriable, false, true, "converting the message took too long and was cancelled"
+	case errors.Is(err, msgconv.ErrMediaDownloadFailed),
+		errors.Is(err, msgconv.ErrMediaUploadFailed):
+		return event.MessageStatusGenericError, event.MessageStatusRetriable, true, true, err.Error()
+	case errors.Is(err, msgconv.ErrMediaDecryptFailed):
+		// The file or the keys in the event are broken, so retrying won't help
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, "couldn't decrypt your attachment"
+	case errors.Is(err, msgconv.ErrMediaConvertFailed),
+		errors.Is(err, msgconv.ErrMediaTooLarge),
+		errors.Is(err, msgconv.ErrMediaCorrupt),
+		errors.Is(err, msgconv.ErrMessageTooLong):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, err.Error()
 	case errors.Is(err, errMNoticeDisabled):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, false, err.Error()
 	case errors.Is(err, errEditDifferentSender),
 		errors.Is(err, errEditTooOld),
 		errors.Is(err, errEditReverted),
 		errors.Is(err, errEditCountExceeded),
-		errors.Is(err, errEditUnknownTarget):
+		errors.Is(err, errEditUnknownTarget),
+		errors.Is(err, errEditCaptionUnsupported),
+		errors.Is(err, errEditScheduledMessage),
+		errors.Is(err, msgconv.ErrEditNotCaptioned),
+		errors.Is(err, msgconv.ErrUnsupportedReaction),
+		errors.Is(err, msgconv.ErrUnsupportedEffect),
+		errors.Is(err, msgconv.ErrUnsupportedSticker),
+		errors.Is(err, msgconv.ErrUnknownPollAnswer),
+		errors.Is(err, errMediaNotAllowed),
+		errors.Is(err, errScheduledTooFar):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, msgconv.ErrRoomMentionNotAllowed):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, err.Error()
 	case errors.Is(err, errTimeoutBeforeHandling):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, "the message was too old when it reached the bridge, so it was not handled"
 	case errors.Is(err, context.DeadlineExceeded):
@@ -83,10 +117,13 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		errors.Is(err, errReloading),
 		errors.Is(err, errLoggedOut):
 		return event.MessageStatusGenericError, event.MessageStatusRetriable, false, true, err.Error()
+	case errors.Is(err, errScheduledSendInterrupted):
+		return event.MessageStatusGenericError, event.MessageStatusRetriable, true, true, err.Error()
 	case errors.Is(err, errMessageTakingLong):
 		return event.MessageStatusTooOld, event.MessageStatusPending, false, true, err.Error()
 	case errors.Is(err, errRedactionTargetNotFound),
 		errors.Is(err, errReactionTargetNotFound),
+		errors.Is(err, errPollTargetNotFound),
 		errors.Is(err, errRedactionTargetSentBySomeoneElse),
 		errors.Is(err, errUnreactTargetSentBySomeoneElse):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, ""
@@ -117,10 +154,10 @@ func (portal *Portal) sendErrorMessage(ctx context.Context, evt *event.Event, er
 		msgType = "reaction"
 	case event.EventRedaction:
 		msgType = "redaction"
-	//case TypeMSC3381PollResponse, TypeMSC3381V2PollResponse:
-	//	msgType = "poll response"
-	//case TypeMSC3381PollStart:
-	//	msgType = "poll start"
+	case msgconv.EventUnstablePollResponse:
+		msgType = "poll response"
+	case msgconv.EventUnstablePollStart:
+		msgType = "poll start"
 	default:
 		msgType = "unknown event"
 	}
@@ -42,6 +42,8 @@ type ReplyMetaData struct {
 	ReplySourceType int64  `json:"reply_source_type"` // 1 ?
 	ReplyType       int64  `json:"reply_type"`        // ?
 	ReplySender     int64  `json:"-"`
+	// ReplyChatJID is the WhatsApp JID of the chat the replied-to message is in, if it's not the current chat.
+	ReplyChatJID string `json:"-"`
 }
 
 type MentionData struct {
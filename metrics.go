@@ -0,0 +1,98 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-meta/msgconv"
+)
+
+// MetricsHandler exports Prometheus metrics about the bridge. It implements msgconv.ConversionMetrics,
+// so it can be set as the metrics receiver of message converters.
+type MetricsHandler struct {
+	registry *prometheus.Registry
+	server   *http.Server
+	log      zerolog.Logger
+
+	conversions       *prometheus.CounterVec
+	mediaStepDuration *prometheus.HistogramVec
+	mediaStepSize     *prometheus.HistogramVec
+}
+
+var _ msgconv.ConversionMetrics = (*MetricsHandler)(nil)
+
+func NewMetricsHandler(address string, log zerolog.Logger) *MetricsHandler {
+	mh := &MetricsHandler{
+		registry: prometheus.NewRegistry(),
+		log:      log,
+
+		conversions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bridge_matrix_conversions_total",
+			Help: "Number of Matrix messages converted to Meta or WhatsApp by msgtype and outcome",
+		}, []string{"msgtype", "outcome"}),
+		mediaStepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bridge_matrix_media_step_duration_seconds",
+			Help:    "Time taken by each step of bridging Matrix media",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"msgtype", "step"}),
+		mediaStepSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bridge_matrix_media_step_size_bytes",
+			Help:    "Size of the data produced by each step of bridging Matrix media",
+			Buckets: prometheus.ExponentialBuckets(16*1024, 4, 8),
+		}, []string{"msgtype", "step"}),
+	}
+	mh.registry.MustRegister(mh.conversions, mh.mediaStepDuration, mh.mediaStepSize)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(mh.registry, promhttp.HandlerOpts{}))
+	mh.server = &http.Server{Addr: address, Handler: mux}
+	return mh
+}
+
+func (mh *MetricsHandler) Start() {
+	mh.log.Info().Str("address", mh.server.Addr).Msg("Starting metrics listener")
+	err := mh.server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		mh.log.Err(err).Msg("Error in metrics listener")
+	}
+}
+
+func (mh *MetricsHandler) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := mh.server.Shutdown(ctx)
+	if err != nil {
+		mh.log.Err(err).Msg("Failed to stop metrics listener")
+	}
+}
+
+func (mh *MetricsHandler) ObserveConversion(msgType event.MessageType, outcome msgconv.ConversionOutcome) {
+	mh.conversions.WithLabelValues(string(msgType), string(outcome)).Inc()
+}
+
+func (mh *MetricsHandler) ObserveMediaStep(msgType event.MessageType, step msgconv.MediaStep, duration time.Duration, size int) {
+	mh.mediaStepDuration.WithLabelValues(string(msgType), string(step)).Observe(duration.Seconds())
+	mh.mediaStepSize.WithLabelValues(string(msgType), string(step)).Observe(float64(size))
+}
@@ -0,0 +1,78 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/util/random"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"go.mau.fi/whatsmeow/binary/armadillo/waMsgApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+// AlbumItem is a single media event that should be sent as a part of an album.
+type AlbumItem struct {
+	Event   *event.Event
+	Content *event.MessageEventContent
+}
+
+// IsAlbumMsgType returns true if media of the given type can be grouped into an album.
+func IsAlbumMsgType(msgType event.MessageType) bool {
+	return msgType == event.MsgImage || msgType == event.MsgVideo
+}
+
+// ToWhatsAppAlbum converts a batch of Matrix media events into WhatsApp messages that are grouped
+// together as an album. Each item keeps its own caption. If the batch can't be sent as an album
+// (e.g. it contains something other than images and videos), the messages are returned without
+// the grouping metadata, so they'll be sent individually.
+func (mc *MessageConverter) ToWhatsAppAlbum(
+	ctx context.Context,
+	items []AlbumItem,
+	relaybotFormatted bool,
+) ([]*waConsumerApplication.ConsumerApplication, []*waMsgApplication.MessageApplication_Metadata, error) {
+	canGroup := len(items) > 1
+	for _, item := range items {
+		if !IsAlbumMsgType(item.Content.MsgType) {
+			canGroup = false
+		}
+	}
+	groupID := strings.ToUpper(random.String(32))
+	messages := make([]*waConsumerApplication.ConsumerApplication, len(items))
+	metas := make([]*waMsgApplication.MessageApplication_Metadata, len(items))
+	for i, item := range items {
+		var err error
+		messages[i], metas[i], err = mc.ToWhatsApp(ctx, item.Event, item.Content, relaybotFormatted)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to convert album item #%d: %w", i+1, err)
+		}
+		// The media type may change during reupload (e.g. GIFs are converted to videos)
+		if canGroup && !IsAlbumMsgType(item.Content.MsgType) {
+			canGroup = false
+		}
+	}
+	if canGroup {
+		for i, meta := range metas {
+			meta.GroupID = groupID
+			meta.GroupSize = uint32(len(metas))
+			meta.GroupIndex = uint32(i)
+		}
+	}
+	return messages, metas, nil
+}
@@ -0,0 +1,86 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestAlbum(t *testing.T, msgTypes ...event.MessageType) (*MessageConverter, []AlbumItem) {
+	t.Helper()
+	media := fixtureDownloader{}
+	items := make([]AlbumItem, len(msgTypes))
+	for i, msgType := range msgTypes {
+		content, data := newTestMediaContent(t, msgType, fmt.Sprintf("caption %d", i+1), fmt.Sprintf("file%d", i+1))
+		content.URL = id.ContentURIString(fmt.Sprintf("mxc://example.com/media%d", i+1))
+		media[content.URL] = data
+		items[i] = AlbumItem{
+			Event: &event.Event{
+				Type:    event.EventMessage,
+				Sender:  "@alice:example.com",
+				ID:      id.EventID(fmt.Sprintf("$item%d", i+1)),
+				Content: event.Content{Parsed: content, Raw: map[string]any{}},
+			},
+			Content: content,
+		}
+	}
+	mc := &MessageConverter{
+		PortalMethods:   newTestPortal(),
+		MediaDownloader: media,
+		MediaUploader:   HashMediaUploader{DirectPath: testDirectPath},
+	}
+	return mc, items
+}
+
+func TestToWhatsAppAlbum(t *testing.T) {
+	mc, items := newTestAlbum(t, event.MsgImage, event.MsgVideo, event.MsgImage)
+	messages, metas, err := mc.ToWhatsAppAlbum(context.Background(), items, false)
+	if err != nil {
+		t.Fatalf("failed to convert album: %v", err)
+	}
+	groupID := metas[0].GetGroupID()
+	if groupID == "" {
+		t.Fatal("album doesn't have a group ID")
+	}
+	for i, meta := range metas {
+		if meta.GetGroupID() != groupID || meta.GetGroupSize() != 3 || meta.GetGroupIndex() != uint32(i) {
+			t.Errorf("item %d group = %s %d/%d, want %s %d/3", i, meta.GetGroupID(), meta.GetGroupIndex(), meta.GetGroupSize(), groupID, i)
+		}
+		caption := testCaption(t, messages[i].GetPayload().GetContent().GetContent())
+		if want := fmt.Sprintf("caption %d", i+1); caption.GetText() != want {
+			t.Errorf("item %d caption = %q, want %q", i, caption.GetText(), want)
+		}
+	}
+}
+
+func TestToWhatsAppAlbumWithFile(t *testing.T) {
+	mc, items := newTestAlbum(t, event.MsgImage, event.MsgFile)
+	_, metas, err := mc.ToWhatsAppAlbum(context.Background(), items, false)
+	if err != nil {
+		t.Fatalf("failed to convert album: %v", err)
+	}
+	for i, meta := range metas {
+		if meta.GetGroupID() != "" || meta.GetGroupSize() != 0 {
+			t.Errorf("item %d is grouped into %s of %d, want no grouping", i, meta.GetGroupID(), meta.GetGroupSize())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+// EventUnstableBeacon is the MSC3489 event that contains a location update of a live location share.
+var EventUnstableBeacon = event.Type{Type: "org.matrix.msc3672.beacon", Class: event.MessageEventType}
+
+type BeaconLocation struct {
+	URI         string `json:"uri"`
+	Description string `json:"description,omitempty"`
+}
+
+type beaconEventContent struct {
+	Location  *BeaconLocation `json:"org.matrix.msc3488.location"`
+	Timestamp int64           `json:"org.matrix.msc3488.ts"`
+}
+
+func parseBeacon(evt *event.Event) (*beaconEventContent, error) {
+	var parsed beaconEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse beacon content: %w", err)
+	} else if parsed.Location == nil || parsed.Location.URI == "" {
+		return nil, fmt.Errorf("%w: beacon doesn't contain a location", ErrInvalidGeoURI)
+	}
+	if parsed.Timestamp == 0 {
+		parsed.Timestamp = evt.Timestamp
+	}
+	return &parsed, nil
+}
+
+// BeaconToStaticLocation converts a live location update into a normal location message,
+// which can be used in chats where live locations aren't supported.
+func BeaconToStaticLocation(evt *event.Event, content *event.MessageEventContent) error {
+	beacon, err := parseBeacon(evt)
+	if err != nil {
+		return err
+	}
+	content.MsgType = event.MsgLocation
+	content.GeoURI = beacon.Location.URI
+	content.Body = beacon.Location.Description
+	return nil
+}
+
+// BeaconToWhatsApp converts a live location update into a WhatsApp live location message.
+//
+// The armadillo live location message doesn't have a field for the total duration of the share,
+// so only the current position is sent and WhatsApp clients show it until the next update.
+func (mc *MessageConverter) BeaconToWhatsApp(ctx context.Context, evt *event.Event) (*waConsumerApplication.ConsumerApplication_LiveLocationMessage, error) {
+	beacon, err := parseBeacon(evt)
+	if err != nil {
+		return nil, err
+	}
+	lat, long, uncertainty, err := parseGeoURI(beacon.Location.URI)
+	if err != nil {
+		return nil, err
+	}
+	liveLocation := &waConsumerApplication.ConsumerApplication_LiveLocationMessage{
+		Location: &waConsumerApplication.ConsumerApplication_Location{
+			DegreesLatitude:  lat,
+			DegreesLongitude: long,
+		},
+		AccuracyInMeters: uint32(uncertainty),
+		// The timestamp of the update is used as the sequence number, as it's always increasing
+		SequenceNumber: beacon.Timestamp,
+	}
+	if beacon.Location.Description != "" {
+		liveLocation.Caption = &waCommon.MessageText{Text: beacon.Location.Description}
+	}
+	return liveLocation, nil
+}
@@ -0,0 +1,92 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"html"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// hasMediaCaption returns whether the body of a Matrix media message is a caption. Per the current spec,
+// the body is always the caption when a separate file name is present. Older clients put the file name
+// in the body and either leave the file name field empty or duplicate it, neither of which is a caption.
+// A body that equals the file name is still a caption if it has formatting, as clients don't format
+// file names.
+func hasMediaCaption(content *event.MessageEventContent) bool {
+	if content.FileName == "" {
+		return false
+	}
+	caption := strings.TrimSpace(content.Body)
+	if caption == "" {
+		return false
+	} else if caption != content.FileName {
+		return true
+	}
+	return hasCaptionFormatting(content, caption)
+}
+
+// hasCaptionFormatting returns whether the formatted body of a message contains anything other than
+// the escaped plaintext caption.
+func hasCaptionFormatting(content *event.MessageEventContent, caption string) bool {
+	if content.Format != event.FormatHTML {
+		return false
+	}
+	formatted := strings.TrimSpace(content.FormattedBody)
+	return formatted != "" && formatted != html.EscapeString(caption)
+}
+
+// CaptionPlacement is where the caption of a media message is sent.
+type CaptionPlacement string
+
+const (
+	// CaptionAttached sends the caption as a part of the media message.
+	CaptionAttached CaptionPlacement = "attached"
+	// CaptionBefore sends the caption as a separate text message before the media.
+	CaptionBefore CaptionPlacement = "before"
+	// CaptionAfter sends the caption as a separate text message after the media.
+	CaptionAfter CaptionPlacement = "after"
+)
+
+// captionPlacement returns where the caption of a Matrix message should be sent. Messages that aren't
+// captioned media always have the caption attached, i.e. there's no separate caption message.
+func (mc *MessageConverter) captionPlacement(content *event.MessageEventContent) CaptionPlacement {
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+	default:
+		return CaptionAttached
+	}
+	if !hasMediaCaption(content) {
+		return CaptionAttached
+	}
+	switch mc.CaptionPlacement {
+	case CaptionBefore, CaptionAfter:
+		return mc.CaptionPlacement
+	default:
+		return CaptionAttached
+	}
+}
+
+// mediaFileName returns the file name of a Matrix media message, falling back to the body for
+// older clients that don't set the file name field.
+func mediaFileName(content *event.MessageEventContent) string {
+	if content.FileName != "" {
+		return content.FileName
+	}
+	return content.Body
+}
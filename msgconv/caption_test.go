@@ -0,0 +1,65 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestHasMediaCaption(t *testing.T) {
+	tests := []struct {
+		name    string
+		content *event.MessageEventContent
+		want    bool
+	}{
+		{name: "No file name", content: &event.MessageEventContent{Body: "image.png"}},
+		{name: "Body is file name", content: &event.MessageEventContent{Body: "image.png", FileName: "image.png"}},
+		{name: "Whitespace body", content: &event.MessageEventContent{Body: " \n ", FileName: "image.png"}},
+		{name: "Separate caption", content: &event.MessageEventContent{Body: "look at this", FileName: "image.png"}, want: true},
+		{
+			name: "Escaped file name as formatted body",
+			content: &event.MessageEventContent{
+				Body: "cats & dogs.png", FileName: "cats & dogs.png",
+				Format: event.FormatHTML, FormattedBody: "cats &amp; dogs.png",
+			},
+		},
+		{
+			name: "Formatted caption equal to file name",
+			content: &event.MessageEventContent{
+				Body: "image.png", FileName: "image.png",
+				Format: event.FormatHTML, FormattedBody: "<b>image.png</b>",
+			},
+			want: true,
+		},
+		{
+			name: "Formatted body without HTML format",
+			content: &event.MessageEventContent{
+				Body: "image.png", FileName: "image.png",
+				FormattedBody: "<b>image.png</b>",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := hasMediaCaption(test.content); got != test.want {
+				t.Errorf("hasMediaCaption() = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
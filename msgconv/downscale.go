@@ -0,0 +1,70 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+const downscaledJPEGQuality = 90
+
+// downscaleImage scales an image down so that neither dimension exceeds maxSize, preserving the aspect ratio.
+// The EXIF orientation is applied to the pixels, as the re-encoded image doesn't have EXIF data. JPEGs are
+// re-encoded as JPEG and everything else as PNG to keep transparency. If the image is already small enough,
+// nil is returned.
+func downscaleImage(data []byte, mimeType string, maxSize int) ([]byte, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image config: %w", err)
+	} else if cfg.Width <= maxSize && cfg.Height <= maxSize {
+		return nil, "", nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	img = applyOrientation(img, jpegOrientation(data))
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > maxSize {
+		h = max(h*maxSize/w, 1)
+		w = maxSize
+	}
+	if h > maxSize {
+		w = max(w*maxSize/h, 1)
+		h = maxSize
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	var buf bytes.Buffer
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: downscaledJPEGQuality})
+	} else {
+		mimeType = "image/png"
+		err = png.Encode(&buf, scaled)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode downscaled image: %w", err)
+	}
+	return buf.Bytes(), mimeType, nil
+}
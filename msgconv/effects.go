@@ -0,0 +1,77 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// MessageEffectField is the custom field in the content of Matrix message events that requests
+// a Messenger message effect, like a nudge or a visual effect, to be sent with the message.
+// The value is the name of the effect, e.g. `"fi.mau.meta.effect": "hot_emoji_large"`.
+const MessageEffectField = "fi.mau.meta.effect"
+
+// hotEmojiSizes maps effect names to the sizes of "hot" emojis, which are the enlarged emojis that
+// Messenger sends when the emoji button is held down. They're only supported in text messages.
+var hotEmojiSizes = map[string]int32{
+	"hot_emoji_small":  1,
+	"hot_emoji_medium": 2,
+	"hot_emoji_large":  3,
+}
+
+// getMessageEffect returns the name of the message effect requested in the event, if any.
+func getMessageEffect(evt *event.Event) (string, error) {
+	rawEffect, ok := evt.Content.Raw[MessageEffectField]
+	if !ok {
+		return "", nil
+	}
+	effect, _ := rawEffect.(string)
+	if effect == "" {
+		return "", fmt.Errorf("%w: effect name must be a non-empty string", ErrUnsupportedEffect)
+	}
+	return effect, nil
+}
+
+// checkMessageEffect returns an error if the event requests a message effect, as effects can't be sent
+// to WhatsApp. This is so that the message isn't silently sent without the effect the user asked for.
+func checkMessageEffect(evt *event.Event) error {
+	effect, err := getMessageEffect(evt)
+	if err != nil || effect == "" {
+		return err
+	} else if _, isHotEmoji := hotEmojiSizes[effect]; isHotEmoji {
+		return fmt.Errorf("%w %q in encrypted chats", ErrUnsupportedEffect, effect)
+	}
+	return fmt.Errorf("%w %q", ErrUnsupportedEffect, effect)
+}
+
+// metaHotEmojiSize returns the hot emoji size for the effect requested in the event, or an error if the
+// effect isn't known or can't be sent with the message.
+func metaHotEmojiSize(evt *event.Event, content *event.MessageEventContent) (int32, error) {
+	effect, err := getMessageEffect(evt)
+	if err != nil || effect == "" {
+		return 0, err
+	}
+	size, ok := hotEmojiSizes[effect]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnsupportedEffect, effect)
+	} else if msgType := conversionMsgType(evt, content); msgType != event.MsgText {
+		return 0, fmt.Errorf("%w %q in %s messages", ErrUnsupportedEffect, effect, msgType)
+	}
+	return size, nil
+}
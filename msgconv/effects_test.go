@@ -0,0 +1,91 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-meta/messagix/socket"
+)
+
+func newTestEffectEvent(msgType event.MessageType, effect any) *event.Event {
+	content := &event.MessageEventContent{MsgType: msgType, Body: "👍"}
+	return &event.Event{
+		Type: event.EventMessage,
+		Content: event.Content{
+			Parsed: content,
+			Raw:    map[string]any{"msgtype": string(msgType), "body": content.Body, MessageEffectField: effect},
+		},
+	}
+}
+
+func TestToMetaHotEmoji(t *testing.T) {
+	mc := &MessageConverter{PortalMethods: newTestPortal()}
+	evt := newTestEffectEvent(event.MsgText, "hot_emoji_large")
+	tasks, _, err := mc.ToMeta(context.Background(), evt, evt.Content.AsMessage(), false)
+	if err != nil {
+		t.Fatalf("ToMeta returned error: %v", err)
+	}
+	task, ok := tasks[0].(*socket.SendMessageTask)
+	if !ok {
+		t.Fatalf("first task is %T, want *socket.SendMessageTask", tasks[0])
+	}
+	if task.HotEmojiSize != 3 {
+		t.Errorf("hot emoji size = %d, want 3", task.HotEmojiSize)
+	}
+	if task.Text != "👍" {
+		t.Errorf("text = %q, want %q", task.Text, "👍")
+	}
+}
+
+func TestMessageEffectErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgType event.MessageType
+		effect  any
+	}{
+		{name: "Unknown effect", msgType: event.MsgText, effect: "fireworks"},
+		{name: "Empty effect", msgType: event.MsgText, effect: ""},
+		{name: "Non-string effect", msgType: event.MsgText, effect: 3},
+		{name: "Hot emoji in notice", msgType: event.MsgNotice, effect: "hot_emoji_small"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mc := &MessageConverter{PortalMethods: newTestPortal()}
+			evt := newTestEffectEvent(test.msgType, test.effect)
+			_, _, err := mc.ToMeta(context.Background(), evt, evt.Content.AsMessage(), false)
+			if !errors.Is(err, ErrUnsupportedEffect) {
+				t.Errorf("ToMeta error = %v, want ErrUnsupportedEffect", err)
+			}
+		})
+	}
+}
+
+func TestCheckMessageEffectWhatsApp(t *testing.T) {
+	if err := checkMessageEffect(newTestEffectEvent(event.MsgText, "hot_emoji_medium")); !errors.Is(err, ErrUnsupportedEffect) {
+		t.Errorf("checkMessageEffect error = %v, want ErrUnsupportedEffect", err)
+	}
+	evt := newTestEffectEvent(event.MsgText, nil)
+	delete(evt.Content.Raw, MessageEffectField)
+	if err := checkMessageEffect(evt); err != nil {
+		t.Errorf("checkMessageEffect error = %v without an effect, want nil", err)
+	}
+}
@@ -0,0 +1,131 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type customEmoji struct {
+	URL id.ContentURIString
+	Alt string
+}
+
+func parseCustomEmoji(token html.Token) (customEmoji, bool) {
+	if token.Data != "img" {
+		return customEmoji{}, false
+	}
+	var emoji customEmoji
+	var isEmoticon bool
+	var title string
+	for _, attr := range token.Attr {
+		switch attr.Key {
+		case "data-mx-emoticon":
+			isEmoticon = true
+		case "src":
+			emoji.URL = id.ContentURIString(attr.Val)
+		case "alt":
+			emoji.Alt = attr.Val
+		case "title":
+			title = attr.Val
+		}
+	}
+	if emoji.Alt == "" {
+		emoji.Alt = title
+	}
+	return emoji, isEmoticon
+}
+
+// replaceCustomEmojis replaces custom emoji images in HTML with their alt text (usually the shortcode),
+// as WhatsApp doesn't support inline images and the HTML parser would drop them entirely.
+func replaceCustomEmojis(formattedBody string) string {
+	if !strings.Contains(formattedBody, "data-mx-emoticon") {
+		return formattedBody
+	}
+	var out strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(formattedBody))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if !errors.Is(tokenizer.Err(), io.EOF) {
+				return formattedBody
+			}
+			return out.String()
+		}
+		if tokenType == html.StartTagToken || tokenType == html.SelfClosingTagToken {
+			if emoji, ok := parseCustomEmoji(tokenizer.Token()); ok {
+				out.WriteString(html.EscapeString(emoji.Alt))
+				continue
+			}
+		}
+		out.Write(tokenizer.Raw())
+	}
+}
+
+// singleCustomEmoji checks whether the message consists of nothing but one custom emoji.
+func singleCustomEmoji(content *event.MessageEventContent) (customEmoji, bool) {
+	if content.Format != event.FormatHTML || !strings.Contains(content.FormattedBody, "data-mx-emoticon") {
+		return customEmoji{}, false
+	}
+	var found customEmoji
+	var count int
+	tokenizer := html.NewTokenizer(strings.NewReader(content.FormattedBody))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return found, count == 1 && errors.Is(tokenizer.Err(), io.EOF) && found.URL != ""
+		case html.TextToken:
+			if strings.TrimSpace(string(tokenizer.Text())) != "" {
+				return customEmoji{}, false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if emoji, ok := parseCustomEmoji(token); ok {
+				found = emoji
+				count++
+			} else if token.Data == "img" {
+				return customEmoji{}, false
+			}
+		}
+	}
+}
+
+// customEmojiToSticker turns a message that only contains a custom emoji into a sticker message.
+func (mc *MessageConverter) customEmojiToSticker(content *event.MessageEventContent) bool {
+	if !mc.CustomEmojiStickers {
+		return false
+	}
+	emoji, ok := singleCustomEmoji(content)
+	if !ok || emoji.URL.ParseOrIgnore().IsEmpty() {
+		return false
+	}
+	content.MsgType = event.MessageType(event.EventSticker.Type)
+	content.URL = emoji.URL
+	content.Body = emoji.Alt
+	content.Format = ""
+	content.FormattedBody = ""
+	if content.Info == nil {
+		content.Info = &event.FileInfo{}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// WhatsAppEstimate is the predicted result of converting a Matrix message with ToWhatsApp.
+type WhatsAppEstimate struct {
+	// MsgType is the type of message that will be sent, e.g. m.video for GIFs that are converted to videos.
+	MsgType event.MessageType
+	// RequiresUpload is true if media will have to be downloaded from Matrix and uploaded to WhatsApp.
+	RequiresUpload bool
+	// Size is the approximate size of the message in bytes. For media, it's the size of the Matrix file
+	// declared by the client (or zero if it's not declared), as the converted file size can't be known in advance.
+	Size int
+}
+
+// EstimateWhatsApp predicts what ToWhatsApp will send for the given message without downloading, converting
+// or uploading anything, e.g. for enforcing rate limits or warning about large files before sending.
+// The content isn't modified, so it can be passed to ToWhatsApp afterwards.
+func (mc *MessageConverter) EstimateWhatsApp(ctx context.Context, evt *event.Event, content *event.MessageEventContent, relaybotFormatted bool) (*WhatsAppEstimate, error) {
+	err := checkMessageEffect(evt)
+	if err != nil {
+		return nil, err
+	}
+	// The routing only replaces top-level fields, so a shallow copy is enough to leave the original untouched
+	routed := *content
+	mc.routeWhatsAppMsgType(evt, &routed, relaybotFormatted)
+	estimate := &WhatsAppEstimate{MsgType: routed.MsgType}
+	switch routed.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+		estimate.Size = len(routed.Body)
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile, event.MessageType(event.EventSticker.Type):
+		if isVCardFile(&routed) {
+			// vCards are usually converted into contact messages, which only requires downloading the file
+			estimate.Size = routed.GetInfo().Size
+			break
+		}
+		if cached := mc.MediaCache.get(mc.mediaCacheKey(ctx, evt, &routed)); cached != nil {
+			estimate.MsgType = cached.MsgType
+			break
+		}
+		estimate.RequiresUpload = true
+		estimate.Size = routed.GetInfo().Size
+		// Conversions that fail when reuploading (e.g. HEIC images) change the type again, which can't be predicted
+		estimate.MsgType, _ = mc.routeWhatsAppMedia(ctx, routed.MsgType, estimateMediaProperties(evt, &routed))
+	case event.MsgLocation, event.MessageType(EventUnstableBeacon.Type), event.MessageType(EventUnstablePollStart.Type):
+		estimate.Size = len(evt.Content.VeryRaw)
+	default:
+		if !mc.SendUnsupportedAsText {
+			return nil, fmt.Errorf("%w %s", ErrUnsupportedMsgType, routed.MsgType)
+		}
+		estimate.MsgType = event.MsgText
+		estimate.Size = len(routed.Body)
+	}
+	return estimate, nil
+}
@@ -0,0 +1,162 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"testing"
+
+	"go.mau.fi/util/ffmpeg"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestEstimateMatchesConversion(t *testing.T) {
+	sticker := event.MessageType(event.EventSticker.Type)
+	tests := []struct {
+		name                string
+		msgType             event.MessageType
+		mimeType            string
+		fileName            string
+		data                []byte
+		width, height       int
+		rawInfo             map[string]any
+		setup               func(mc *MessageConverter)
+		transcodingDisabled bool
+		needsFFmpeg         bool
+		want                event.MessageType
+	}{
+		{
+			name: "Native GIF without ffmpeg", msgType: event.MsgImage, mimeType: "image/gif", fileName: "cat.gif",
+			data: encodeTestGIF(t, 32, 32), width: 32, height: 32,
+			setup: func(mc *MessageConverter) { mc.NativeGIFs = true },
+			want:  event.MsgVideo,
+		},
+		{
+			name: "GIF too large to send natively", msgType: event.MsgImage, mimeType: "image/gif", fileName: "cat.gif",
+			data: encodeTestGIF(t, 32, 32), width: 32, height: 32,
+			setup: func(mc *MessageConverter) { mc.NativeGIFs, mc.MaxNativeGIFDimension = true, 16 },
+			want:  event.MsgImage,
+		},
+		{
+			name: "GIF with transcoding disabled", msgType: event.MsgImage, mimeType: "image/gif", fileName: "cat.gif",
+			data: encodeTestGIF(t, 32, 32), width: 32, height: 32, transcodingDisabled: true,
+			want: event.MsgVideo,
+		},
+		{
+			name: "GIF converted with ffmpeg", msgType: event.MsgImage, mimeType: "image/gif", fileName: "cat.gif",
+			data: encodeTestGIF(t, 32, 32), width: 32, height: 32, needsFFmpeg: true,
+			want: event.MsgVideo,
+		},
+		{
+			name: "Animated WebP", msgType: event.MsgImage, mimeType: "image/webp", fileName: "party.webp",
+			data: testAnimatedWebP, width: 16, height: 16, rawInfo: map[string]any{"is_animated": true}, needsFFmpeg: true,
+			want: event.MsgVideo,
+		},
+		{
+			name: "Animated WebP without ffmpeg", msgType: event.MsgImage, mimeType: "image/webp", fileName: "party.webp",
+			data: testAnimatedWebP, width: 16, height: 16, rawInfo: map[string]any{"is_animated": true},
+			want: event.MsgImage,
+		},
+		{
+			name: "Sticker-like PNG", msgType: event.MsgImage, mimeType: "image/png", fileName: "emoji.png",
+			data: encodeTestPNG(t, 64, 64), width: 64, height: 64,
+			setup: func(mc *MessageConverter) { mc.StickerLikeImages, mc.MaxStickerLikeDimension = true, 128 },
+			want:  sticker,
+		},
+		{
+			name: "Large PNG", msgType: event.MsgImage, mimeType: "image/png", fileName: "photo.png",
+			data: encodeTestPNG(t, 64, 64), width: 64, height: 64,
+			setup: func(mc *MessageConverter) { mc.StickerLikeImages, mc.MaxStickerLikeDimension = true, 32 },
+			want:  event.MsgImage,
+		},
+		{
+			name: "HEIC without ffmpeg", msgType: event.MsgImage, mimeType: "image/heic", fileName: "photo.heic",
+			data: testHEIC, want: event.MsgFile,
+		},
+		{
+			name: "SVG without ffmpeg", msgType: event.MsgImage, mimeType: "image/svg+xml", fileName: "logo.svg",
+			data: testSVG, want: event.MsgFile,
+		},
+		{
+			name: "SVG with transcoding disabled", msgType: event.MsgImage, mimeType: "image/svg+xml", fileName: "logo.svg",
+			data: testSVG, transcodingDisabled: true, want: event.MsgFile,
+		},
+		{
+			name: "PNG sticker with transcoding disabled", msgType: sticker, mimeType: "image/png", fileName: "sticker.png",
+			data: encodeTestPNG(t, 64, 64), width: 64, height: 64, transcodingDisabled: true,
+			want: event.MsgImage,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.needsFFmpeg && !ffmpeg.Supported() {
+				t.Skip("ffmpeg is not available")
+			}
+			portal := newTestPortal()
+			portal.data.DisableTranscoding = test.transcodingDisabled
+			mc := &MessageConverter{
+				PortalMethods:   portal,
+				FFmpegAvailable: test.needsFFmpeg,
+				MediaDownloader: fixtureDownloader{"mxc://example.com/media": test.data},
+				MediaUploader:   HashMediaUploader{DirectPath: testDirectPath},
+			}
+			if test.setup != nil {
+				test.setup(mc)
+			}
+			content := &event.MessageEventContent{
+				MsgType:  test.msgType,
+				Body:     test.fileName,
+				FileName: test.fileName,
+				URL:      "mxc://example.com/media",
+				Info: &event.FileInfo{
+					MimeType: test.mimeType,
+					Size:     len(test.data),
+					Width:    test.width,
+					Height:   test.height,
+				},
+			}
+			rawInfo := map[string]any{"mimetype": test.mimeType}
+			for key, value := range test.rawInfo {
+				rawInfo[key] = value
+			}
+			evtType := event.EventMessage
+			if test.msgType == sticker {
+				evtType = event.EventSticker
+			}
+			evt := &event.Event{
+				Type:    evtType,
+				Sender:  "@alice:example.com",
+				ID:      "$media",
+				Content: event.Content{Parsed: content, Raw: map[string]any{"info": rawInfo}},
+			}
+			estimate, err := mc.EstimateWhatsApp(context.Background(), evt, content, false)
+			if err != nil {
+				t.Fatalf("failed to estimate message: %v", err)
+			}
+			_, _, err = mc.ToWhatsApp(context.Background(), evt, content, false)
+			if err != nil {
+				t.Fatalf("failed to convert message: %v", err)
+			}
+			if content.MsgType != test.want {
+				t.Errorf("converted msgtype = %s, want %s", content.MsgType, test.want)
+			}
+			if estimate.MsgType != content.MsgType {
+				t.Errorf("estimated msgtype = %s, but message was sent as %s", estimate.MsgType, content.MsgType)
+			}
+		})
+	}
+}
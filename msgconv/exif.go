@@ -0,0 +1,125 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// jpegOrientation reads the EXIF orientation tag of a JPEG image. It returns 1 (normal orientation)
+// if the data isn't a JPEG or doesn't contain a valid orientation tag.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		segmentLength := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		if marker == 0xDA || segmentLength < 2 || offset+2+segmentLength > len(data) {
+			// Start of scan or broken segment, there won't be any more metadata
+			return 1
+		}
+		segment := data[offset+4 : offset+2+segmentLength]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		offset += 2 + segmentLength
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifdOffset := int(order.Uint32(tiff[4:8]))
+	if ifdOffset+2 > len(tiff) {
+		return 1
+	}
+	entryCount := int(order.Uint16(tiff[ifdOffset : ifdOffset+2]))
+	for i := 0; i < entryCount; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		const orientationTag = 0x0112
+		if order.Uint16(tiff[entry:entry+2]) == orientationTag {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientationSwapsDimensions returns true if the given EXIF orientation rotates the image by 90 or 270 degrees.
+func orientationSwapsDimensions(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// applyOrientation returns a copy of the image transformed according to the given EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	outW, outH := w, h
+	if orientationSwapsDimensions(orientation) {
+		outW, outH = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, outW, outH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dstX, dstY int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dstX, dstY = w-1-x, y
+			case 3: // Rotated 180°
+				dstX, dstY = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dstX, dstY = x, h-1-y
+			case 5: // Mirrored along the top-left diagonal
+				dstX, dstY = y, x
+			case 6: // Rotated 90° clockwise
+				dstX, dstY = h-1-y, x
+			case 7: // Mirrored along the top-right diagonal
+				dstX, dstY = h-1-y, w-1-x
+			case 8: // Rotated 90° counter-clockwise
+				dstX, dstY = y, w-1-x
+			}
+			out.Set(dstX, dstY, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return out
+}
@@ -0,0 +1,155 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+// encodeTestJPEG encodes a JPEG with an EXIF segment containing the given orientation tag right after the SOI marker.
+func encodeTestJPEG(t *testing.T, width, height, orientation int, order binary.ByteOrder) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatalf("failed to encode test JPEG: %v", err)
+	}
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	header := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(2+len(segment)))
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), append(header, segment...)...), data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if got := jpegOrientation(encodeTestJPEG(t, 4, 2, orientation, order)); got != orientation {
+				t.Errorf("jpegOrientation() = %d for %s orientation %d", got, order, orientation)
+			}
+		}
+	}
+	if got := jpegOrientation(encodeTestJPEG(t, 4, 2, 9, binary.BigEndian)); got != 1 {
+		t.Errorf("jpegOrientation() = %d for invalid orientation 9, want 1", got)
+	}
+	if got := jpegOrientation(encodeTestPNG(t, 4, 2)); got != 1 {
+		t.Errorf("jpegOrientation() = %d for a PNG, want 1", got)
+	}
+}
+
+func TestProbeDimensionsOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		width, height, err := probeDimensions(context.Background(), encodeTestJPEG(t, 40, 20, orientation, binary.BigEndian), "image/jpeg")
+		if err != nil {
+			t.Fatalf("failed to probe dimensions: %v", err)
+		}
+		wantW, wantH := 40, 20
+		if orientation >= 5 {
+			wantW, wantH = 20, 40
+		}
+		if width != wantW || height != wantH {
+			t.Errorf("probeDimensions() = %dx%d for orientation %d, want %dx%d", width, height, orientation, wantW, wantH)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image with markers in the top left corner and the pixel right of it
+	const w, h = 3, 2
+	corner, next := color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	img.Set(0, 0, corner)
+	img.Set(1, 0, next)
+	tests := []struct {
+		orientation  int
+		corner, next image.Point
+	}{
+		{1, image.Pt(0, 0), image.Pt(1, 0)},
+		{2, image.Pt(w-1, 0), image.Pt(w-2, 0)},
+		{3, image.Pt(w-1, h-1), image.Pt(w-2, h-1)},
+		{4, image.Pt(0, h-1), image.Pt(1, h-1)},
+		{5, image.Pt(0, 0), image.Pt(0, 1)},
+		{6, image.Pt(h-1, 0), image.Pt(h-1, 1)},
+		{7, image.Pt(h-1, w-1), image.Pt(h-1, w-2)},
+		{8, image.Pt(0, w-1), image.Pt(0, w-2)},
+	}
+	for _, test := range tests {
+		out := applyOrientation(img, test.orientation)
+		wantW, wantH := w, h
+		if orientationSwapsDimensions(test.orientation) {
+			wantW, wantH = h, w
+		}
+		if out.Bounds().Dx() != wantW || out.Bounds().Dy() != wantH {
+			t.Errorf("orientation %d: output is %dx%d, want %dx%d", test.orientation, out.Bounds().Dx(), out.Bounds().Dy(), wantW, wantH)
+			continue
+		}
+		if got := color.RGBAModel.Convert(out.At(test.corner.X, test.corner.Y)); got != corner {
+			t.Errorf("orientation %d: top left pixel wasn't moved to %v", test.orientation, test.corner)
+		}
+		if got := color.RGBAModel.Convert(out.At(test.next.X, test.next.Y)); got != next {
+			t.Errorf("orientation %d: second pixel wasn't moved to %v", test.orientation, test.next)
+		}
+	}
+}
+
+func TestRotatedImageDimensions(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgImage, Body: "photo.jpg", Info: &event.FileInfo{MimeType: "image/jpeg", Width: 800, Height: 400}}
+	mc := &MessageConverter{PortalMethods: newTestPortal()}
+	output := convertTestMessage(t, mc, content, encodeTestJPEG(t, 800, 400, 6, binary.LittleEndian))
+	msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_ImageMessage)
+	if !ok {
+		t.Fatalf("expected an image message, got %T", output)
+	}
+	transport, err := msg.ImageMessage.Decode()
+	if err != nil {
+		t.Fatalf("failed to decode image transport: %v", err)
+	}
+	if w, h := transport.GetAncillary().GetWidth(), transport.GetAncillary().GetHeight(); w != 400 || h != 800 {
+		t.Errorf("image dimensions = %dx%d, want the rotated 400x800", w, h)
+	}
+	thumb := transport.GetIntegral().GetTransport().GetAncillary().GetThumbnail()
+	if w, h := thumb.GetThumbnailWidth(), thumb.GetThumbnailHeight(); w != 200 || h != 400 {
+		t.Errorf("thumbnail dimensions = %dx%d, want the rotated 200x400", w, h)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(thumb.GetJPEGThumbnail()))
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	} else if cfg.Width != 200 || cfg.Height != 400 {
+		t.Errorf("thumbnail is %dx%d, want the rotation to be applied to the pixels", cfg.Width, cfg.Height)
+	}
+}
@@ -0,0 +1,161 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/exmime"
+)
+
+// runFFprobe writes the given data into a temporary file and runs ffprobe on it with the given arguments.
+func runFFprobe(ctx context.Context, data []byte, mimeType string, args ...string) (string, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return "", fmt.Errorf("ffprobe not found: %w", err)
+	}
+	file, err := os.CreateTemp("", "mautrix_ffprobe_*"+exmime.ExtensionFromMimetype(mimeType))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	_ = file.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write data to temp file: %w", err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffprobePath, append(append([]string{"-v", "error"}, args...), file.Name())...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe error: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// probeDuration finds the duration of an audio or video file using ffprobe. If the container doesn't
+// declare a duration, the duration of the first video or audio stream is used instead, which is
+// needed for some videos without an audio track.
+func probeDuration(ctx context.Context, data []byte, mimeType string) (time.Duration, error) {
+	output, err := runFFprobe(ctx, data, mimeType, "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1")
+	if err != nil {
+		return 0, err
+	}
+	if output == "" || output == "N/A" {
+		output, err = runFFprobe(ctx, data, mimeType, "-show_entries", "stream=duration", "-of", "default=noprint_wrappers=1:nokey=1")
+		if err != nil {
+			return 0, err
+		}
+		output = strings.SplitN(output, "\n", 2)[0]
+	}
+	seconds, err := strconv.ParseFloat(output, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// probeAudioCodec finds the codec name of the first audio stream in a file using ffprobe.
+func probeAudioCodec(ctx context.Context, data []byte, mimeType string) (string, error) {
+	output, err := runFFprobe(ctx, data, mimeType,
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+	)
+	if err != nil {
+		return "", err
+	} else if output == "" {
+		return "", fmt.Errorf("file doesn't contain an audio stream")
+	}
+	return strings.SplitN(output, "\n", 2)[0], nil
+}
+
+// probeHasAudioStream checks whether a file contains at least one audio stream using ffprobe.
+func probeHasAudioStream(ctx context.Context, data []byte, mimeType string) (bool, error) {
+	output, err := runFFprobe(ctx, data, mimeType,
+		"-select_streams", "a",
+		"-show_entries", "stream=index",
+		"-of", "csv=p=0",
+	)
+	if err != nil {
+		return false, err
+	}
+	return output != "", nil
+}
+
+// probeAudioTags reads the title and artist tags (e.g. ID3 tags in mp3 files) of an audio file using ffprobe.
+// Missing tags are returned as empty strings.
+func probeAudioTags(ctx context.Context, data []byte, mimeType string) (title, artist string, err error) {
+	output, err := runFFprobe(ctx, data, mimeType, "-show_entries", "format_tags=title,artist", "-of", "default=noprint_wrappers=1")
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, _ := strings.Cut(strings.TrimPrefix(line, "TAG:"), "=")
+		switch strings.ToLower(key) {
+		case "title":
+			title = strings.TrimSpace(value)
+		case "artist":
+			artist = strings.TrimSpace(value)
+		}
+	}
+	return title, artist, nil
+}
+
+// probeDimensions finds the width and height of an image or video. Formats supported by the image package
+// (JPEG, PNG, GIF and WebP) are decoded directly, anything else (e.g. AVIF, HEIC and videos) is passed to ffprobe.
+func probeDimensions(ctx context.Context, data []byte, mimeType string) (int, int, error) {
+	cfg, _, decodeErr := image.DecodeConfig(bytes.NewReader(data))
+	if decodeErr == nil {
+		if orientationSwapsDimensions(jpegOrientation(data)) {
+			return cfg.Height, cfg.Width, nil
+		}
+		return cfg.Width, cfg.Height, nil
+	}
+	output, err := runFFprobe(ctx, data, mimeType,
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=p=0:s=x",
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w (image decoder also failed: %v)", err, decodeErr)
+	}
+	// Multiple lines may be returned for some container formats, the first one is the main video stream
+	widthStr, heightStr, ok := strings.Cut(strings.SplitN(output, "\n", 2)[0], "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpected ffprobe output %q", output)
+	}
+	width, err := strconv.Atoi(strings.TrimSpace(widthStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse width: %w", err)
+	}
+	height, err := strconv.Atoi(strings.TrimSpace(heightStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse height: %w", err)
+	}
+	return width, height, nil
+}
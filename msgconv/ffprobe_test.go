@@ -0,0 +1,111 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+// testAVIF is the start of an AVIF file without any image data.
+var testAVIF = []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf")
+
+func TestProbeDimensions(t *testing.T) {
+	var jpegBuf bytes.Buffer
+	if err := jpeg.Encode(&jpegBuf, image.NewGray(image.Rect(0, 0, 64, 32)), nil); err != nil {
+		t.Fatalf("failed to encode test JPEG: %v", err)
+	}
+	tests := []struct {
+		name          string
+		data          []byte
+		mimeType      string
+		width, height int
+	}{
+		{"PNG", encodeTestPNG(t, 800, 400), "image/png", 800, 400},
+		{"JPEG", jpegBuf.Bytes(), "image/jpeg", 64, 32},
+		{"GIF", encodeTestGIF(t, 30, 20), "image/gif", 30, 20},
+		{"Lossless WebP", testStaticWebP, "image/webp", 1, 1},
+		{"Animated WebP", testAnimatedWebP, "image/webp", 1, 1},
+		{"Extended WebP header", []byte("RIFF\x16\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\x2b\x01\x00\xc7\x00\x00"), "image/webp", 300, 200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := probeDimensions(context.Background(), test.data, test.mimeType)
+			if err != nil {
+				t.Fatalf("failed to probe dimensions: %v", err)
+			}
+			if width != test.width || height != test.height {
+				t.Errorf("probeDimensions() = %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestProbeDimensionsReportsDecoderError(t *testing.T) {
+	// Neither the image package nor ffprobe can read files without any image data
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+	}{
+		{"AVIF", testAVIF, "image/avif"},
+		{"HEIC", testHEIC, "image/heic"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := probeDimensions(context.Background(), test.data, test.mimeType)
+			if err == nil {
+				t.Fatalf("probeDimensions() = %dx%d, want an error", width, height)
+			}
+			if !strings.Contains(err.Error(), image.ErrFormat.Error()) {
+				t.Errorf("error %q doesn't include the image decoder error", err)
+			}
+		})
+	}
+}
+
+func TestUnprobeableImageKeepsEventDimensions(t *testing.T) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "photo.avif",
+		Info:    &event.FileInfo{MimeType: "image/avif", Width: 640, Height: 480},
+	}
+	mc := &MessageConverter{PortalMethods: newTestPortal()}
+	output := convertTestMessage(t, mc, content, testAVIF)
+	msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_ImageMessage)
+	if !ok {
+		t.Fatalf("expected an image message, got %T", output)
+	}
+	transport, err := msg.ImageMessage.Decode()
+	if err != nil {
+		t.Fatalf("failed to decode image transport: %v", err)
+	}
+	if w, h := transport.GetAncillary().GetWidth(), transport.GetAncillary().GetHeight(); w != 640 || h != 480 {
+		t.Errorf("image dimensions = %dx%d, want the 640x480 from the Matrix event", w, h)
+	}
+	thumb := transport.GetIntegral().GetTransport().GetAncillary().GetThumbnail()
+	if w, h := thumb.GetThumbnailWidth(), thumb.GetThumbnailHeight(); w != 400 || h != 300 {
+		t.Errorf("thumbnail dimensions = %dx%d, want 400x300", w, h)
+	}
+}
@@ -17,11 +17,17 @@
 package msgconv
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"image"
 	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/exerrors"
@@ -37,20 +43,57 @@ import (
 )
 
 var (
-	ErrUnsupportedMsgType  = errors.New("unsupported msgtype")
-	ErrMediaDownloadFailed = errors.New("failed to download media")
-	ErrMediaDecryptFailed  = errors.New("failed to decrypt media")
-	ErrMediaConvertFailed  = errors.New("failed to convert")
-	ErrMediaUploadFailed   = errors.New("failed to upload media")
-	ErrInvalidGeoURI       = errors.New("invalid `geo:` URI in message")
-	ErrURLNotFound         = errors.New("url not found")
+	ErrUnsupportedMsgType      = errors.New("unsupported msgtype")
+	ErrMediaDownloadFailed     = errors.New("failed to download media")
+	ErrMediaDecryptFailed      = errors.New("failed to decrypt media")
+	ErrMediaConvertFailed      = errors.New("failed to convert")
+	ErrMediaUploadFailed       = errors.New("failed to upload media")
+	ErrMediaTooLarge           = errors.New("media is too large")
+	ErrMediaCorrupt            = errors.New("media appears corrupt")
+	ErrEditNotCaptioned        = errors.New("edit target is not a text message or media with a caption")
+	ErrMessageTooLong          = errors.New("message is too long")
+	ErrInvalidGeoURI           = errors.New("invalid `geo:` URI in message")
+	ErrURLNotFound             = errors.New("url not found")
+	ErrUnsupportedReaction     = errors.New("unsupported reaction")
+	ErrUnsupportedEffect       = errors.New("unsupported message effect")
+	ErrUnsupportedSticker      = errors.New("unsupported sticker format")
+	ErrUnknownPollAnswer       = errors.New("unknown poll answer")
+	ErrConversionTimeout       = errors.New("converting the message took too long")
+	ErrReceiptTargetNotBridged = errors.New("read receipt target is not a bridged message")
+	ErrRoomMentionNotAllowed   = errors.New("you don't have permission to mention everyone in this room")
 )
 
 func (mc *MessageConverter) ToMeta(ctx context.Context, evt *event.Event, content *event.MessageEventContent, relaybotFormatted bool) ([]socket.Task, int64, error) {
+	msgType := conversionMsgType(evt, content)
+	tasks, otid, err := mc.toMeta(ctx, evt, content, relaybotFormatted)
+	mc.observeConversion(msgType, err)
+	return tasks, otid, err
+}
+
+func (mc *MessageConverter) toMeta(ctx context.Context, evt *event.Event, content *event.MessageEventContent, relaybotFormatted bool) ([]socket.Task, int64, error) {
+	hotEmojiSize, err := metaHotEmojiSize(evt, content)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = mc.checkRoomMention(ctx, evt, content)
+	if err != nil {
+		return nil, 0, err
+	}
 	if evt.Type == event.EventSticker {
 		content.MsgType = event.MsgImage
+	} else if evt.Type == EventUnstablePollStart {
+		content.MsgType = event.MessageType(evt.Type.Type)
+	} else if evt.Type == EventUnstableBeacon {
+		// Messenger doesn't support live locations, so send the current position as a normal location instead
+		err := BeaconToStaticLocation(evt, content)
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 
+	// Replies are sent with reply metadata, so the fallback would duplicate the quote
+	content.RemoveReplyFallback()
+
 	task := &socket.SendMessageTask{
 		ThreadId:         mc.GetData(ctx).ThreadID,
 		Otid:             methods.GenerateEpochId(),
@@ -59,17 +102,24 @@ func (mc *MessageConverter) ToMeta(ctx context.Context, evt *event.Event, conten
 		SendType:         table.TEXT,
 		SyncGroup:        1,
 
-		ReplyMetaData: mc.GetMetaReply(ctx, content),
+		ReplyMetaData: mc.GetMetaReply(ctx, mc.replyTargetID(content)),
 	}
-	if content.MsgType == event.MsgEmote && !relaybotFormatted {
-		content.Body = "/me " + content.Body
-		if content.FormattedBody != "" {
-			content.FormattedBody = "/me " + content.FormattedBody
-		}
+	if mc.GetData(ctx).ThreadType == table.MARKETPLACE {
+		// Marketplace threads don't accept messages sent from the normal inbox source
+		task.Source = table.MARKETPLACE_SEND_MESSAGE
 	}
+	if !relaybotFormatted {
+		mc.addMsgTypePrefix(ctx, evt.Sender, content)
+	}
+	// Captions that aren't attached to the media are sent as a separate message, see captionPlacement
+	var captionTask *socket.SendMessageTask
 	switch content.MsgType {
 	case event.MsgText, event.MsgNotice, event.MsgEmote:
-		task.Text = content.Body
+		if length := utf8.RuneCountInString(content.Body); length > MaxTextLength {
+			return nil, 0, fmt.Errorf("%w: message is %d characters long, maximum is %d", ErrMessageTooLong, length, MaxTextLength)
+		}
+		task.Text, task.MentionData = mc.matrixToMetaText(ctx, content)
+		task.HotEmojiSize = hotEmojiSize
 	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
 		resp, err := mc.reuploadFileToMeta(ctx, evt, content)
 		if err != nil {
@@ -82,9 +132,19 @@ func (mc *MessageConverter) ToMeta(ctx context.Context, evt *event.Event, conten
 		}
 		task.SendType = table.MEDIA
 		task.AttachmentFBIds = []int64{attachmentID}
-		if content.FileName != "" && content.Body != content.FileName {
+		if mc.captionPlacement(content) != CaptionAttached {
+			captionTask = &socket.SendMessageTask{
+				ThreadId:         task.ThreadId,
+				Otid:             methods.GenerateEpochId(),
+				Source:           task.Source,
+				InitiatingSource: task.InitiatingSource,
+				SendType:         table.TEXT,
+				SyncGroup:        1,
+			}
+			captionTask.Text, captionTask.MentionData = mc.matrixToMetaText(ctx, content)
+		} else if hasMediaCaption(content) {
 			// This might not actually be allowed
-			task.Text = content.Body
+			task.Text, task.MentionData = mc.matrixToMetaText(ctx, content)
 		}
 	case event.MsgLocation:
 		// TODO implement
@@ -98,6 +158,13 @@ func (mc *MessageConverter) ToMeta(ctx context.Context, evt *event.Event, conten
 
 		LastReadWatermarkTs: time.Now().UnixMilli(),
 	}
+	if captionTask != nil {
+		// Only the media is tracked using the returned OTID, so the caption isn't stored in the database
+		if mc.captionPlacement(content) == CaptionBefore {
+			return []socket.Task{captionTask, task, readTask}, task.Otid, nil
+		}
+		return []socket.Task{task, captionTask, readTask}, task.Otid, nil
+	}
 	return []socket.Task{task, readTask}, task.Otid, nil
 }
 
@@ -106,7 +173,13 @@ func (mc *MessageConverter) downloadMatrixMedia(ctx context.Context, content *ev
 	if content.File != nil {
 		mxc = content.File.URL
 	}
-	data, err = mc.DownloadMatrixMedia(ctx, mxc)
+	downloader := mc.MediaDownloader
+	if downloader == nil {
+		downloader = mc.PortalMethods
+	}
+	downloadStart := time.Now()
+	data, err = downloader.DownloadMatrixMedia(ctx, mxc)
+	mc.observeMediaStep(content.MsgType, MediaStepDownload, downloadStart, len(data))
 	if err != nil {
 		err = exerrors.NewDualError(ErrMediaDownloadFailed, err)
 		return
@@ -119,19 +192,130 @@ func (mc *MessageConverter) downloadMatrixMedia(ctx context.Context, content *ev
 		}
 	}
 	mimeType = content.GetInfo().MimeType
-	if mimeType == "" {
+	if mimeType == "" || mimeType == "application/octet-stream" {
 		mimeType = http.DetectContentType(data)
 	}
-	fileName = content.FileName
+	err = validateMediaData(content.MsgType, data, mimeType)
+	if err != nil {
+		return
+	}
+	fileName = mediaFileName(content)
 	if fileName == "" {
-		fileName = content.Body
-		if fileName == "" {
-			fileName = string(content.MsgType)[2:] + exmime.ExtensionFromMimetype(mimeType)
-		}
+		fileName = string(content.MsgType)[2:] + exmime.ExtensionFromMimetype(mimeType)
 	}
 	return
 }
 
+// validateMediaData rejects empty files and images that can't be decoded, so that broken downloads
+// fail with a clear error instead of somewhere in the conversion or upload steps.
+func validateMediaData(msgType event.MessageType, data []byte, mimeType string) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: file is empty", ErrMediaCorrupt)
+	}
+	if msgType != event.MsgImage {
+		return nil
+	}
+	switch {
+	case mimeType == "image/webp" && isAnimatedWebP(data):
+		// The WebP decoder doesn't support animations, so only the header can be checked
+		_, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%w: failed to decode %s: %w", ErrMediaCorrupt, mimeType, err)
+		}
+	case mimeType == "image/jpeg", mimeType == "image/png", mimeType == "image/gif", mimeType == "image/webp":
+		// Only formats that the image package can decode are checked, others (e.g. AVIF) are passed through as-is
+		_, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%w: failed to decode %s: %w", ErrMediaCorrupt, mimeType, err)
+		}
+	}
+	return nil
+}
+
+// convertVoice converts a voice message to the configured codec, which is AAC in an MP4 container by default.
+// Files that already have the target codec and container are passed through as-is to avoid re-encoding them, and so is
+// everything if transcoding is disabled (globally or in the portal) or ffmpeg isn't available.
+func (mc *MessageConverter) convertVoice(ctx context.Context, data []byte, mimeType, fileName string) ([]byte, string, string, error) {
+	if !mc.TranscodeVoiceMessages || mc.GetData(ctx).DisableTranscoding {
+		return data, mimeType, fileName, nil
+	} else if !mc.FFmpegAvailable {
+		zerolog.Ctx(ctx).Debug().Str("mime_type", mimeType).Msg("ffmpeg isn't available, sending voice message without converting it")
+		return data, mimeType, fileName, nil
+	}
+	codec := mc.voiceCodec(ctx)
+	format := voiceFormats[codec]
+	if slices.Contains(format.containerMimes, mimeType) {
+		probedCodec, err := probeAudioCodec(ctx, data, mimeType)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to probe voice message codec, converting it anyway")
+		} else if probedCodec == string(codec) {
+			zerolog.Ctx(ctx).Debug().Str("mime_type", mimeType).Str("codec", probedCodec).Msg("Voice message already has the target codec, not converting")
+			return data, format.mimeType, fileName, nil
+		}
+	}
+	inputArgs, outputArgs := mc.voiceConvertArgs(ctx, codec)
+	data, err := ffmpeg.ConvertBytes(ctx, data, format.extension, inputArgs, outputArgs, mimeType)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("%w voice message to %s: %w", ErrMediaConvertFailed, strings.TrimPrefix(format.extension, "."), err)
+	}
+	return data, format.mimeType, fileName + format.extension, nil
+}
+
+// VoiceCodec is the audio codec that voice messages are converted to.
+type VoiceCodec string
+
+const (
+	// VoiceCodecAAC converts voice messages to AAC in an m4a container, which all Meta clients support.
+	VoiceCodecAAC VoiceCodec = "aac"
+	// VoiceCodecOpus converts voice messages to Opus in an ogg container.
+	VoiceCodecOpus VoiceCodec = "opus"
+)
+
+type voiceFormat struct {
+	extension      string
+	mimeType       string
+	containerMimes []string
+}
+
+var voiceFormats = map[VoiceCodec]voiceFormat{
+	VoiceCodecAAC:  {extension: ".m4a", mimeType: "audio/mp4", containerMimes: []string{"audio/mp4", "audio/m4a", "audio/x-m4a"}},
+	VoiceCodecOpus: {extension: ".ogg", mimeType: "audio/ogg", containerMimes: []string{"audio/ogg", "audio/opus"}},
+}
+
+// voiceCodec returns the configured voice message codec, falling back to AAC if it's not supported.
+func (mc *MessageConverter) voiceCodec(ctx context.Context) VoiceCodec {
+	switch mc.VoiceCodec {
+	case VoiceCodecAAC, VoiceCodecOpus:
+		return mc.VoiceCodec
+	case "":
+		return VoiceCodecAAC
+	default:
+		zerolog.Ctx(ctx).Warn().Str("voice_codec", string(mc.VoiceCodec)).Msg("Unsupported voice codec in config, using AAC")
+		return VoiceCodecAAC
+	}
+}
+
+// musicFileName returns a file name in the form "Artist - Title.ext" based on the tags of a music file,
+// which Messenger shows as the title of the audio attachment. The given file name is returned as-is
+// if the file doesn't have a title tag. Music isn't converted like voice messages, so the format stays the same.
+func musicFileName(ctx context.Context, data []byte, mimeType, fileName string) string {
+	title, artist, err := probeAudioTags(ctx, data, mimeType)
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Failed to read audio tags")
+		return fileName
+	} else if title == "" {
+		return fileName
+	}
+	if artist != "" {
+		title = artist + " - " + title
+	}
+	ext := filepath.Ext(fileName)
+	if ext == "" {
+		ext = exmime.ExtensionFromMimetype(mimeType)
+	}
+	return strings.ReplaceAll(title, "/", "_") + ext
+}
+
 func (mc *MessageConverter) reuploadFileToMeta(ctx context.Context, evt *event.Event, content *event.MessageEventContent) (*types.MercuryUploadResponse, error) {
 	threadID := mc.GetData(ctx).ThreadID
 	data, mimeType, fileName, err := mc.downloadMatrixMedia(ctx, content)
@@ -140,13 +324,16 @@ func (mc *MessageConverter) reuploadFileToMeta(ctx context.Context, evt *event.E
 	}
 	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
 	if isVoice {
-		data, err = ffmpeg.ConvertBytes(ctx, data, ".m4a", []string{}, []string{"-c:a", "aac"}, mimeType)
+		transcodeStart := time.Now()
+		data, mimeType, fileName, err = mc.convertVoice(ctx, data, mimeType, fileName)
 		if err != nil {
 			return nil, err
 		}
-		mimeType = "audio/mp4"
-		fileName += ".m4a"
+		mc.observeMediaStep(content.MsgType, MediaStepTranscode, transcodeStart, len(data))
+	} else if content.MsgType == event.MsgAudio {
+		fileName = musicFileName(ctx, data, mimeType, fileName)
 	}
+	uploadStart := time.Now()
 	resp, err := mc.GetClient(ctx).SendMercuryUploadRequest(ctx, threadID, &messagix.MercuryUploadMedia{
 		Filename:    fileName,
 		MimeType:    mimeType,
@@ -154,6 +341,7 @@ func (mc *MessageConverter) reuploadFileToMeta(ctx context.Context, evt *event.E
 		IsVoiceClip: isVoice,
 	})
 	if err != nil {
+		mc.observeMediaStep(content.MsgType, MediaStepUpload, uploadStart, 0)
 		zerolog.Ctx(ctx).Debug().
 			Str("file_name", fileName).
 			Str("mime_type", mimeType).
@@ -161,5 +349,6 @@ func (mc *MessageConverter) reuploadFileToMeta(ctx context.Context, evt *event.E
 			Msg("Failed upload metadata")
 		return nil, fmt.Errorf("%w: %w", ErrMediaUploadFailed, err)
 	}
+	mc.observeMediaStep(content.MsgType, MediaStepUpload, uploadStart, len(data))
 	return resp, nil
 }
@@ -0,0 +1,89 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDownloadMatrixMediaErrors(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("%PDF-1.4\nhello\n%%EOF\n")
+	file := attachment.NewEncryptedFile()
+	ciphertext := file.Encrypt(plaintext)
+	corrupted := bytes.Clone(ciphertext)
+	corrupted[0] ^= 0xff
+	const encryptedURL, corruptedURL id.ContentURIString = "mxc://example.com/encrypted", "mxc://example.com/corrupted"
+	mc := &MessageConverter{
+		PortalMethods: newTestPortal(),
+		MediaDownloader: fixtureDownloader{
+			encryptedURL: ciphertext,
+			corruptedURL: corrupted,
+		},
+	}
+	newContent := func(url id.ContentURIString, file attachment.EncryptedFile) *event.MessageEventContent {
+		// Round trip the keys through JSON like in real events, as the file caches its decoded keys
+		var reparsed event.EncryptedFileInfo
+		keys, _ := json.Marshal(&file)
+		if err := json.Unmarshal(keys, &reparsed); err != nil {
+			t.Fatalf("failed to parse encrypted file keys: %v", err)
+		}
+		reparsed.URL = url
+		return &event.MessageEventContent{
+			MsgType: event.MsgFile,
+			Body:    "file.pdf",
+			Info:    &event.FileInfo{MimeType: "application/pdf"},
+			File:    &reparsed,
+		}
+	}
+
+	data, _, _, err := mc.downloadMatrixMedia(ctx, newContent(encryptedURL, *file))
+	if err != nil {
+		t.Fatalf("failed to download encrypted media: %v", err)
+	} else if !bytes.Equal(data, plaintext) {
+		t.Errorf("decrypted data = %q, want %q", data, plaintext)
+	}
+
+	_, _, _, err = mc.downloadMatrixMedia(ctx, newContent(corruptedURL, *file))
+	if !errors.Is(err, ErrMediaDecryptFailed) {
+		t.Errorf("corrupted file returned %v, want ErrMediaDecryptFailed", err)
+	} else if errors.Is(err, ErrMediaDownloadFailed) {
+		t.Error("decryption failure is also reported as a download failure")
+	}
+
+	wrongKey := *attachment.NewEncryptedFile()
+	wrongKey.Hashes = file.Hashes
+	_, _, _, err = mc.downloadMatrixMedia(ctx, newContent(encryptedURL, wrongKey))
+	if !errors.Is(err, ErrMediaDecryptFailed) {
+		t.Errorf("wrong key returned %v, want ErrMediaDecryptFailed", err)
+	}
+
+	_, _, _, err = mc.downloadMatrixMedia(ctx, newContent("mxc://example.com/missing", *file))
+	if !errors.Is(err, ErrMediaDownloadFailed) {
+		t.Errorf("missing file returned %v, want ErrMediaDownloadFailed", err)
+	} else if errors.Is(err, ErrMediaDecryptFailed) {
+		t.Error("download failure is also reported as a decryption failure")
+	}
+}
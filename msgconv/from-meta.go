@@ -41,6 +41,7 @@ import (
 	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
 
+	"go.mau.fi/mautrix-meta/database"
 	"go.mau.fi/mautrix-meta/messagix/data/responses"
 	"go.mau.fi/mautrix-meta/messagix/socket"
 	"go.mau.fi/mautrix-meta/messagix/table"
@@ -82,6 +83,7 @@ type ConvertedMessagePart struct {
 	Type    event.Type
 	Content *event.MessageEventContent
 	Extra   map[string]any
+	Subtype database.MessageSubtype
 }
 
 func isProbablyURLPreview(xma *table.WrappedXMA) bool {
@@ -169,11 +171,17 @@ func (mc *MessageConverter) ToMatrix(ctx context.Context, msg *table.WrappedMess
 			default:
 			}
 		}
-		cm.Parts = append(cm.Parts, &ConvertedMessagePart{
+		part := &ConvertedMessagePart{
 			Type:    event.EventMessage,
 			Content: content,
 			Extra:   extra,
-		})
+		}
+		if extra["com.beeper.relation_preview_type"] == "story" {
+			part.Subtype = database.MessageSubtypeStory
+		} else if msg.IsAdminMessage {
+			part.Subtype = database.MessageSubtypeAdmin
+		}
+		cm.Parts = append(cm.Parts, part)
 	}
 	if len(cm.Parts) == 0 {
 		cm.Parts = append(cm.Parts, &ConvertedMessagePart{
@@ -0,0 +1,51 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/util/ffmpeg"
+)
+
+// heicJPEGQuality is the ffmpeg qscale used when converting HEIC photos to JPEG (2 is the best, 31 the worst).
+const heicJPEGQuality = "3"
+
+// isHEIC checks whether a file is a HEIC or HEIF image, as sent by iOS devices.
+func isHEIC(mimeType, fileName string) bool {
+	switch mimeType {
+	case "image/heic", "image/heif", "image/heic-sequence", "image/heif-sequence":
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// convertHEIC converts a HEIC or HEIF image into a JPEG, as most Meta clients can't display HEIC.
+// ffmpeg applies the rotation of the image to the pixels, as the JPEG output doesn't have EXIF data.
+func (mc *MessageConverter) convertHEIC(ctx context.Context, data []byte, mimeType string) ([]byte, error) {
+	if !mc.FFmpegAvailable {
+		return nil, fmt.Errorf("ffmpeg isn't available")
+	}
+	return ffmpeg.ConvertBytes(ctx, data, ".jpg", []string{}, []string{"-frames:v", "1", "-q:v", heicJPEGQuality}, mimeType)
+}
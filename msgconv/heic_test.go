@@ -0,0 +1,87 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+// testHEIC is the start of a HEIC file from an iPhone. It doesn't have any image data, so converting it always fails.
+var testHEIC = []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic\x00\x00\x00\x08meta")
+
+func TestIsHEIC(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		fileName string
+		want     bool
+	}{
+		{mimeType: "image/heic", fileName: "photo", want: true},
+		{mimeType: "image/heif", fileName: "photo", want: true},
+		{mimeType: "image/heic-sequence", fileName: "photo", want: true},
+		{mimeType: "application/octet-stream", fileName: "IMG_0001.HEIC", want: true},
+		{mimeType: "application/octet-stream", fileName: "IMG_0001.heif", want: true},
+		{mimeType: "image/jpeg", fileName: "IMG_0001.jpg"},
+		{mimeType: "application/octet-stream", fileName: "heic"},
+	}
+	for _, test := range tests {
+		if got := isHEIC(test.mimeType, test.fileName); got != test.want {
+			t.Errorf("isHEIC(%q, %q) = %t, want %t", test.mimeType, test.fileName, got, test.want)
+		}
+	}
+}
+
+func TestHEICFallsBackToFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		ffmpeg   bool
+		disable  bool
+	}{
+		{name: "ffmpeg unavailable", mimeType: "image/heic"},
+		{name: "Conversion failure", mimeType: "image/heic", ffmpeg: true},
+		{name: "Transcoding disabled", mimeType: "image/heic", ffmpeg: true, disable: true},
+		{name: "Detected by extension", ffmpeg: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			portal := newTestPortal()
+			portal.data.DisableTranscoding = test.disable
+			mc := &MessageConverter{PortalMethods: portal, FFmpegAvailable: test.ffmpeg}
+			content := &event.MessageEventContent{MsgType: event.MsgImage, Body: "IMG_0001.HEIC", Info: &event.FileInfo{MimeType: test.mimeType}}
+			output := convertTestMessage(t, mc, content, testHEIC)
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_DocumentMessage)
+			if !ok {
+				t.Fatalf("expected a document message, got %T", output)
+			}
+			if name := msg.DocumentMessage.GetFileName(); name != "IMG_0001.HEIC" {
+				t.Errorf("file name = %q, want IMG_0001.HEIC", name)
+			}
+			if mimeType := testMediaMimetype(t, output); mimeType != "image/heic" {
+				t.Errorf("mimetype = %q, want image/heic", mimeType)
+			}
+			transport, _ := msg.DocumentMessage.Decode()
+			hash := sha256.Sum256(testHEIC)
+			if string(transport.GetIntegral().GetTransport().GetIntegral().GetFileSHA256()) != string(hash[:]) {
+				t.Error("HEIC file was modified before upload")
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"go.mau.fi/whatsmeow/binary/armadillo/waMediaTransport"
+	"golang.org/x/net/html"
+
+	"go.mau.fi/mautrix-meta/messagix"
+)
+
+const (
+	defaultURLPreviewTimeout = 5 * time.Second
+	maxURLPreviewPageSize    = 1 * 1024 * 1024
+	maxURLPreviewImageSize   = 5 * 1024 * 1024
+)
+
+var errNonPublicAddress = errors.New("refusing to connect to non-public address")
+
+// carrierGradeNAT is the shared address space (RFC 6598), which isn't covered by netip.Addr.IsPrivate.
+var carrierGradeNAT = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublicAddress checks whether the given IP address is publicly routable. Link previews are fetched
+// for any URL in a message, so they must not be able to reach the bridge's internal network.
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !carrierGradeNAT.Contains(addr)
+}
+
+// rejectNonPublicAddress is a net.Dialer control function that only allows connections to public IPs.
+// It runs after DNS resolution, so it also covers hostnames pointing at internal addresses and redirects.
+func rejectNonPublicAddress(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("failed to parse address: %w", err)
+	} else if !isPublicAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w %s", errNonPublicAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// linkPreviewHTTPClient is used for fetching link previews. Unlike mediaHTTPClient, the URLs come from
+// message bodies written by users, so only public addresses are allowed.
+var linkPreviewHTTPClient = http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, Control: rejectNonPublicAddress}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:     true,
+	},
+	Timeout: 30 * time.Second,
+}
+
+var urlRegex = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+type openGraphData struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+}
+
+func findFirstURL(text string) string {
+	found := urlRegex.FindString(text)
+	// Don't include trailing punctuation from the surrounding sentence
+	return strings.TrimRight(found, ".,:;!?)]}")
+}
+
+func parseOpenGraph(body io.Reader, pageURL *url.URL) *openGraphData {
+	data := &openGraphData{URL: pageURL.String()}
+	var pageTitle string
+	tokenizer := html.NewTokenizer(body)
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			if data.Title == "" {
+				data.Title = strings.TrimSpace(pageTitle)
+			}
+			return data
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				if tokenizer.Next() == html.TextToken {
+					pageTitle = string(tokenizer.Text())
+				}
+			case "meta":
+				var property, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						property = attr.Val
+					case "content":
+						content = attr.Val
+					}
+				}
+				switch property {
+				case "og:title":
+					data.Title = content
+				case "og:description":
+					data.Description = content
+				case "og:url":
+					data.URL = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if data.ImageURL == "" {
+						if imageURL, err := pageURL.Parse(content); err == nil {
+							data.ImageURL = imageURL.String()
+						}
+					}
+				}
+			}
+		case html.EndTagToken:
+			if token := tokenizer.Token(); token.Data == "head" {
+				if data.Title == "" {
+					data.Title = strings.TrimSpace(pageTitle)
+				}
+				return data
+			}
+		}
+	}
+}
+
+func fetchOpenGraph(ctx context.Context, pageURL string) (*openGraphData, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", messagix.UserAgent)
+	resp, err := linkPreviewHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mimeType != "text/html" && mimeType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unexpected content type %q", mimeType)
+	}
+	return parseOpenGraph(io.LimitReader(resp.Body, maxURLPreviewPageSize), resp.Request.URL), nil
+}
+
+func (mc *MessageConverter) urlPreviewTimeout() time.Duration {
+	if mc.URLPreviewTimeout <= 0 {
+		return defaultURLPreviewTimeout
+	}
+	return mc.URLPreviewTimeout
+}
+
+// LinkPreviewToWhatsApp fetches a preview of the first URL in the given text and returns
+// an extended text message containing it, or nil if previews are disabled or fetching failed.
+func (mc *MessageConverter) LinkPreviewToWhatsApp(ctx context.Context, text *waCommon.MessageText) *waConsumerApplication.ConsumerApplication_ExtendedTextMessage {
+	if !mc.URLPreviews {
+		return nil
+	}
+	matchedURL := findFirstURL(text.GetText())
+	if matchedURL == "" {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("url", matchedURL).Logger()
+	ctx, cancel := context.WithTimeout(ctx, mc.urlPreviewTimeout())
+	defer cancel()
+	preview, err := fetchOpenGraph(ctx, matchedURL)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to fetch URL preview, sending without preview")
+		return nil
+	} else if preview.Title == "" && preview.Description == "" {
+		return nil
+	}
+	extendedText := &waConsumerApplication.ConsumerApplication_ExtendedTextMessage{
+		Text:         text,
+		MatchedText:  matchedURL,
+		CanonicalURL: preview.URL,
+		Title:        preview.Title,
+		Description:  preview.Description,
+	}
+	if preview.ImageURL != "" {
+		err = mc.setLinkPreviewThumbnail(ctx, extendedText, preview.ImageURL)
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to add thumbnail to URL preview")
+		}
+	}
+	return extendedText
+}
+
+func (mc *MessageConverter) setLinkPreviewThumbnail(ctx context.Context, msg *waConsumerApplication.ConsumerApplication_ExtendedTextMessage, imageURL string) error {
+	data, err := downloadLinkPreviewImage(ctx, imageURL)
+	if err != nil {
+		return fmt.Errorf("failed to download image: %w", err)
+	}
+	thumbnail, w, h, err := mc.createThumbnail(ctx, data, http.DetectContentType(data), false)
+	if err != nil {
+		return err
+	}
+	return msg.SetThumbnail(&waMediaTransport.ImageTransport{
+		Integral: &waMediaTransport.ImageTransport_Integral{
+			Transport: &waMediaTransport.WAMediaTransport{
+				Ancillary: &waMediaTransport.WAMediaTransport_Ancillary{
+					Mimetype: "image/jpeg",
+					Thumbnail: &waMediaTransport.WAMediaTransport_Ancillary_Thumbnail{
+						JPEGThumbnail:   thumbnail,
+						ThumbnailWidth:  uint32(w),
+						ThumbnailHeight: uint32(h),
+					},
+				},
+			},
+		},
+		Ancillary: &waMediaTransport.ImageTransport_Ancillary{
+			Width:  uint32(w),
+			Height: uint32(h),
+		},
+	})
+}
+
+func downloadLinkPreviewImage(ctx context.Context, imageURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	addDownloadHeaders(req.Header, "image/*")
+	resp, err := linkPreviewHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	} else if resp.ContentLength > maxURLPreviewImageSize {
+		return nil, fmt.Errorf("%w (%.2f MiB)", ErrTooLargeFile, float64(resp.ContentLength)/1024/1024)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxURLPreviewImageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	} else if len(data) > maxURLPreviewImageSize {
+		return nil, ErrTooLargeFile
+	}
+	return data, nil
+}
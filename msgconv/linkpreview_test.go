@@ -0,0 +1,87 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"157.240.1.35", true},
+		{"2a03:2880:f003:c07:face:b00c::2", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, test := range tests {
+		if got := isPublicAddress(netip.MustParseAddr(test.addr)); got != test.want {
+			t.Errorf("isPublicAddress(%s) = %t, want %t", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestLinkPreviewRejectsInternalHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<html><head><meta property="og:title" content="Internal"></head></html>`)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	if _, err := fetchOpenGraph(ctx, server.URL+"/page"); !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("fetchOpenGraph() on loopback address returned %v, want errNonPublicAddress", err)
+	}
+	if _, err := fetchOpenGraph(ctx, "http://localhost:1/page"); !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("fetchOpenGraph() on localhost returned %v, want errNonPublicAddress", err)
+	}
+	if _, err := downloadLinkPreviewImage(ctx, server.URL+"/image.png"); !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("downloadLinkPreviewImage() on loopback address returned %v, want errNonPublicAddress", err)
+	}
+	if _, err := downloadLinkPreviewImage(ctx, "http://169.254.169.254/latest/meta-data/"); !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("downloadLinkPreviewImage() on link-local address returned %v, want errNonPublicAddress", err)
+	}
+
+	mc := &MessageConverter{PortalMethods: newTestPortal(), URLPreviews: true}
+	if preview := mc.LinkPreviewToWhatsApp(ctx, &waCommon.MessageText{Text: "see " + server.URL + "/page"}); preview != nil {
+		t.Errorf("got preview %+v of an internal page", preview)
+	}
+}
@@ -0,0 +1,196 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxTextLength is the maximum number of characters in a single text message sent to Meta.
+const MaxTextLength = 20000
+
+// splitFormattingReserve is the number of characters left free in each part for closing and reopening formatting.
+const splitFormattingReserve = 16
+
+var splitFormattingMarkers = []string{"```", "*", "_", "~"}
+
+// openFormatting returns the formatting markers that are still open at the end of the given text.
+func openFormatting(text []rune, alreadyOpen []string) []string {
+	open := slices.Clone(alreadyOpen)
+	toggle := func(marker string) {
+		for i, existing := range open {
+			if existing == marker {
+				open = append(open[:i], open[i+1:]...)
+				return
+			}
+		}
+		open = append(open, marker)
+	}
+	inCode := slices.Contains(open, "```")
+	for i := 0; i < len(text); i++ {
+		if i+3 <= len(text) && string(text[i:i+3]) == "```" {
+			toggle("```")
+			inCode = !inCode
+			i += 2
+		} else if !inCode && strings.ContainsRune("*_~", text[i]) {
+			toggle(string(text[i]))
+		}
+	}
+	return open
+}
+
+// findSplitPoint finds a good place to split the text before the given limit, preferring
+// line breaks and spaces, and never splitting inside a mention.
+func findSplitPoint(text []rune, limit int) int {
+	if len(text) <= limit {
+		return len(text)
+	}
+	cut := limit
+	minCut := limit * 3 / 4
+	for i := limit; i > minCut; i-- {
+		if text[i-1] == '\n' {
+			cut = i
+			break
+		}
+	}
+	if cut == limit {
+		for i := limit; i > minCut; i-- {
+			if unicode.IsSpace(text[i-1]) {
+				cut = i
+				break
+			}
+		}
+	}
+	// Mentions are @ followed by the user's numeric ID, so make sure the cut isn't in the middle of one
+	mentionStart := cut
+	for mentionStart > 0 && unicode.IsDigit(text[mentionStart-1]) {
+		mentionStart--
+	}
+	if mentionStart > 0 && mentionStart < cut && text[mentionStart-1] == '@' && cut < len(text) && unicode.IsDigit(text[cut]) {
+		cut = mentionStart - 1
+	}
+	if cut <= 0 {
+		cut = limit
+	}
+	return cut
+}
+
+// utf16Offsets returns the UTF-16 offset of each rune in the text, plus the total length at the end.
+func utf16Offsets(runes []rune) []uint32 {
+	offsets := make([]uint32, len(runes)+1)
+	for i, r := range runes {
+		length := uint32(1)
+		if r >= 0x10000 {
+			length = 2
+		}
+		offsets[i+1] = offsets[i] + length
+	}
+	return offsets
+}
+
+// avoidSplittingCommands moves the cut before any command (i.e. a room mention) that it would split.
+func avoidSplittingCommands(commands []*waCommon.Command, offsets []uint32, start, cut int) int {
+	cutOffset := offsets[start+cut]
+	for _, cmd := range commands {
+		if cmd.Offset < cutOffset && cmd.Offset+cmd.Length > cutOffset && cmd.Offset > offsets[start] {
+			for cut > 0 && offsets[start+cut] > cmd.Offset {
+				cut--
+			}
+		}
+	}
+	return cut
+}
+
+// containsMention checks if the text mentions the given user ID, without matching mentions of longer IDs
+// that happen to start with the same digits.
+func containsMention(text, user string) bool {
+	mention := "@" + user
+	for index := strings.Index(text, mention); index >= 0; {
+		end := index + len(mention)
+		if end == len(text) || !unicode.IsDigit(rune(text[end])) {
+			return true
+		}
+		next := strings.Index(text[end:], mention)
+		if next < 0 {
+			break
+		}
+		index = end + next
+	}
+	return false
+}
+
+// splitMessageText splits a text message into parts of at most maxLength characters. Formatting that's
+// open at a split is closed at the end of the part and reopened at the start of the next one, and each
+// part only mentions users whose mention is actually in that part. Commands are moved into the part that
+// contains them, with their UTF-16 offsets rebased on the part.
+func splitMessageText(text *waCommon.MessageText, maxLength int) []*waCommon.MessageText {
+	runes := []rune(text.Text)
+	if len(runes) <= maxLength {
+		return []*waCommon.MessageText{text}
+	}
+	offsets := utf16Offsets(runes)
+	var parts []*waCommon.MessageText
+	var open []string
+	for start := 0; start < len(runes); {
+		prefix := strings.Join(open, "")
+		remaining := runes[start:]
+		cut := findSplitPoint(remaining, maxLength-splitFormattingReserve-len([]rune(prefix)))
+		if cut < len(remaining) {
+			if safeCut := avoidSplittingCommands(text.Commands, offsets, start, cut); safeCut > 0 {
+				cut = safeCut
+			}
+		}
+		chunk := []rune(strings.TrimRightFunc(string(remaining[:cut]), unicode.IsSpace))
+		part := &waCommon.MessageText{}
+		prefixLength := uint32(len(utf16.Encode([]rune(prefix))))
+		for _, cmd := range text.Commands {
+			if cmd.Offset >= offsets[start] && cmd.Offset+cmd.Length <= offsets[start+len(chunk)] {
+				rebased := proto.Clone(cmd).(*waCommon.Command)
+				rebased.Offset = cmd.Offset - offsets[start] + prefixLength
+				part.Commands = append(part.Commands, rebased)
+			}
+		}
+		start += cut
+		if strings.Trim(string(runes[start:]), " \n*_~`") == "" {
+			// Only the closing formatting markers are left, and those are added to this part anyway
+			start = len(runes)
+		}
+		open = openFormatting(remaining[:cut], open)
+		var suffix strings.Builder
+		for i := len(open) - 1; i >= 0; i-- {
+			suffix.WriteString(open[i])
+		}
+		part.Text = prefix + string(chunk) + suffix.String()
+		parts = append(parts, part)
+	}
+	for _, part := range parts {
+		for _, jid := range text.MentionedJID {
+			parsed, err := types.ParseJID(jid)
+			if err == nil && containsMention(part.Text, parsed.User) {
+				part.MentionedJID = append(part.MentionedJID, jid)
+			}
+		}
+	}
+	return parts
+}
@@ -0,0 +1,104 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+)
+
+func TestSplitMessageTextRoomMention(t *testing.T) {
+	first := "👍 " + strings.Repeat("a", 60)
+	second := "*bold " + strings.Repeat("b", 40) + " 👍 @room " + strings.Repeat("c", 20) + "*"
+	text := &waCommon.MessageText{
+		Text: first + " " + second,
+		Commands: []*waCommon.Command{{
+			CommandType: waCommon.Command_EVERYONE,
+			Offset:      uint32(len(NewUTF16String(first + " " + strings.Split(second, "@room")[0]))),
+			Length:      uint32(len(NewUTF16String(roomMentionText))),
+		}},
+	}
+	parts := splitMessageText(text, 100)
+	if len(parts) < 2 {
+		t.Fatalf("got %d parts, want at least 2", len(parts))
+	}
+	var found int
+	for i, part := range parts {
+		utf16Text := NewUTF16String(part.GetText())
+		for _, cmd := range part.GetCommands() {
+			found++
+			if cmd.GetCommandType() != waCommon.Command_EVERYONE {
+				t.Errorf("part %d command type = %s, want EVERYONE", i, cmd.GetCommandType())
+			}
+			end := int(cmd.GetOffset() + cmd.GetLength())
+			if end > len(utf16Text) {
+				t.Fatalf("part %d command ends at %d, after the end of the part (%d)", i, end, len(utf16Text))
+			}
+			if mention := utf16Text[cmd.GetOffset():end].String(); mention != roomMentionText {
+				t.Errorf("part %d command covers %q, want %q", i, mention, roomMentionText)
+			}
+		}
+	}
+	if found != 1 {
+		t.Errorf("found %d room mentions in the parts, want 1", found)
+	}
+}
+
+func TestSplitMessageTextDoesNotCutRoomMention(t *testing.T) {
+	// There's no whitespace to split at, so the cut would land in the middle of @room
+	before := strings.Repeat("a", 82)
+	text := &waCommon.MessageText{
+		Text: before + roomMentionText + strings.Repeat("b", 40),
+		Commands: []*waCommon.Command{{
+			CommandType: waCommon.Command_EVERYONE,
+			Offset:      uint32(len(before)),
+			Length:      uint32(len(roomMentionText)),
+		}},
+	}
+	parts := splitMessageText(text, 100)
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	if parts[0].GetText() != before {
+		t.Errorf("first part = %q, want %q", parts[0].GetText(), before)
+	}
+	if len(parts[0].GetCommands()) != 0 {
+		t.Errorf("first part has %d commands, want 0", len(parts[0].GetCommands()))
+	}
+	if cmds := parts[1].GetCommands(); len(cmds) != 1 || cmds[0].GetOffset() != 0 {
+		t.Errorf("second part commands = %v, want one at offset 0", cmds)
+	}
+}
+
+func TestSplitMessageTextMentionPrefix(t *testing.T) {
+	text := &waCommon.MessageText{
+		Text:         "@1234 " + strings.Repeat("a", 90) + " @123 " + strings.Repeat("b", 20),
+		MentionedJID: []string{"123@msgr", "1234@msgr"},
+	}
+	parts := splitMessageText(text, 100)
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	if mentions := parts[0].GetMentionedJID(); len(mentions) != 1 || mentions[0] != "1234@msgr" {
+		t.Errorf("first part mentions = %v, want [1234@msgr]", mentions)
+	}
+	if mentions := parts[1].GetMentionedJID(); len(mentions) != 1 || mentions[0] != "123@msgr" {
+		t.Errorf("second part mentions = %v, want [123@msgr]", mentions)
+	}
+}
@@ -0,0 +1,165 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"html"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	formatKeyAllowedMentions = "fi.mau.meta.allowed_mentions"
+	formatKeyMentionedJIDs   = "fi.mau.meta.mentioned_jids"
+)
+
+func formatSurround(char string) format.TextConverter {
+	return func(str string, _ format.Context) string {
+		if str == "" {
+			return str
+		}
+		return char + str + char
+	}
+}
+
+func (mc *MessageConverter) matrixHTMLParser() *format.HTMLParser {
+	return &format.HTMLParser{
+		TabsToSpaces:   4,
+		Newline:        "\n",
+		HorizontalLine: "\n---\n",
+		PillConverter:  mc.convertMatrixPill,
+
+		BoldConverter:          formatSurround("*"),
+		ItalicConverter:        formatSurround("_"),
+		StrikethroughConverter: formatSurround("~"),
+		MonospaceConverter:     formatSurround("```"),
+		SpoilerConverter:       mc.convertMatrixSpoiler,
+		MonospaceBlockConverter: func(code, language string, ctx format.Context) string {
+			return "```" + strings.TrimSuffix(code, "\n") + "```"
+		},
+	}
+}
+
+func (mc *MessageConverter) convertMatrixSpoiler(text, reason string, _ format.Context) string {
+	prefix := "⚠️ Spoiler"
+	if reason != "" {
+		prefix += " (" + reason + ")"
+	}
+	if mc.SpoilerStyle == "hidden" {
+		return prefix + ": " + strings.Repeat("█", utf8.RuneCountInString(text))
+	}
+	return prefix + ": ||" + text + "||"
+}
+
+func (mc *MessageConverter) convertMatrixPill(displayname, mxid, eventID string, ctx format.Context) string {
+	if len(mxid) == 0 || mxid[0] != '@' {
+		return format.DefaultPillConverter(displayname, mxid, eventID, ctx)
+	}
+	userID := id.UserID(mxid)
+	allowedMentions, _ := ctx.ReturnData[formatKeyAllowedMentions].(*event.Mentions)
+	if allowedMentions != nil && !slices.Contains(allowedMentions.UserIDs, userID) {
+		return displayname
+	}
+	metaID := mc.GetUserMetaID(ctx.Ctx, userID)
+	if metaID == 0 {
+		return displayname
+	}
+	jid := types.JID{User: strconv.FormatInt(metaID, 10), Server: mc.UserJIDServer(ctx.Ctx)}
+	mentions, _ := ctx.ReturnData[formatKeyMentionedJIDs].([]string)
+	if !slices.Contains(mentions, jid.String()) {
+		ctx.ReturnData[formatKeyMentionedJIDs] = append(mentions, jid.String())
+	}
+	return "@" + jid.User
+}
+
+const defaultEmotePrefix = "/me "
+
+// leadingBlockTagsRegex matches any block-level opening tags at the start of a formatted body.
+var leadingBlockTagsRegex = regexp.MustCompile(`^(?:\s*<(?:p|div|blockquote|h[1-6]|pre|ul|ol|li)(?:\s[^>]*)?>)*`)
+
+// addMsgTypePrefix prepends the configured emote or notice prefix to the message, as Meta doesn't have either
+// message type. Other message types and notices without a configured prefix are left as-is.
+func (mc *MessageConverter) addMsgTypePrefix(ctx context.Context, sender id.UserID, content *event.MessageEventContent) {
+	switch content.MsgType {
+	case event.MsgEmote:
+		prefix := mc.EmotePrefix
+		if prefix == "" {
+			prefix = defaultEmotePrefix
+		}
+		mc.addMessagePrefix(ctx, sender, content, prefix)
+	case event.MsgNotice:
+		if mc.NoticePrefix != "" {
+			mc.addMessagePrefix(ctx, sender, content, mc.NoticePrefix)
+		}
+	}
+}
+
+// addMessagePrefix prepends the given prefix to the message, substituting %s with the sender's displayname.
+// In the formatted body, the prefix is inserted after leading block tags so that it's rendered on the same line.
+func (mc *MessageConverter) addMessagePrefix(ctx context.Context, sender id.UserID, content *event.MessageEventContent, prefix string) {
+	plainPrefix, htmlPrefix := prefix, prefix
+	if strings.Contains(prefix, "%s") {
+		name := mc.GetMatrixDisplayname(ctx, sender)
+		plainPrefix = strings.ReplaceAll(prefix, "%s", name)
+		htmlPrefix = strings.ReplaceAll(html.EscapeString(prefix), "%s", html.EscapeString(name))
+	}
+	content.Body = plainPrefix + content.Body
+	if content.FormattedBody != "" {
+		insertAt := len(leadingBlockTagsRegex.FindString(content.FormattedBody))
+		content.FormattedBody = content.FormattedBody[:insertAt] + htmlPrefix + content.FormattedBody[insertAt:]
+	}
+}
+
+// MaxFormattedBodyLength is the maximum size of a formatted body in bytes that will be parsed as HTML.
+// It's well above what the maximum text length allows, so only unreasonably large or malicious payloads are
+// affected. Those are bridged using the plaintext body instead.
+const MaxFormattedBodyLength = 64 * 1024
+
+// canParseFormattedBody returns whether the formatted body of the Matrix message is small enough to be parsed.
+func canParseFormattedBody(ctx context.Context, content *event.MessageEventContent) bool {
+	if len(content.FormattedBody) <= MaxFormattedBodyLength {
+		return true
+	}
+	zerolog.Ctx(ctx).Warn().
+		Int("formatted_body_length", len(content.FormattedBody)).
+		Msg("Formatted body is too long, using plaintext body instead")
+	return false
+}
+
+// parseMatrixHTML converts the formatted body of a Matrix message into WhatsApp-style
+// markdown and collects the Meta JIDs of any users mentioned with pills.
+// It returns an empty string if the formatted body is too long to be parsed.
+func (mc *MessageConverter) parseMatrixHTML(ctx context.Context, content *event.MessageEventContent) (string, []string) {
+	if !canParseFormattedBody(ctx, content) {
+		return "", nil
+	}
+	parseCtx := format.NewContext(ctx)
+	parseCtx.ReturnData[formatKeyAllowedMentions] = content.Mentions
+	text := mc.matrixHTMLParser().Parse(replaceCustomEmojis(content.FormattedBody), parseCtx)
+	mentions, _ := parseCtx.ReturnData[formatKeyMentionedJIDs].([]string)
+	return text, mentions
+}
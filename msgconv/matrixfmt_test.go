@@ -0,0 +1,222 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-meta/messagix/socket"
+)
+
+// htmlConversionTimeout is how long converting a single formatted body may take. Even pathological inputs
+// are either well under MaxFormattedBodyLength or skipped entirely, so this is very generous.
+const htmlConversionTimeout = 5 * time.Second
+
+type htmlConversionResult struct {
+	html     string
+	htmlJIDs []string
+	text     string
+	mentions *socket.MentionData
+}
+
+// convertHTMLWithTimeout runs both Matrix HTML converters in a goroutine, failing the test if either one
+// panics or takes longer than htmlConversionTimeout.
+func convertHTMLWithTimeout(t *testing.T, mc *MessageConverter, content *event.MessageEventContent) htmlConversionResult {
+	t.Helper()
+	done := make(chan htmlConversionResult, 1)
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				panicked <- err
+			}
+		}()
+		var res htmlConversionResult
+		res.html, res.htmlJIDs = mc.parseMatrixHTML(context.Background(), content)
+		res.text, res.mentions = mc.matrixToMetaUserMentions(context.Background(), content)
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		return res
+	case err := <-panicked:
+		t.Fatalf("converting formatted body %q panicked: %v", content.FormattedBody, err)
+	case <-time.After(htmlConversionTimeout):
+		t.Fatalf("converting formatted body of %d bytes took longer than %s", len(content.FormattedBody), htmlConversionTimeout)
+	}
+	return htmlConversionResult{}
+}
+
+// checkMentionBounds verifies that all Meta mentions point inside the converted text.
+func checkMentionBounds(t *testing.T, text string, mentions *socket.MentionData) {
+	t.Helper()
+	if mentions == nil {
+		return
+	}
+	parsed, err := mentions.Parse()
+	if err != nil {
+		t.Fatalf("generated mention data %+v can't be parsed: %v", mentions, err)
+	}
+	textLength := len(NewUTF16String(text))
+	for _, mention := range parsed {
+		if mention.Offset < 0 || mention.Length <= 0 || mention.Offset+mention.Length > textLength {
+			t.Errorf("mention %+v is outside text of %d UTF-16 units: %q", mention, textLength, text)
+		}
+	}
+}
+
+func newFuzzConverter() *MessageConverter {
+	portal := newTestPortal()
+	portal.metaIDs["@alice:example.com"] = 1001
+	portal.metaIDs["@bob:example.com"] = 1002
+	return &MessageConverter{PortalMethods: portal}
+}
+
+func FuzzParseMatrixHTML(f *testing.F) {
+	seeds := []string{
+		"",
+		"plain text",
+		"<b>bold</b> <i>italic</i> <del>strike</del> <code>code</code>",
+		"<pre><code class=\"language-go\">func main() {}\n</code></pre>",
+		`<a href="https://matrix.to/#/@alice:example.com">Alice</a> hi`,
+		`<a href="https://matrix.to/#/@alice:example.com">Alice</a> and <a href="https://matrix.to/#/@bob:example.com">Bob</a>`,
+		`<a href="https://matrix.to/#/@unknown:example.com">Nobody</a>`,
+		`<a href="https://matrix.to/#/@alice:example.com">` + string(mentionStartMarker) + `5` + string(mentionEndMarker) + `</a>`,
+		`text ` + string(mentionStartMarker) + `0` + string(mentionEndMarker) + ` <a href="https://matrix.to/#/@alice:example.com">A</a>`,
+		"<span data-mx-spoiler=\"reason\">secret</span>",
+		"<blockquote><p>quote</p></blockquote><ul><li>one</li><li>two</li></ul>",
+		"<img data-mx-emoticon src=\"mxc://example.com/emoji\" alt=\":emoji:\">",
+		strings.Repeat("<b>", 500) + "deep" + strings.Repeat("</b>", 500),
+		"<a href=\"https://matrix.to/#/@alice:example.com\"><b>unclosed",
+		"👩🏽‍💻 <b>emoji</b> ‍️",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	mc := newFuzzConverter()
+	f.Fuzz(func(t *testing.T, formattedBody string) {
+		content := &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          "fallback body",
+			Format:        event.FormatHTML,
+			FormattedBody: formattedBody,
+		}
+		res := convertHTMLWithTimeout(t, mc, content)
+		checkMentionBounds(t, res.text, res.mentions)
+
+		if formattedBody == "" {
+			return
+		}
+		// Repeat the input past the length limit, where both converters must fall back to the plaintext body
+		content.FormattedBody = strings.Repeat(formattedBody, MaxFormattedBodyLength/len(formattedBody)+1)
+		res = convertHTMLWithTimeout(t, mc, content)
+		if res.html != "" || res.htmlJIDs != nil {
+			t.Errorf("parseMatrixHTML() parsed a %d byte body, which is over the limit", len(content.FormattedBody))
+		}
+		if res.text != content.Body || res.mentions != nil {
+			t.Errorf("matrixToMetaUserMentions() = (%q, %+v) for a body over the limit, want the plaintext body", res.text, res.mentions)
+		}
+	})
+}
+
+func TestMatrixToMetaUserMentions(t *testing.T) {
+	mc := newFuzzConverter()
+	alice := `<a href="https://matrix.to/#/@alice:example.com">Alice</a>`
+	bob := `<a href="https://matrix.to/#/@bob:example.com">Bob</a>`
+	tests := []struct {
+		name          string
+		formattedBody string
+		mentions      *event.Mentions
+		wantText      string
+		wantIDs       []int64
+		wantOffsets   []int
+	}{
+		{name: "No pills", formattedBody: "<b>hello</b>", wantText: "fallback body"},
+		{name: "Single pill", formattedBody: "hi " + alice, wantText: "hi @Alice", wantIDs: []int64{1001}, wantOffsets: []int{3}},
+		{name: "Two pills", formattedBody: alice + " & " + bob, wantText: "@Alice & @Bob", wantIDs: []int64{1001, 1002}, wantOffsets: []int{0, 9}},
+		{name: "UTF-16 offsets after emoji", formattedBody: "👍 " + alice, wantText: "👍 @Alice", wantIDs: []int64{1001}, wantOffsets: []int{3}},
+		{
+			name:          "Pill not in allowed mentions",
+			formattedBody: alice + " " + bob,
+			mentions:      &event.Mentions{UserIDs: []id.UserID{"@bob:example.com"}},
+			wantText:      "Alice @Bob",
+			wantIDs:       []int64{1002},
+			wantOffsets:   []int{6},
+		},
+		{name: "Unknown user", formattedBody: `<a href="https://matrix.to/#/@carol:example.com">Carol</a>`, wantText: "fallback body"},
+		{name: "Forged marker", formattedBody: string(mentionStartMarker) + "9" + string(mentionEndMarker) + alice, wantText: "fallback body"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := &event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "fallback body",
+				Format:        event.FormatHTML,
+				FormattedBody: test.formattedBody,
+				Mentions:      test.mentions,
+			}
+			text, mentionData := mc.matrixToMetaUserMentions(context.Background(), content)
+			if text != test.wantText {
+				t.Errorf("text = %q, want %q", text, test.wantText)
+			}
+			var ids, offsets []string
+			for i, metaID := range test.wantIDs {
+				ids = append(ids, strconv.FormatInt(metaID, 10))
+				offsets = append(offsets, strconv.Itoa(test.wantOffsets[i]))
+			}
+			if len(test.wantIDs) == 0 {
+				if mentionData != nil {
+					t.Errorf("mentions = %+v, want none", mentionData)
+				}
+				return
+			} else if mentionData == nil {
+				t.Fatalf("mentions = nil, want %v", ids)
+			}
+			gotIDs, gotOffsets := mentionData.MentionIDs, mentionData.MentionOffsets
+			if gotIDs != strings.Join(ids, ",") || gotOffsets != strings.Join(offsets, ",") {
+				t.Errorf("mentions = ids %q offsets %q, want ids %q offsets %q", gotIDs, gotOffsets, strings.Join(ids, ","), strings.Join(offsets, ","))
+			}
+			checkMentionBounds(t, text, mentionData)
+		})
+	}
+}
+
+func TestParseMatrixHTMLLengthLimit(t *testing.T) {
+	mc := newFuzzConverter()
+	for _, length := range []int{MaxFormattedBodyLength, MaxFormattedBodyLength + 1} {
+		t.Run(fmt.Sprintf("%d bytes", length), func(t *testing.T) {
+			body := "<b>" + strings.Repeat("a", length-7) + "</b>"
+			text, _ := mc.parseMatrixHTML(context.Background(), &event.MessageEventContent{
+				Format:        event.FormatHTML,
+				FormattedBody: body,
+			})
+			if length <= MaxFormattedBodyLength && text == "" {
+				t.Error("body at the limit wasn't parsed")
+			} else if length > MaxFormattedBodyLength && text != "" {
+				t.Error("body over the limit was parsed")
+			}
+		})
+	}
+}
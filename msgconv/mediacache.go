@@ -0,0 +1,250 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waMediaTransport"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+)
+
+// cachedMedia contains the result of reuploading a Matrix file to WhatsApp,
+// including the changes that the reupload made to the event content.
+type cachedMedia struct {
+	Transport *waMediaTransport.WAMediaTransport
+	// FileName is the name of the file before conversion, which is only used if the event being sent doesn't
+	// have a file name. FileNameSuffix is the extension added by the conversion, e.g. .mp4 for GIFs.
+	FileName       string
+	FileNameSuffix string
+	MsgType        event.MessageType
+	Width          int
+	Height         int
+	Duration       int
+	CustomInfo     map[string]any
+
+	expiry time.Time
+}
+
+// MediaCache stores the results of reuploading Matrix media to WhatsApp, so that
+// sending the same file multiple times doesn't download, convert and upload it again.
+type MediaCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*cachedMedia
+}
+
+// NewMediaCache creates a new media cache. A zero TTL or max entry count disables the cache.
+func NewMediaCache(ttl time.Duration, maxEntries int) *MediaCache {
+	return &MediaCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cachedMedia),
+	}
+}
+
+func (mc *MediaCache) enabled() bool {
+	return mc != nil && mc.ttl > 0 && mc.maxEntries > 0
+}
+
+func (mc *MediaCache) get(key string) *cachedMedia {
+	if !mc.enabled() {
+		return nil
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	entry, ok := mc.entries[key]
+	if !ok {
+		return nil
+	} else if time.Now().After(entry.expiry) {
+		delete(mc.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (mc *MediaCache) put(key string, entry *cachedMedia) {
+	if !mc.enabled() {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	now := time.Now()
+	entry.expiry = now.Add(mc.ttl)
+	if _, exists := mc.entries[key]; !exists && len(mc.entries) >= mc.maxEntries {
+		mc.evict(now)
+	}
+	mc.entries[key] = entry
+}
+
+// evict removes expired entries, or the entry closest to expiring if none have expired yet.
+func (mc *MediaCache) evict(now time.Time) {
+	var oldestKey string
+	var oldestExpiry time.Time
+	for key, entry := range mc.entries {
+		if now.After(entry.expiry) {
+			delete(mc.entries, key)
+		} else if oldestKey == "" || entry.expiry.Before(oldestExpiry) {
+			oldestKey, oldestExpiry = key, entry.expiry
+		}
+	}
+	if len(mc.entries) >= mc.maxEntries {
+		delete(mc.entries, oldestKey)
+	}
+}
+
+func (mc *MessageConverter) mediaCacheKey(ctx context.Context, evt *event.Event, content *event.MessageEventContent) string {
+	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
+	return mc.contentMediaCacheKey(ctx, content, isVoice)
+}
+
+// contentMediaCacheKey returns the key for caching the upload of the given Matrix file. The cache is shared
+// between portals, so the key includes everything that changes how the file is converted, i.e. whether
+// transcoding is disabled in the portal and the converter options.
+func (mc *MessageConverter) contentMediaCacheKey(ctx context.Context, content *event.MessageEventContent, isVoice bool) string {
+	mxc := content.URL
+	if content.File != nil {
+		mxc = content.File.URL
+	}
+	if mxc == "" {
+		return ""
+	}
+	key := string(content.MsgType) + "|" + string(mxc)
+	if isVoice {
+		key += "|voice"
+	}
+	if mc.GetData(ctx).DisableTranscoding {
+		key += "|original"
+	}
+	return key + "|" + mc.mediaOptionsHash()
+}
+
+// mediaOptionsHash returns a short hash of the converter options that affect reuploaded media.
+func (mc *MessageConverter) mediaOptionsHash() string {
+	options := fmt.Sprintf(
+		"%t|%t|%d|%d|%t|%d|%d|%t|%s|%v|%v|%v|%t|%d|%d|%d",
+		mc.FFmpegAvailable, mc.NativeGIFs, mc.MaxNativeGIFSize, mc.MaxNativeGIFDimension,
+		mc.StickerLikeImages, mc.MaxStickerLikeSize, mc.MaxStickerLikeDimension,
+		mc.TranscodeVoiceMessages, mc.VoiceCodec, mc.VoiceConvertArgs, mc.VoiceOpusConvertArgs, mc.GIFConvertArgs,
+		mc.AddSilentAudio, mc.MaxImageDimension, mc.MaxThumbnailDimension, mc.ThumbnailQuality,
+	)
+	hash := sha256.Sum256([]byte(options))
+	return hex.EncodeToString(hash[:8])
+}
+
+func (mc *MessageConverter) getCachedMedia(ctx context.Context, evt *event.Event, content *event.MessageEventContent) (*waMediaTransport.WAMediaTransport, string, bool) {
+	key := mc.mediaCacheKey(ctx, evt, content)
+	if key == "" {
+		return nil, "", false
+	}
+	cached := mc.MediaCache.get(key)
+	if cached == nil {
+		return nil, "", false
+	}
+	content.MsgType = cached.MsgType
+	info := content.GetInfo()
+	info.Width, info.Height, info.Duration = cached.Width, cached.Height, cached.Duration
+	for infoKey, value := range cached.CustomInfo {
+		setCustomInfo(evt, infoKey, value)
+	}
+	// The cache TTL ensures that the direct path hasn't expired yet, but some clients reject media
+	// with an old media key timestamp, so it's bumped to make the reused upload look fresh.
+	transport := proto.Clone(cached.Transport).(*waMediaTransport.WAMediaTransport)
+	refreshMediaKeyTimestamp(transport)
+	// The same file may be sent with a different name, so only reuse the extension from the conversion
+	fileName := mediaFileName(content)
+	if fileName == "" {
+		fileName = cached.FileName
+	}
+	return transport, fileName + cached.FileNameSuffix, true
+}
+
+// refreshMediaKeyTimestamp sets the media key timestamp of the transport to the current time
+// without touching any of the other fields.
+func refreshMediaKeyTimestamp(transport *waMediaTransport.WAMediaTransport) {
+	if transport.GetIntegral() != nil {
+		transport.Integral.MediaKeyTimestamp = time.Now().Unix()
+	}
+}
+
+// getCachedQuoteMedia returns the cached upload of a Matrix image or video without modifying the content,
+// so that quoted messages can include the media and its thumbnail like replies from native clients do.
+// Media that was converted to a different type when it was uploaded (e.g. GIFs) isn't returned.
+func (mc *MessageConverter) getCachedQuoteMedia(ctx context.Context, content *event.MessageEventContent) *cachedMedia {
+	key := mc.contentMediaCacheKey(ctx, content, false)
+	if key == "" {
+		return nil
+	}
+	cached := mc.MediaCache.get(key)
+	if cached == nil || cached.MsgType != content.MsgType {
+		return nil
+	}
+	return &cachedMedia{
+		Transport: proto.Clone(cached.Transport).(*waMediaTransport.WAMediaTransport),
+		MsgType:   cached.MsgType,
+		Width:     cached.Width,
+		Height:    cached.Height,
+		Duration:  cached.Duration,
+	}
+}
+
+func (mc *MessageConverter) cacheMedia(
+	ctx context.Context,
+	evt *event.Event,
+	origMsgType event.MessageType,
+	content *event.MessageEventContent,
+	transport *waMediaTransport.WAMediaTransport,
+	origFileName, fileName string,
+) {
+	if !mc.MediaCache.enabled() {
+		return
+	}
+	key := mc.mediaCacheKey(ctx, evt, &event.MessageEventContent{MsgType: origMsgType, URL: content.URL, File: content.File})
+	if key == "" {
+		return
+	}
+	customInfo, _ := evt.Content.Raw["info"].(map[string]any)
+	fiMauInfo := make(map[string]any)
+	maps.Copy(fiMauInfo, customInfo)
+	maps.DeleteFunc(fiMauInfo, func(key string, _ any) bool {
+		return !strings.HasPrefix(key, "fi.mau.")
+	})
+	var fileNameSuffix string
+	if strings.HasPrefix(fileName, origFileName) {
+		fileNameSuffix = fileName[len(origFileName):]
+	}
+	mc.MediaCache.put(key, &cachedMedia{
+		Transport:      proto.Clone(transport).(*waMediaTransport.WAMediaTransport),
+		FileName:       origFileName,
+		FileNameSuffix: fileNameSuffix,
+		MsgType:        content.MsgType,
+		Width:          content.Info.Width,
+		Height:         content.Info.Height,
+		Duration:       content.Info.Duration,
+		CustomInfo:     fiMauInfo,
+	})
+}
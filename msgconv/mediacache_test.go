@@ -0,0 +1,106 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waMediaTransport"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestContentMediaCacheKey(t *testing.T) {
+	ctx := context.Background()
+	portal := newTestPortal()
+	mc := &MessageConverter{PortalMethods: portal}
+	content := &event.MessageEventContent{MsgType: event.MsgImage, URL: "mxc://example.com/gif"}
+
+	base := mc.contentMediaCacheKey(ctx, content, false)
+	if base == "" {
+		t.Fatal("expected a cache key for content with a URL")
+	}
+	if voice := mc.contentMediaCacheKey(ctx, content, true); voice == base {
+		t.Error("voice and non-voice uploads share a cache key")
+	}
+
+	portal.data.DisableTranscoding = true
+	if original := mc.contentMediaCacheKey(ctx, content, false); original == base {
+		t.Error("portals with transcoding disabled share a cache key with transcoding portals")
+	}
+	portal.data.DisableTranscoding = false
+
+	mc.FFmpegAvailable = true
+	if withFFmpeg := mc.contentMediaCacheKey(ctx, content, false); withFFmpeg == base {
+		t.Error("converter options that change the output don't change the cache key")
+	}
+	mc.FFmpegAvailable = false
+	if again := mc.contentMediaCacheKey(ctx, content, false); again != base {
+		t.Errorf("cache key isn't stable: %q != %q", again, base)
+	}
+
+	if empty := mc.contentMediaCacheKey(ctx, &event.MessageEventContent{MsgType: event.MsgImage}, false); empty != "" {
+		t.Errorf("expected no cache key for content without a URL, got %q", empty)
+	}
+}
+
+func TestCachedMediaFileName(t *testing.T) {
+	ctx := context.Background()
+	mc := &MessageConverter{PortalMethods: newTestPortal(), MediaCache: NewMediaCache(time.Hour, 10)}
+	evt := &event.Event{Type: event.EventMessage, Content: event.Content{Raw: map[string]any{}}}
+	sent := &event.MessageEventContent{MsgType: event.MsgVideo, URL: "mxc://example.com/gif", Info: &event.FileInfo{}}
+	mc.cacheMedia(ctx, evt, event.MsgImage, sent, &waMediaTransport.WAMediaTransport{}, "cat.gif", "cat.gif.mp4")
+
+	tests := []struct {
+		name    string
+		content *event.MessageEventContent
+		want    string
+	}{
+		{name: "Different file name", content: &event.MessageEventContent{FileName: "dog.gif", Body: "look"}, want: "dog.gif.mp4"},
+		{name: "Body as file name", content: &event.MessageEventContent{Body: "party.gif"}, want: "party.gif.mp4"},
+		{name: "No file name", content: &event.MessageEventContent{}, want: "cat.gif.mp4"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.content.MsgType = event.MsgImage
+			test.content.URL = sent.URL
+			_, fileName, ok := mc.getCachedMedia(ctx, evt, test.content)
+			if !ok {
+				t.Fatal("media wasn't found in the cache")
+			} else if fileName != test.want {
+				t.Errorf("file name = %q, want %q", fileName, test.want)
+			}
+		})
+	}
+}
+
+func TestCachedDocumentFileName(t *testing.T) {
+	mc := &MessageConverter{PortalMethods: newTestPortal(), MediaCache: NewMediaCache(time.Hour, 10)}
+	content, data := newTestMediaContent(t, event.MsgFile, "report.pdf", "report.pdf")
+	if fileName := testCaption(t, convertTestMessage(t, mc, content, data)).GetText(); fileName != "report.pdf" {
+		t.Fatalf("first upload file name = %q, want %q", fileName, "report.pdf")
+	}
+	content, _ = newTestMediaContent(t, event.MsgFile, "final report.pdf", "final report.pdf")
+	content.URL = "mxc://example.com/media"
+	// The media is in the cache, so the second conversion must not download the file again
+	mc.MediaDownloader = fixtureDownloader{}
+	converted := convertTestMessage(t, mc, content, nil)
+	if fileName := testCaption(t, converted).GetText(); fileName != "final report.pdf" {
+		t.Errorf("cached upload file name = %q, want %q", fileName, "final report.pdf")
+	}
+}
@@ -0,0 +1,180 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"image/gif"
+	"image/png"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// mediaConversion is the conversion that's applied to a Matrix file before reuploading it to WhatsApp.
+type mediaConversion int
+
+const (
+	mediaConversionNone mediaConversion = iota
+	mediaConversionVoice
+	mediaConversionNativeGIF
+	mediaConversionGIFFirstFrame
+	mediaConversionGIFToMP4
+	mediaConversionAnimatedWebPToMP4
+	mediaConversionSilentAudio
+	mediaConversionHEICAsFile
+	mediaConversionHEICToJPEG
+	mediaConversionSVGAsFile
+	mediaConversionSVGToPNG
+	mediaConversionPDFPageCount
+	mediaConversionOriginalSticker
+	mediaConversionStickerAsImage
+	mediaConversionSticker
+)
+
+// mediaProperties are the properties of a Matrix file that decide how it's sent to WhatsApp. They're read
+// from the file itself when reuploading, and from the info in the Matrix event when estimating.
+type mediaProperties struct {
+	MimeType string
+	FileName string
+	Size     int64
+	Width    int
+	Height   int
+	IsVoice  bool
+	// Animated is only set for WebP images.
+	Animated bool
+	// Transparent is only set for PNG images.
+	Transparent bool
+}
+
+// readMediaProperties reads the properties of a downloaded Matrix file. The files are only decoded as far
+// as needed for routing, so e.g. PNGs are only fully decoded when sticker-like images are enabled.
+func (mc *MessageConverter) readMediaProperties(msgType event.MessageType, data []byte, mimeType, fileName string, isVoice bool) mediaProperties {
+	props := mediaProperties{
+		MimeType: mimeType,
+		FileName: fileName,
+		Size:     int64(len(data)),
+		IsVoice:  isVoice,
+	}
+	if msgType != event.MsgImage {
+		return props
+	}
+	switch mimeType {
+	case "image/gif":
+		if cfg, err := gif.DecodeConfig(bytes.NewReader(data)); err == nil {
+			props.Width, props.Height = cfg.Width, cfg.Height
+		}
+	case "image/webp":
+		props.Animated = isAnimatedWebP(data)
+	case "image/png":
+		if !mc.StickerLikeImages {
+			break
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			break
+		}
+		props.Width, props.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		opaque, ok := img.(interface{ Opaque() bool })
+		props.Transparent = ok && !opaque.Opaque()
+	}
+	return props
+}
+
+// estimateMediaProperties returns the properties of a Matrix file based on the info in the event. Clients
+// don't declare whether PNGs are transparent, so small square PNGs are assumed to be sticker-like.
+func estimateMediaProperties(evt *event.Event, content *event.MessageEventContent) mediaProperties {
+	info := content.GetInfo()
+	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
+	rawInfo, _ := evt.Content.Raw["info"].(map[string]any)
+	isAnimated, _ := rawInfo["is_animated"].(bool)
+	return mediaProperties{
+		MimeType:    info.MimeType,
+		FileName:    mediaFileName(content),
+		Size:        int64(info.Size),
+		Width:       info.Width,
+		Height:      info.Height,
+		IsVoice:     isVoice,
+		Animated:    info.MimeType == "image/webp" && isAnimated,
+		Transparent: info.MimeType == "image/png",
+	}
+}
+
+// canSendNativeGIF checks whether a GIF is small enough to be sent without converting it to mp4.
+func (mc *MessageConverter) canSendNativeGIF(props mediaProperties) bool {
+	if !mc.NativeGIFs || (mc.MaxNativeGIFSize > 0 && props.Size > mc.MaxNativeGIFSize) || props.Width == 0 || props.Height == 0 {
+		return false
+	}
+	return mc.MaxNativeGIFDimension <= 0 || (props.Width <= mc.MaxNativeGIFDimension && props.Height <= mc.MaxNativeGIFDimension)
+}
+
+// isStickerLikeImage checks whether a PNG is small, square and transparent enough
+// that it was most likely meant to be a sticker or custom emoji rather than a photo.
+func (mc *MessageConverter) isStickerLikeImage(props mediaProperties) bool {
+	if !mc.StickerLikeImages || (mc.MaxStickerLikeSize > 0 && props.Size > mc.MaxStickerLikeSize) {
+		return false
+	} else if props.Width == 0 || props.Width != props.Height || (mc.MaxStickerLikeDimension > 0 && props.Width > mc.MaxStickerLikeDimension) {
+		return false
+	}
+	return props.Transparent
+}
+
+// routeWhatsAppMedia decides which type of WhatsApp message a Matrix file will be sent as and how it's converted
+// before uploading. Both reuploading and estimating use this, so that estimates match what's actually sent.
+// HEIC and SVG images can only be converted with ffmpeg, so without it they're sent as files right away.
+func (mc *MessageConverter) routeWhatsAppMedia(ctx context.Context, msgType event.MessageType, props mediaProperties) (event.MessageType, mediaConversion) {
+	transcodingDisabled := mc.GetData(ctx).DisableTranscoding
+	isGIF := msgType == event.MsgImage && props.MimeType == "image/gif"
+	switch {
+	case props.IsVoice:
+		return msgType, mediaConversionVoice
+	case isGIF && (transcodingDisabled || mc.canSendNativeGIF(props)):
+		// With transcoding disabled, the original GIF is sent the same way as native GIFs to keep GIF playback
+		return event.MsgVideo, mediaConversionNativeGIF
+	case isGIF && !mc.FFmpegAvailable:
+		return event.MsgImage, mediaConversionGIFFirstFrame
+	case isGIF:
+		return event.MsgVideo, mediaConversionGIFToMP4
+	case msgType == event.MsgImage && props.MimeType == "image/webp" && props.Animated && mc.FFmpegAvailable && !transcodingDisabled:
+		return event.MsgVideo, mediaConversionAnimatedWebPToMP4
+	case msgType == event.MsgVideo && mc.AddSilentAudio && !transcodingDisabled:
+		return msgType, mediaConversionSilentAudio
+	case msgType == event.MsgImage && isHEIC(props.MimeType, props.FileName):
+		if transcodingDisabled || !mc.FFmpegAvailable {
+			return event.MsgFile, mediaConversionHEICAsFile
+		}
+		return msgType, mediaConversionHEICToJPEG
+	case msgType == event.MsgImage && isSVG(props.MimeType, props.FileName):
+		if transcodingDisabled || !mc.FFmpegAvailable {
+			return event.MsgFile, mediaConversionSVGAsFile
+		}
+		return msgType, mediaConversionSVGToPNG
+	case msgType == event.MsgImage && props.MimeType == "image/png" && mc.isStickerLikeImage(props):
+		return event.MessageType(event.EventSticker.Type), mediaConversionNone
+	case msgType == event.MsgFile && props.MimeType == "application/pdf":
+		return msgType, mediaConversionPDFPageCount
+	case msgType == event.MessageType(event.EventSticker.Type) && transcodingDisabled:
+		if props.MimeType != "image/webp" {
+			return event.MsgImage, mediaConversionStickerAsImage
+		}
+		return msgType, mediaConversionOriginalSticker
+	case msgType == event.MessageType(event.EventSticker.Type):
+		return msgType, mediaConversionSticker
+	default:
+		return msgType, mediaConversionNone
+	}
+}
@@ -19,11 +19,16 @@ package msgconv
 import (
 	"context"
 	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-meta/messagix/socket"
 )
@@ -93,3 +98,170 @@ func (mc *MessageConverter) metaToMatrixText(ctx context.Context, text string, r
 	content.FormattedBody = output.String()
 	return content
 }
+
+const formatKeyMetaMentions = "fi.mau.meta.meta_mentions"
+
+// Pills are replaced with these private use characters around the mention index while parsing the HTML,
+// so that the mention offsets can be calculated from the final plaintext.
+const (
+	mentionStartMarker = '\uE000'
+	mentionEndMarker   = '\uE001'
+)
+
+type pendingMetaMention struct {
+	ID   int64
+	Text string
+}
+
+func identityConverter(str string, _ format.Context) string {
+	return str
+}
+
+// convertMetaPill replaces a Matrix user pill with the Meta mention text. Instagram mentions use the
+// username, as that's what Instagram clients display, while Messenger mentions use the displayname.
+func (mc *MessageConverter) convertMetaPill(displayname, mxid, eventID string, ctx format.Context) string {
+	if len(mxid) == 0 || mxid[0] != '@' {
+		return format.DefaultPillConverter(displayname, mxid, eventID, ctx)
+	}
+	userID := id.UserID(mxid)
+	allowedMentions, _ := ctx.ReturnData[formatKeyAllowedMentions].(*event.Mentions)
+	if allowedMentions != nil && !slices.Contains(allowedMentions.UserIDs, userID) {
+		return displayname
+	}
+	metaID := mc.GetUserMetaID(ctx.Ctx, userID)
+	if metaID == 0 {
+		return displayname
+	}
+	text := "@" + displayname
+	if mc.BridgeMode.IsInstagram() {
+		if username := mc.GetUserUsername(ctx.Ctx, metaID); username != "" {
+			text = "@" + username
+		}
+	}
+	mentions, _ := ctx.ReturnData[formatKeyMetaMentions].([]pendingMetaMention)
+	ctx.ReturnData[formatKeyMetaMentions] = append(mentions, pendingMetaMention{ID: metaID, Text: text})
+	return string(mentionStartMarker) + strconv.Itoa(len(mentions)) + string(mentionEndMarker)
+}
+
+// roomMentionText is how clients write room mentions in the message body.
+const roomMentionText = "@room"
+
+// mentionsRoom returns whether the Matrix message mentions everyone in the room. Room mentions are
+// ignored in private chats, as neither Meta nor WhatsApp have group-wide mentions there.
+func (mc *MessageConverter) mentionsRoom(ctx context.Context, content *event.MessageEventContent) bool {
+	return content.Mentions != nil && content.Mentions.Room && !mc.IsPrivateChat(ctx)
+}
+
+// checkRoomMention rejects messages that mention the whole room if the sender doesn't have the power level
+// for room notifications, rather than bridging a mention that the Matrix side wouldn't have allowed.
+func (mc *MessageConverter) checkRoomMention(ctx context.Context, evt *event.Event, content *event.MessageEventContent) error {
+	if mc.mentionsRoom(ctx, content) && !mc.CanMentionRoom(ctx, evt.Sender) {
+		return ErrRoomMentionNotAllowed
+	}
+	return nil
+}
+
+// findRoomMention finds the UTF-16 offset and length of the room mention in the converted text.
+// Mentions without the @room text can't be bridged, as both Meta and WhatsApp need a range to highlight.
+func findRoomMention(text string) (offset, length int, ok bool) {
+	index := strings.Index(text, roomMentionText)
+	if index < 0 {
+		return 0, 0, false
+	}
+	return len(NewUTF16String(text[:index])), len(NewUTF16String(roomMentionText)), true
+}
+
+// matrixToMetaText converts the body of a Matrix message into plaintext and mention data for Meta,
+// including a thread mention if the message mentions the whole room.
+func (mc *MessageConverter) matrixToMetaText(ctx context.Context, content *event.MessageEventContent) (string, *socket.MentionData) {
+	text, mentionData := mc.matrixToMetaUserMentions(ctx, content)
+	if !mc.mentionsRoom(ctx, content) {
+		return text, mentionData
+	}
+	offset, length, ok := findRoomMention(text)
+	if !ok {
+		zerolog.Ctx(ctx).Debug().Msg("Not bridging room mention, as the message doesn't contain @room")
+		return text, mentionData
+	}
+	var mentions socket.Mentions
+	if mentionData != nil {
+		var err error
+		mentions, err = mentionData.Parse()
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to parse mentions to add room mention")
+			return text, mentionData
+		}
+	}
+	mentions = append(mentions, socket.Mention{
+		ID:     mc.GetData(ctx).ThreadID,
+		Offset: offset,
+		Length: length,
+		Type:   socket.MentionTypeThread,
+	})
+	sort.Sort(mentions)
+	data := mentions.ToData()
+	return text, &data
+}
+
+// matrixToMetaUserMentions converts the body of a Matrix message into plaintext and user mention data for Meta.
+// Messages without user pills are sent using the plaintext body as-is.
+func (mc *MessageConverter) matrixToMetaUserMentions(ctx context.Context, content *event.MessageEventContent) (string, *socket.MentionData) {
+	if content.Format != event.FormatHTML || !strings.Contains(content.FormattedBody, "https://matrix.to/#/@") ||
+		!canParseFormattedBody(ctx, content) {
+		return content.Body, nil
+	}
+	parser := &format.HTMLParser{
+		TabsToSpaces:   4,
+		Newline:        "\n",
+		HorizontalLine: "\n---\n",
+		PillConverter:  mc.convertMetaPill,
+
+		BoldConverter:          identityConverter,
+		ItalicConverter:        identityConverter,
+		StrikethroughConverter: identityConverter,
+		MonospaceConverter:     identityConverter,
+	}
+	parseCtx := format.NewContext(ctx)
+	parseCtx.ReturnData[formatKeyAllowedMentions] = content.Mentions
+	text := parser.Parse(content.FormattedBody, parseCtx)
+	mentions, _ := parseCtx.ReturnData[formatKeyMetaMentions].([]pendingMetaMention)
+	if len(mentions) == 0 {
+		return content.Body, nil
+	}
+	var output strings.Builder
+	var ids, offsets, lengths, types []string
+	utf16Offset := 0
+	for {
+		start := strings.IndexRune(text, mentionStartMarker)
+		if start < 0 {
+			break
+		}
+		markerLength := strings.IndexRune(text[start:], mentionEndMarker)
+		if markerLength < 0 {
+			return content.Body, nil
+		}
+		index, err := strconv.Atoi(text[start+utf8.RuneLen(mentionStartMarker) : start+markerLength])
+		if err != nil || index >= len(mentions) {
+			// The marker wasn't produced by convertMetaPill, so it's safer to send the message without mentions
+			return content.Body, nil
+		}
+		output.WriteString(text[:start])
+		utf16Offset += len(NewUTF16String(text[:start]))
+		mention := mentions[index]
+		mentionLength := len(NewUTF16String(mention.Text))
+		output.WriteString(mention.Text)
+		ids = append(ids, strconv.FormatInt(mention.ID, 10))
+		offsets = append(offsets, strconv.Itoa(utf16Offset))
+		lengths = append(lengths, strconv.Itoa(mentionLength))
+		types = append(types, string(socket.MentionTypePerson))
+		utf16Offset += mentionLength
+		text = text[start+markerLength+utf8.RuneLen(mentionEndMarker):]
+	}
+	output.WriteString(text)
+	return output.String(), &socket.MentionData{
+		MentionIDs:     strings.Join(ids, ","),
+		MentionOffsets: strings.Join(offsets, ","),
+		MentionLengths: strings.Join(lengths, ","),
+		MentionTypes:   strings.Join(types, ","),
+	}
+}
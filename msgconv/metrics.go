@@ -0,0 +1,85 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"errors"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// ConversionOutcome is the result of converting a Matrix message, as reported to ConversionMetrics.
+type ConversionOutcome string
+
+const (
+	ConversionSuccess     ConversionOutcome = "success"
+	ConversionUnsupported ConversionOutcome = "unsupported"
+	ConversionError       ConversionOutcome = "error"
+)
+
+// MediaStep is a stage of bridging Matrix media, as reported to ConversionMetrics.
+type MediaStep string
+
+const (
+	MediaStepDownload  MediaStep = "download"
+	MediaStepTranscode MediaStep = "transcode"
+	MediaStepUpload    MediaStep = "upload"
+)
+
+// ConversionMetrics receives metrics about converting Matrix messages, so that they can be exported
+// e.g. as Prometheus counters and histograms. Implementations must be safe for concurrent use.
+type ConversionMetrics interface {
+	// ObserveConversion is called once for every Matrix message converted to Meta or WhatsApp.
+	ObserveConversion(msgType event.MessageType, outcome ConversionOutcome)
+	// ObserveMediaStep is called after each media step with its duration and the size of the resulting
+	// data. Failed downloads and uploads are reported too, with a size of zero.
+	ObserveMediaStep(msgType event.MessageType, step MediaStep, duration time.Duration, size int)
+}
+
+// conversionMsgType returns the msgtype that a Matrix event is reported as in metrics.
+// Non-message events like stickers and polls use their event type instead.
+func conversionMsgType(evt *event.Event, content *event.MessageEventContent) event.MessageType {
+	if evt.Type != event.EventMessage {
+		return event.MessageType(evt.Type.Type)
+	}
+	return content.MsgType
+}
+
+func conversionOutcome(err error) ConversionOutcome {
+	switch {
+	case err == nil:
+		return ConversionSuccess
+	case errors.Is(err, ErrUnsupportedMsgType), errors.Is(err, ErrUnsupportedEffect), errors.Is(err, ErrUnsupportedReaction),
+		errors.Is(err, ErrUnsupportedSticker):
+		return ConversionUnsupported
+	default:
+		return ConversionError
+	}
+}
+
+func (mc *MessageConverter) observeConversion(msgType event.MessageType, err error) {
+	if mc.Metrics != nil {
+		mc.Metrics.ObserveConversion(msgType, conversionOutcome(err))
+	}
+}
+
+func (mc *MessageConverter) observeMediaStep(msgType event.MessageType, step MediaStep, start time.Time, size int) {
+	if mc.Metrics != nil {
+		mc.Metrics.ObserveMediaStep(msgType, step, time.Since(start), size)
+	}
+}
@@ -18,22 +18,45 @@ package msgconv
 
 import (
 	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/rs/zerolog"
 	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"go.mau.fi/mautrix-meta/config"
 	"go.mau.fi/mautrix-meta/database"
 	"go.mau.fi/mautrix-meta/messagix"
 	"go.mau.fi/mautrix-meta/messagix/socket"
 )
 
+// MediaDownloader downloads media from Matrix. The portal implements it using the homeserver's media repo,
+// but a different implementation can be set in MessageConverter.MediaDownloader, e.g. to serve files from
+// a local cache or other storage.
+type MediaDownloader interface {
+	DownloadMatrixMedia(ctx context.Context, uri id.ContentURIString) ([]byte, error)
+}
+
 type PortalMethods interface {
+	MediaDownloader
 	UploadMatrixMedia(ctx context.Context, data []byte, fileName, contentType string) (id.ContentURIString, error)
-	DownloadMatrixMedia(ctx context.Context, uri id.ContentURIString) ([]byte, error)
 	GetMatrixReply(ctx context.Context, messageID string, replyToUser int64) (replyTo id.EventID, replyTargetSender id.UserID)
-	GetMetaReply(ctx context.Context, content *event.MessageEventContent) *socket.ReplyMetaData
+	GetMetaReply(ctx context.Context, replyToID id.EventID) *socket.ReplyMetaData
+	GetReplyTargetContent(ctx context.Context, eventID id.EventID) *event.MessageEventContent
+	GetMessageByMXID(ctx context.Context, eventID id.EventID) *database.Message
+	// GetMessagesBetween returns the first parts of the messages in the portal sent after min and at or before max.
+	GetMessagesBetween(ctx context.Context, min, max time.Time) []*database.Message
 	GetUserMXID(ctx context.Context, userID int64) id.UserID
+	GetUserMetaID(ctx context.Context, userID id.UserID) int64
+	GetUserWhatsAppServer(ctx context.Context, userID int64) string
+	GetUserUsername(ctx context.Context, userID int64) string
+	GetMatrixDisplayname(ctx context.Context, userID id.UserID) string
+	CanMentionRoom(ctx context.Context, userID id.UserID) bool
 	ShouldFetchXMA(ctx context.Context) bool
 	GetThreadURL(ctx context.Context) (string, string)
 
@@ -45,12 +68,143 @@ type PortalMethods interface {
 type MessageConverter struct {
 	PortalMethods
 
-	ConvertVoiceMessages bool
-	ConvertGIFToAPNG     bool
-	MaxFileSize          int64
-	AsyncFiles           bool
+	BridgeMode config.BridgeMode
+
+	ConvertVoiceMessages    bool
+	FFmpegAvailable         bool
+	ConvertGIFToAPNG        bool
+	MaxFileSize             int64
+	AsyncFiles              bool
+	MediaUploadRetries      int
+	ConversionTimeout       time.Duration
+	URLPreviews             bool
+	URLPreviewTimeout       time.Duration
+	SendUnsupportedAsText   bool
+	EmotePrefix             string
+	NoticePrefix            string
+	LocationAddress         string
+	MediaCache              *MediaCache
+	MaxThumbnailDimension   int
+	MaxImageDimension       int
+	ThumbnailQuality        int
+	SpoilerStyle            string
+	NativeGIFs              bool
+	MaxNativeGIFSize        int64
+	MaxNativeGIFDimension   int
+	StickerLikeImages       bool
+	MaxStickerLikeSize      int64
+	MaxStickerLikeDimension int
+	CustomEmojiStickers     bool
+	SplitLongMessages       bool
+	TranscodeVoiceMessages  bool
+	VoiceCodec              VoiceCodec
+	AddSilentAudio          bool
+	RouteFilesByMimetype    bool
+	ThreadsAsReplies        bool
+	CaptionPlacement        CaptionPlacement
+	GIFConvertArgs          config.FFmpegArgs
+	VoiceConvertArgs        config.FFmpegArgs
+	VoiceOpusConvertArgs    config.FFmpegArgs
+
+	// UploadAttempt is an optional callback for tracking the attempts to upload media to WhatsApp.
+	UploadAttempt UploadAttemptFunc
+	// MediaPresence is an optional callback for showing activity in the chat while media is being processed.
+	MediaPresence MediaPresenceFunc
+	// MediaDownloader optionally overrides where Matrix media is downloaded from. If nil, the portal is used.
+	MediaDownloader MediaDownloader
+	// MediaUploader optionally overrides where media is uploaded to. If nil, the portal's E2EE client is used.
+	MediaUploader MediaUploader
+	// Metrics optionally receives conversion outcomes and media processing durations for monitoring.
+	Metrics ConversionMetrics
+}
+
+var (
+	defaultGIFConvertArgs = config.FFmpegArgs{
+		Input: []string{"-f", "gif"},
+		Output: []string{
+			"-pix_fmt", "yuv420p", "-c:v", "libx264", "-movflags", "+faststart",
+			"-filter:v", "crop='floor(in_w/2)*2:floor(in_h/2)*2'",
+		},
+	}
+	defaultVoiceConvertArgs = config.FFmpegArgs{
+		Input:  []string{},
+		Output: []string{"-c:a", "aac"},
+	}
+	defaultVoiceOpusConvertArgs = config.FFmpegArgs{
+		Input:  []string{},
+		Output: []string{"-c:a", "libopus"},
+	}
+)
+
+// ffmpegArgs returns the configured ffmpeg input and output args, or the defaults if the config is invalid.
+func ffmpegArgs(ctx context.Context, name string, args, defaults config.FFmpegArgs) ([]string, []string) {
+	valid := len(args.Output) > 0
+	for _, arg := range append(slices.Clone(args.Input), args.Output...) {
+		if strings.TrimSpace(arg) == "" {
+			valid = false
+		}
+	}
+	if !valid {
+		if len(args.Input) > 0 || len(args.Output) > 0 {
+			zerolog.Ctx(ctx).Warn().
+				Str("conversion", name).
+				Strs("input_args", args.Input).
+				Strs("output_args", args.Output).
+				Msg("Invalid ffmpeg args in config, using defaults")
+		}
+		return defaults.Input, defaults.Output
+	}
+	if args.Input == nil {
+		args.Input = []string{}
+	}
+	return args.Input, args.Output
+}
+
+func (mc *MessageConverter) gifConvertArgs(ctx context.Context) ([]string, []string) {
+	return ffmpegArgs(ctx, "gif_to_mp4", mc.GIFConvertArgs, defaultGIFConvertArgs)
+}
+
+func (mc *MessageConverter) voiceConvertArgs(ctx context.Context, codec VoiceCodec) ([]string, []string) {
+	if codec == VoiceCodecOpus {
+		return ffmpegArgs(ctx, "voice_to_ogg", mc.VoiceOpusConvertArgs, defaultVoiceOpusConvertArgs)
+	}
+	return ffmpegArgs(ctx, "voice_to_m4a", mc.VoiceConvertArgs, defaultVoiceConvertArgs)
 }
 
 func (mc *MessageConverter) IsPrivateChat(ctx context.Context) bool {
 	return mc.GetData(ctx).IsPrivateChat()
 }
+
+// UserJIDServer returns the WhatsApp server used in user JIDs for the current login.
+func (mc *MessageConverter) UserJIDServer(ctx context.Context) string {
+	portal := mc.GetData(ctx)
+	if portal.IsPrivateChat() && portal.WhatsAppServer != "" {
+		// DMs are addressed to the other user's JID, so the portal knows the right server
+		return portal.WhatsAppServer
+	} else if mc.BridgeMode.IsInstagram() {
+		return types.DefaultUserServer
+	}
+	return types.MessengerServer
+}
+
+// UserJID returns the WhatsApp JID of the given Meta user, preferring the server
+// the user was last seen on over the guess made by UserJIDServer.
+func (mc *MessageConverter) UserJID(ctx context.Context, userID int64) types.JID {
+	server := mc.GetUserWhatsAppServer(ctx, userID)
+	if server == "" {
+		server = mc.UserJIDServer(ctx)
+	}
+	return types.JID{User: strconv.FormatInt(userID, 10), Server: server}
+}
+
+// replyTargetID returns the Matrix event that a message should be sent as a reply to. Messages in threads
+// are sent as replies to the previous message in the thread (the reply fallback set by clients), or to the
+// thread root if there's no fallback. If ThreadsAsReplies is disabled, only explicit replies are used.
+func (mc *MessageConverter) replyTargetID(content *event.MessageEventContent) id.EventID {
+	if !mc.ThreadsAsReplies {
+		return content.RelatesTo.GetNonFallbackReplyTo()
+	} else if replyTo := content.RelatesTo.GetReplyTo(); replyTo != "" {
+		return replyTo
+	}
+	return content.RelatesTo.GetThreadParent()
+}
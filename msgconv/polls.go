@@ -0,0 +1,204 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/util/random"
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/gcmutil"
+	"go.mau.fi/whatsmeow/util/hkdfutil"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-meta/database"
+)
+
+var (
+	EventUnstablePollStart    = event.Type{Type: "org.matrix.msc3381.poll.start", Class: event.MessageEventType}
+	EventUnstablePollResponse = event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+)
+
+type PollText struct {
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type PollAnswer struct {
+	ID string `json:"id"`
+	PollText
+}
+
+type PollStartContent struct {
+	Question      PollText     `json:"question"`
+	Kind          string       `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Answers       []PollAnswer `json:"answers"`
+}
+
+type pollStartEventContent struct {
+	PollStart *PollStartContent `json:"org.matrix.msc3381.poll.start"`
+}
+
+type PollResponseContent struct {
+	Answers []string `json:"answers"`
+}
+
+type pollResponseEventContent struct {
+	RelatesTo    event.RelatesTo      `json:"m.relates_to"`
+	PollResponse *PollResponseContent `json:"org.matrix.msc3381.poll.response"`
+}
+
+// PollOptionHash returns the stable identifier that WhatsApp uses to refer to a poll option in votes.
+func PollOptionHash(optionName string) []byte {
+	hash := sha256.Sum256([]byte(optionName))
+	return hash[:]
+}
+
+func parsePollStart(evt *event.Event) (*PollStartContent, error) {
+	var parsed pollStartEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse poll start content: %w", err)
+	} else if parsed.PollStart == nil || len(parsed.PollStart.Answers) == 0 {
+		return nil, fmt.Errorf("poll start event doesn't contain any answers")
+	}
+	return parsed.PollStart, nil
+}
+
+// PollOptionHashes returns the option hashes of the answers in a Matrix poll start event, keyed by answer ID.
+// They're stored with the bridged poll, so that votes referring to answer IDs can be converted later.
+func PollOptionHashes(evt *event.Event) (map[string][]byte, error) {
+	pollStart, err := parsePollStart(evt)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string][]byte, len(pollStart.Answers))
+	for _, answer := range pollStart.Answers {
+		hashes[answer.ID] = PollOptionHash(answer.Text)
+	}
+	return hashes, nil
+}
+
+func (mc *MessageConverter) PollStartToWhatsApp(ctx context.Context, evt *event.Event) (*waConsumerApplication.ConsumerApplication_PollCreationMessage, error) {
+	if mc.IsPrivateChat(ctx) {
+		return nil, fmt.Errorf("%w %s in private chats", ErrUnsupportedMsgType, evt.Type.Type)
+	}
+	pollStart, err := parsePollStart(evt)
+	if err != nil {
+		return nil, err
+	}
+	options := make([]*waConsumerApplication.ConsumerApplication_Option, len(pollStart.Answers))
+	seenOptions := make(map[string]struct{}, len(options))
+	seenIDs := make(map[string]struct{}, len(options))
+	for i, answer := range pollStart.Answers {
+		if strings.TrimSpace(answer.Text) == "" {
+			return nil, fmt.Errorf("poll answer #%d is empty", i+1)
+		} else if _, seen := seenOptions[answer.Text]; seen {
+			return nil, fmt.Errorf("poll contains duplicate answer %q", answer.Text)
+		} else if _, seen = seenIDs[answer.ID]; seen {
+			return nil, fmt.Errorf("poll contains duplicate answer ID %q", answer.ID)
+		}
+		seenOptions[answer.Text] = struct{}{}
+		seenIDs[answer.ID] = struct{}{}
+		options[i] = &waConsumerApplication.ConsumerApplication_Option{OptionName: answer.Text}
+	}
+	maxSelections := pollStart.MaxSelections
+	if maxSelections < 1 {
+		maxSelections = 1
+	} else if maxSelections > len(options) {
+		maxSelections = len(options)
+	}
+	return &waConsumerApplication.ConsumerApplication_PollCreationMessage{
+		EncKey:                 random.Bytes(32),
+		Name:                   pollStart.Question.Text,
+		Options:                options,
+		SelectableOptionsCount: uint32(maxSelections),
+	}, nil
+}
+
+// PollResponseTarget returns the ID of the poll start event that a Matrix poll response refers to.
+func PollResponseTarget(evt *event.Event) (id.EventID, error) {
+	var parsed pollResponseEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &parsed)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse poll response content: %w", err)
+	} else if parsed.RelatesTo.Type != event.RelReference || parsed.RelatesTo.EventID == "" {
+		return "", fmt.Errorf("poll response doesn't reference a poll")
+	}
+	return parsed.RelatesTo.EventID, nil
+}
+
+const pollVoteSecretType = "Poll Vote"
+
+// PollResponseToWhatsApp converts a Matrix poll response into an encrypted WhatsApp vote for the given poll.
+// The vote is encrypted with a key derived from the poll's EncKey the same way whatsmeow does it,
+// so pollSender must be the JID of the user who created the poll and voter the JID of the user voting.
+func (mc *MessageConverter) PollResponseToWhatsApp(
+	ctx context.Context,
+	evt *event.Event,
+	poll *database.Poll,
+	pollKey *waCommon.MessageKey,
+	pollSender, voter types.JID,
+) (*waConsumerApplication.ConsumerApplication_PollUpdateMessage, error) {
+	var parsed pollResponseEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse poll response content: %w", err)
+	} else if parsed.PollResponse == nil {
+		return nil, fmt.Errorf("poll response event doesn't contain a response")
+	}
+	// An empty list of answers is valid and removes the user's vote
+	selected := make([][]byte, 0, len(parsed.PollResponse.Answers))
+	for _, answerID := range parsed.PollResponse.Answers {
+		hash, ok := poll.OptionHashes[answerID]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownPollAnswer, answerID)
+		}
+		selected = append(selected, hash)
+	}
+	plaintext, err := proto.Marshal(&waConsumerApplication.ConsumerApplication_PollVoteMessage{
+		SelectedOptions:   selected,
+		SenderTimestampMS: evt.Timestamp,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal poll vote: %w", err)
+	}
+	pollSenderStr := pollSender.ToNonAD().String()
+	voterStr := voter.ToNonAD().String()
+	secret := hkdfutil.SHA256(poll.EncKey, nil, []byte(pollKey.GetID()+pollSenderStr+voterStr+pollVoteSecretType), 32)
+	additionalData := []byte(fmt.Sprintf("%s\x00%s", pollKey.GetID(), voterStr))
+	iv := random.Bytes(12)
+	ciphertext, err := gcmutil.Encrypt(secret, iv, plaintext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt poll vote: %w", err)
+	}
+	return &waConsumerApplication.ConsumerApplication_PollUpdateMessage{
+		PollCreationMessageKey: pollKey,
+		Vote: &waConsumerApplication.ConsumerApplication_PollEncValue{
+			EncPayload: ciphertext,
+			EncIV:      iv,
+		},
+	}, nil
+}
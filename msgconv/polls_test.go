@@ -0,0 +1,136 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/util/gcmutil"
+	"go.mau.fi/whatsmeow/util/hkdfutil"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-meta/database"
+)
+
+func newPollStartEvent(answers string) *event.Event {
+	return &event.Event{
+		Type: EventUnstablePollStart,
+		Content: event.Content{VeryRaw: []byte(`{"org.matrix.msc3381.poll.start": {
+			"question": {"org.matrix.msc1767.text": "Lunch?"},
+			"max_selections": 1,
+			"answers": ` + answers + `
+		}}`)},
+	}
+}
+
+func TestPollStartToWhatsApp(t *testing.T) {
+	mc := &MessageConverter{PortalMethods: newTestPortal()}
+	ctx := context.Background()
+	poll, err := mc.PollStartToWhatsApp(ctx, newPollStartEvent(`[
+		{"id": "a", "org.matrix.msc1767.text": "Pizza"},
+		{"id": "b", "org.matrix.msc1767.text": "Sushi"}
+	]`))
+	if err != nil {
+		t.Fatalf("failed to convert poll: %v", err)
+	}
+	if poll.GetName() != "Lunch?" || len(poll.GetOptions()) != 2 || poll.GetOptions()[1].GetOptionName() != "Sushi" {
+		t.Errorf("unexpected poll %+v", poll)
+	}
+	if len(poll.GetEncKey()) != 32 {
+		t.Errorf("poll has %d byte enc key, want 32", len(poll.GetEncKey()))
+	}
+
+	for name, answers := range map[string]string{
+		"empty answer":        `[{"id": "a", "org.matrix.msc1767.text": "Pizza"}, {"id": "b", "org.matrix.msc1767.text": "  "}]`,
+		"duplicate answer":    `[{"id": "a", "org.matrix.msc1767.text": "Pizza"}, {"id": "b", "org.matrix.msc1767.text": "Pizza"}]`,
+		"duplicate answer ID": `[{"id": "a", "org.matrix.msc1767.text": "Pizza"}, {"id": "a", "org.matrix.msc1767.text": "Sushi"}]`,
+		"no answers":          `[]`,
+	} {
+		if _, err = mc.PollStartToWhatsApp(ctx, newPollStartEvent(answers)); err == nil {
+			t.Errorf("poll with %s was accepted", name)
+		}
+	}
+}
+
+func TestPollResponseToWhatsApp(t *testing.T) {
+	mc := &MessageConverter{PortalMethods: newTestPortal()}
+	ctx := context.Background()
+	optionHashes, err := PollOptionHashes(newPollStartEvent(`[
+		{"id": "a", "org.matrix.msc1767.text": "Pizza"},
+		{"id": "b", "org.matrix.msc1767.text": "Sushi"}
+	]`))
+	if err != nil {
+		t.Fatalf("failed to get option hashes: %v", err)
+	}
+	if !bytes.Equal(optionHashes["b"], PollOptionHash("Sushi")) {
+		t.Fatalf("answer b has hash %x, want hash of Sushi", optionHashes["b"])
+	}
+	poll := &database.Poll{MessageID: "poll-id", EncKey: bytes.Repeat([]byte{1}, 32), OptionHashes: optionHashes}
+	pollKey := &waCommon.MessageKey{ID: "poll-id"}
+	pollSender := types.JID{User: "1001", Server: types.MessengerServer}
+	voter := types.JID{User: "1002", Server: types.MessengerServer}
+	newResponse := func(answers string) *event.Event {
+		return &event.Event{
+			Type:      EventUnstablePollResponse,
+			Timestamp: 1700000000000,
+			Content: event.Content{VeryRaw: []byte(`{
+				"m.relates_to": {"rel_type": "m.reference", "event_id": "$poll"},
+				"org.matrix.msc3381.poll.response": {"answers": ` + answers + `}
+			}`)},
+		}
+	}
+
+	evt := newResponse(`["b"]`)
+	if target, err := PollResponseTarget(evt); err != nil || target != "$poll" {
+		t.Errorf("PollResponseTarget() = %q, %v, want $poll", target, err)
+	}
+	update, err := mc.PollResponseToWhatsApp(ctx, evt, poll, pollKey, pollSender, voter)
+	if err != nil {
+		t.Fatalf("failed to convert poll response: %v", err)
+	}
+	if update.GetPollCreationMessageKey() != pollKey {
+		t.Error("vote doesn't refer to the poll message key")
+	}
+	secret := hkdfutil.SHA256(poll.EncKey, nil, []byte("poll-id"+pollSender.String()+voter.String()+"Poll Vote"), 32)
+	plaintext, err := gcmutil.Decrypt(secret, update.GetVote().GetEncIV(), update.GetVote().GetEncPayload(), []byte(fmt.Sprintf("poll-id\x00%s", voter)))
+	if err != nil {
+		t.Fatalf("failed to decrypt vote: %v", err)
+	}
+	var vote waConsumerApplication.ConsumerApplication_PollVoteMessage
+	if err = proto.Unmarshal(plaintext, &vote); err != nil {
+		t.Fatalf("failed to unmarshal vote: %v", err)
+	}
+	if len(vote.GetSelectedOptions()) != 1 || !bytes.Equal(vote.GetSelectedOptions()[0], PollOptionHash("Sushi")) {
+		t.Errorf("vote selected %x, want the hash of Sushi", vote.GetSelectedOptions())
+	}
+	if vote.GetSenderTimestampMS() != evt.Timestamp {
+		t.Errorf("vote timestamp = %d, want %d", vote.GetSenderTimestampMS(), evt.Timestamp)
+	}
+
+	_, err = mc.PollResponseToWhatsApp(ctx, newResponse(`["c"]`), poll, pollKey, pollSender, voter)
+	if !errors.Is(err, ErrUnknownPollAnswer) {
+		t.Errorf("vote for unknown answer returned %v, want ErrUnknownPollAnswer", err)
+	}
+}
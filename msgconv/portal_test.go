@@ -0,0 +1,142 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-meta/database"
+	"go.mau.fi/mautrix-meta/messagix"
+	"go.mau.fi/mautrix-meta/messagix/socket"
+	"go.mau.fi/mautrix-meta/messagix/table"
+)
+
+// testPortal is an in-memory implementation of PortalMethods for tests.
+type testPortal struct {
+	data     *database.Portal
+	media    map[id.ContentURIString][]byte
+	metaIDs  map[id.UserID]int64
+	messages map[id.EventID]*database.Message
+}
+
+var _ PortalMethods = (*testPortal)(nil)
+
+func newTestPortal() *testPortal {
+	return &testPortal{
+		data: &database.Portal{
+			PortalKey:  database.PortalKey{ThreadID: 100, Receiver: 1},
+			ThreadType: table.ENCRYPTED_OVER_WA_GROUP,
+		},
+		media:    make(map[id.ContentURIString][]byte),
+		metaIDs:  make(map[id.UserID]int64),
+		messages: make(map[id.EventID]*database.Message),
+	}
+}
+
+func (tp *testPortal) DownloadMatrixMedia(_ context.Context, uri id.ContentURIString) ([]byte, error) {
+	data, ok := tp.media[uri]
+	if !ok {
+		return nil, fmt.Errorf("media %s not found", uri)
+	}
+	return data, nil
+}
+
+func (tp *testPortal) UploadMatrixMedia(_ context.Context, data []byte, _, _ string) (id.ContentURIString, error) {
+	uri := id.ContentURIString(fmt.Sprintf("mxc://test/%d", len(tp.media)))
+	tp.media[uri] = data
+	return uri, nil
+}
+
+func (tp *testPortal) GetMatrixReply(context.Context, string, int64) (id.EventID, id.UserID) {
+	return "", ""
+}
+
+func (tp *testPortal) GetMetaReply(context.Context, id.EventID) *socket.ReplyMetaData {
+	return nil
+}
+
+func (tp *testPortal) GetReplyTargetContent(context.Context, id.EventID) *event.MessageEventContent {
+	return nil
+}
+
+func (tp *testPortal) GetMessageByMXID(_ context.Context, eventID id.EventID) *database.Message {
+	return tp.messages[eventID]
+}
+
+func (tp *testPortal) GetMessagesBetween(_ context.Context, min, max time.Time) []*database.Message {
+	var messages []*database.Message
+	for _, msg := range tp.messages {
+		if msg.PartIndex == 0 && msg.Timestamp.After(min) && !msg.Timestamp.After(max) {
+			messages = append(messages, msg)
+		}
+	}
+	slices.SortFunc(messages, func(a, b *database.Message) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	return messages
+}
+
+func (tp *testPortal) GetUserMXID(_ context.Context, userID int64) id.UserID {
+	return id.NewUserID(fmt.Sprintf("meta_%d", userID), "example.com")
+}
+
+func (tp *testPortal) GetUserMetaID(_ context.Context, userID id.UserID) int64 {
+	return tp.metaIDs[userID]
+}
+
+func (tp *testPortal) GetUserWhatsAppServer(context.Context, int64) string {
+	return ""
+}
+
+func (tp *testPortal) GetUserUsername(context.Context, int64) string {
+	return ""
+}
+
+func (tp *testPortal) GetMatrixDisplayname(_ context.Context, userID id.UserID) string {
+	return userID.Localpart()
+}
+
+func (tp *testPortal) CanMentionRoom(context.Context, id.UserID) bool {
+	return true
+}
+
+func (tp *testPortal) ShouldFetchXMA(context.Context) bool {
+	return false
+}
+
+func (tp *testPortal) GetThreadURL(context.Context) (string, string) {
+	return "", ""
+}
+
+func (tp *testPortal) GetClient(context.Context) *messagix.Client {
+	return nil
+}
+
+func (tp *testPortal) GetE2EEClient(context.Context) *whatsmeow.Client {
+	return nil
+}
+
+func (tp *testPortal) GetData(context.Context) *database.Portal {
+	return tp.data
+}
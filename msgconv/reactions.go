@@ -0,0 +1,102 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/variationselector"
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+// reactionShortcodeField is the MSC4027 field that contains the shortcode of a custom emoji reaction.
+const reactionShortcodeField = "com.beeper.reaction.shortcode"
+
+// ReactionToMeta converts the key of a Matrix reaction into the emoji used by Meta.
+//
+// Meta doesn't support custom emojis, so reactions with an mxc:// key are sent as their shortcode
+// if the event has one, and rejected with ErrUnsupportedReaction otherwise. Malformed emoji sequences
+// are normalized with normalizeReactionEmoji.
+func ReactionToMeta(ctx context.Context, evt *event.Event) (string, error) {
+	key := evt.Content.AsReaction().RelatesTo.Key
+	if strings.HasPrefix(key, "mxc://") {
+		shortcode, _ := evt.Content.Raw[reactionShortcodeField].(string)
+		shortcode = strings.Trim(shortcode, ":")
+		if shortcode == "" {
+			return "", fmt.Errorf("%w: custom emoji reactions without a shortcode can't be bridged", ErrUnsupportedReaction)
+		}
+		return ":" + shortcode + ":", nil
+	} else if key == "" {
+		return "", fmt.Errorf("%w: reaction doesn't have a key", ErrUnsupportedReaction)
+	}
+	emoji := variationselector.Remove(key)
+	normalized := normalizeReactionEmoji(emoji)
+	if normalized == "" {
+		return "", fmt.Errorf("%w: reaction key %q isn't a valid emoji", ErrUnsupportedReaction, key)
+	} else if normalized != emoji {
+		zerolog.Ctx(ctx).Debug().
+			Str("original_emoji", emoji).
+			Str("normalized_emoji", normalized).
+			Msg("Normalized malformed emoji sequence in reaction")
+	}
+	return normalized, nil
+}
+
+const zeroWidthJoiner = '\u200d'
+
+func isSkinToneModifier(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+// normalizeReactionEmoji removes skin tone modifiers and zero-width joiners that aren't attached to an
+// emoji, which Meta rejects. Well-formed sequences, including skin tones (👍🏽) and ZWJ sequences (👩🏽‍💻),
+// are returned unchanged. A lone skin tone modifier is kept, as it's a valid emoji by itself.
+func normalizeReactionEmoji(emoji string) string {
+	runes := []rune(emoji)
+	normalized := make([]rune, 0, len(runes))
+	for _, r := range runes {
+		var prev rune
+		if len(normalized) > 0 {
+			prev = normalized[len(normalized)-1]
+		}
+		if r == zeroWidthJoiner && (prev == 0 || prev == zeroWidthJoiner) {
+			continue
+		} else if isSkinToneModifier(r) && (prev == zeroWidthJoiner || isSkinToneModifier(prev)) {
+			continue
+		}
+		normalized = append(normalized, r)
+	}
+	for len(normalized) > 0 && normalized[len(normalized)-1] == zeroWidthJoiner {
+		normalized = normalized[:len(normalized)-1]
+	}
+	return string(normalized)
+}
+
+// ReactionToWhatsApp builds the reaction message for the given target message key.
+// An empty emoji removes the sender's existing reaction to the message.
+func (mc *MessageConverter) ReactionToWhatsApp(targetKey *waCommon.MessageKey, emoji string, timestamp int64) *waConsumerApplication.ConsumerApplication_ReactionMessage {
+	return &waConsumerApplication.ConsumerApplication_ReactionMessage{
+		Key:               targetKey,
+		Text:              emoji,
+		SenderTimestampMS: timestamp,
+	}
+}
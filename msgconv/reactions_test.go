@@ -0,0 +1,80 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func newReactionEvent(key string, raw map[string]any) *event.Event {
+	return &event.Event{
+		Type: event.EventReaction,
+		Content: event.Content{
+			Parsed: &event.ReactionEventContent{RelatesTo: event.RelatesTo{Type: event.RelAnnotation, Key: key}},
+			Raw:    raw,
+		},
+	}
+}
+
+func TestReactionToMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		raw  map[string]any
+		want string
+	}{
+		{"plain emoji", "👍", nil, "👍"},
+		{"variation selector", "❤️", nil, "❤"},
+		{"skin tone", "👍🏽", nil, "👍🏽"},
+		{"zwj sequence", "👩🏽‍💻", nil, "👩🏽‍💻"},
+		{"family zwj sequence", "👨‍👩‍👧", nil, "👨‍👩‍👧"},
+		{"lone skin tone", "🏽", nil, "🏽"},
+		{"double skin tone", "👍🏽🏿", nil, "👍🏽"},
+		{"leading zwj", "\u200d👍", nil, "👍"},
+		{"trailing zwj", "👍\u200d", nil, "👍"},
+		{"doubled zwj", "👩\u200d\u200d💻", nil, "👩\u200d💻"},
+		{"skin tone after zwj", "👩\u200d🏽💻", nil, "👩\u200d💻"},
+		{"custom emoji shortcode", "mxc://example.com/abc", map[string]any{reactionShortcodeField: ":party:"}, ":party:"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ReactionToMeta(context.Background(), newReactionEvent(test.key, test.raw))
+			if err != nil {
+				t.Fatalf("failed to convert reaction: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %q (%+q), want %q (%+q)", got, got, test.want, test.want)
+			}
+		})
+	}
+}
+
+func TestReactionToMetaUnsupported(t *testing.T) {
+	for name, key := range map[string]string{
+		"empty key":                      "",
+		"only zwj":                       "\u200d\u200d",
+		"custom emoji without shortcode": "mxc://example.com/abc",
+	} {
+		if _, err := ReactionToMeta(context.Background(), newReactionEvent(key, nil)); !errors.Is(err, ErrUnsupportedReaction) {
+			t.Errorf("%s: got error %v, want ErrUnsupportedReaction", name, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/id"
+)
+
+// WhatsAppReadReceipt contains the parameters for marking messages as read with whatsmeow's MarkRead.
+type WhatsAppReadReceipt struct {
+	IDs       []types.MessageID
+	Timestamp time.Time
+	Chat      types.JID
+	// Sender is the sender of the messages. It's empty in private chats, where the participant isn't needed.
+	Sender types.JID
+}
+
+// MarkReadToWhatsApp converts a Matrix read receipt into the requests for marking messages as read on WhatsApp,
+// grouped by the sender of the messages. All messages after lastRead up to the receipt target are included.
+// For implicit receipts (e.g. when the user sends a message), eventID is empty and receiptTimestamp is used
+// as the end of the range instead. If lastRead is zero, only messages from the past two seconds before the
+// end are included.
+//
+// The returned timestamp is that of the newest message included, which should be stored as the new lastRead.
+// It's zero if there were no messages in the range. Messages sent by the user themselves and unencrypted
+// messages are skipped, as they don't need receipts. ErrReceiptTargetNotBridged is returned if the target
+// event doesn't correspond to any Meta message (e.g. because it was sent by a Matrix user who isn't bridged).
+func (mc *MessageConverter) MarkReadToWhatsApp(
+	ctx context.Context,
+	sender int64,
+	eventID id.EventID,
+	lastRead, receiptTimestamp time.Time,
+) ([]*WhatsAppReadReceipt, time.Time, error) {
+	readUpTo := receiptTimestamp
+	if eventID != "" {
+		target := mc.GetMessageByMXID(ctx, eventID)
+		if target == nil {
+			return nil, time.Time{}, fmt.Errorf("%w: %s", ErrReceiptTargetNotBridged, eventID)
+		}
+		readUpTo = target.Timestamp
+	}
+	if lastRead.IsZero() {
+		lastRead = readUpTo.Add(-2 * time.Second)
+	}
+	messages := mc.GetMessagesBetween(ctx, lastRead, readUpTo)
+	if len(messages) == 0 {
+		return nil, time.Time{}, nil
+	}
+	chat := mc.GetData(ctx).JID()
+	isPrivateChat := mc.IsPrivateChat(ctx)
+	var receipts []*WhatsAppReadReceipt
+	bySender := make(map[int64]*WhatsAppReadReceipt)
+	for _, msg := range messages {
+		if msg.Sender == sender || msg.IsUnencrypted() {
+			continue
+		}
+		receipt, ok := bySender[msg.Sender]
+		if !ok {
+			receipt = &WhatsAppReadReceipt{
+				Timestamp: receiptTimestamp,
+				Chat:      chat,
+			}
+			if !isPrivateChat {
+				receipt.Sender = mc.UserJID(ctx, msg.Sender)
+			}
+			bySender[msg.Sender] = receipt
+			receipts = append(receipts, receipt)
+		}
+		receipt.IDs = append(receipt.IDs, msg.ID)
+	}
+	return receipts, messages[len(messages)-1].Timestamp, nil
+}
@@ -0,0 +1,93 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-meta/database"
+)
+
+func TestMarkReadToWhatsApp(t *testing.T) {
+	ctx := context.Background()
+	portal := newTestPortal()
+	mc := &MessageConverter{PortalMethods: portal}
+	const ownID, aliceID, bobID = 1, 1001, 1002
+	base := time.UnixMilli(1700000000000)
+	addMessage := func(evtID id.EventID, msgID string, sender int64, offset time.Duration) {
+		portal.messages[evtID] = &database.Message{ID: msgID, Sender: sender, MXID: evtID, Timestamp: base.Add(offset)}
+	}
+	addMessage("$old", "old", aliceID, 0)
+	addMessage("$alice1", "alice1", aliceID, 10*time.Second)
+	addMessage("$own", "own", ownID, 11*time.Second)
+	addMessage("$bob", "bob", bobID, 12*time.Second)
+	addMessage("$unencrypted", "mid.$unencrypted", bobID, 13*time.Second)
+	addMessage("$alice2", "alice2", aliceID, 14*time.Second)
+	addMessage("$later", "later", aliceID, 20*time.Second)
+	receiptTS := base.Add(30 * time.Second)
+
+	receipts, readUpTo, err := mc.MarkReadToWhatsApp(ctx, ownID, "$alice2", base.Add(5*time.Second), receiptTS)
+	if err != nil {
+		t.Fatalf("failed to convert read receipt: %v", err)
+	}
+	if !readUpTo.Equal(base.Add(14 * time.Second)) {
+		t.Errorf("read up to %s, want the timestamp of the target", readUpTo)
+	}
+	got := make(map[types.JID][]types.MessageID)
+	for _, receipt := range receipts {
+		if receipt.Chat != portal.data.JID() || !receipt.Timestamp.Equal(receiptTS) {
+			t.Errorf("unexpected receipt chat %s or timestamp %s", receipt.Chat, receipt.Timestamp)
+		}
+		got[receipt.Sender] = receipt.IDs
+	}
+	alice, bob := mc.UserJID(ctx, aliceID), mc.UserJID(ctx, bobID)
+	if len(got) != 2 || !slices.Equal(got[alice], []types.MessageID{"alice1", "alice2"}) || !slices.Equal(got[bob], []types.MessageID{"bob"}) {
+		t.Errorf("unexpected receipts %v", got)
+	}
+
+	// Without a previous read marker, only the messages right before the target are included
+	receipts, _, err = mc.MarkReadToWhatsApp(ctx, ownID, "$alice2", time.Time{}, receiptTS)
+	if err != nil || len(receipts) != 1 || !slices.Equal(receipts[0].IDs, []types.MessageID{"alice2"}) {
+		t.Errorf("unexpected receipts without previous read marker: %v, %v", receipts, err)
+	}
+
+	// Implicit receipts read everything up to the receipt time
+	receipts, readUpTo, err = mc.MarkReadToWhatsApp(ctx, ownID, "", base.Add(15*time.Second), receiptTS)
+	if err != nil || len(receipts) != 1 || !slices.Equal(receipts[0].IDs, []types.MessageID{"later"}) {
+		t.Errorf("unexpected implicit receipts: %v, %v", receipts, err)
+	} else if !readUpTo.Equal(base.Add(20 * time.Second)) {
+		t.Errorf("implicit receipt read up to %s, want the timestamp of the last message", readUpTo)
+	}
+
+	// Receipts for own messages don't produce any requests, but still move the read marker
+	receipts, readUpTo, err = mc.MarkReadToWhatsApp(ctx, ownID, "$own", base.Add(10*time.Second), receiptTS)
+	if err != nil || len(receipts) != 0 || !readUpTo.Equal(base.Add(11*time.Second)) {
+		t.Errorf("unexpected receipts for own message: %v, %s, %v", receipts, readUpTo, err)
+	}
+
+	_, _, err = mc.MarkReadToWhatsApp(ctx, ownID, "$notbridged", time.Time{}, receiptTS)
+	if !errors.Is(err, ErrReceiptTargetNotBridged) {
+		t.Errorf("receipt for unbridged event returned %v, want ErrReceiptTargetNotBridged", err)
+	}
+}
@@ -0,0 +1,41 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// ScheduledSendTimeField is the custom field in the content of Matrix message events that contains
+// the unix timestamp in milliseconds at which the message should be sent.
+const ScheduledSendTimeField = "fi.mau.meta.scheduled_ts"
+
+// ScheduledSendTime returns the time at which the given event should be sent, or a zero time
+// if it should be sent immediately.
+//
+// Neither Messenger nor WhatsApp have a known way to schedule messages on the server side,
+// so the caller is responsible for holding the event until the returned time before converting it.
+func ScheduledSendTime(evt *event.Event) time.Time {
+	// Numbers in the raw content are always parsed as float64
+	ts, _ := evt.Content.Raw[ScheduledSendTimeField].(float64)
+	if ts <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(int64(ts))
+}
@@ -0,0 +1,185 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ffmpeg"
+	"golang.org/x/image/webp"
+)
+
+func isLottieMimetype(mimeType string) bool {
+	switch mimeType {
+	case "application/json", "application/x-tgsticker", "video/lottie+json", "application/lottie+zip":
+		return true
+	default:
+		return false
+	}
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isLottie checks whether a sticker is a Lottie animation, based on either the declared mimetype or the data.
+// Telegram-style .tgs stickers are gzipped Lottie JSON, so any gzipped sticker is assumed to be one.
+func isLottie(data []byte, mimeType string) bool {
+	if isLottieMimetype(mimeType) || bytes.HasPrefix(data, gzipMagic) {
+		return true
+	}
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(trimmed, []byte(`"layers"`))
+}
+
+// isAnimatedWebP checks whether a WebP file has the animation flag set in its VP8X header.
+func isAnimatedWebP(data []byte) bool {
+	if len(data) < 21 || !bytes.Equal(data[0:4], []byte("RIFF")) || !bytes.Equal(data[8:12], []byte("WEBP")) {
+		return false
+	}
+	return bytes.Equal(data[12:16], []byte("VP8X")) && data[20]&0x02 != 0
+}
+
+// isAnimatedPNG checks whether a PNG file contains an acTL chunk before the image data, which marks it as an APNG.
+func isAnimatedPNG(data []byte) bool {
+	if len(data) < 8 || !bytes.Equal(data[0:8], []byte("\x89PNG\r\n\x1a\n")) {
+		return false
+	}
+	for offset := 8; offset+8 <= len(data); {
+		chunkLength := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		switch string(data[offset+4 : offset+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		offset += chunkLength + 12
+	}
+	return false
+}
+
+func isAnimatedGIF(data []byte) bool {
+	parsed, err := gif.DecodeAll(bytes.NewReader(data))
+	return err == nil && len(parsed.Image) > 1
+}
+
+// convertSticker prepares a Matrix sticker for sending to Meta. Animated WebP stickers are sent as-is,
+// while other animated formats are converted to animated WebP. If the conversion fails, the first
+// frame is sent as a static sticker instead. Lottie stickers are rejected with ErrUnsupportedSticker,
+// as ffmpeg can't render them.
+func convertSticker(ctx context.Context, data []byte, mimeType string) ([]byte, string, bool, error) {
+	if isLottie(data, mimeType) {
+		return nil, "", false, fmt.Errorf("%w: lottie stickers can't be converted to webp", ErrUnsupportedSticker)
+	}
+	var needsConversion bool
+	switch mimeType {
+	case "image/webp":
+		return data, mimeType, isAnimatedWebP(data), nil
+	case "image/png":
+		needsConversion = isAnimatedPNG(data)
+	case "image/gif":
+		needsConversion = isAnimatedGIF(data)
+	}
+	if !needsConversion {
+		return data, mimeType, false, nil
+	}
+	converted, err := ffmpeg.ConvertBytes(ctx, data, ".webp", []string{}, []string{"-c:v", "libwebp", "-loop", "0", "-an"}, mimeType)
+	if err == nil {
+		return converted, "image/webp", true, nil
+	}
+	zerolog.Ctx(ctx).Warn().Err(err).Str("mime_type", mimeType).Msg("Failed to convert animated sticker, falling back to first frame")
+	converted, err = ffmpeg.ConvertBytes(ctx, data, ".webp", []string{}, []string{"-frames:v", "1", "-c:v", "libwebp"}, mimeType)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("%w sticker to webp: %w", ErrMediaConvertFailed, err)
+	}
+	return converted, "image/webp", false, nil
+}
+
+const (
+	maxStickerDimension    = 512
+	maxStaticStickerSize   = 100 * 1024
+	maxAnimatedStickerSize = 500 * 1024
+)
+
+var stickerQualitySteps = []int{80, 50, 20}
+
+// stickerDimensions reads the dimensions of a sticker from its header, scaled down to fit in 512x512 like
+// clients display them. If the header can't be decoded, the maximum size is returned, as stickers are
+// always scaled to fit it anyway.
+func stickerDimensions(data []byte) (int, int) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		cfg, err = webp.DecodeConfig(bytes.NewReader(data))
+	}
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return maxStickerDimension, maxStickerDimension
+	}
+	width, height := cfg.Width, cfg.Height
+	if width > maxStickerDimension {
+		height = max(height*maxStickerDimension/width, 1)
+		width = maxStickerDimension
+	}
+	if height > maxStickerDimension {
+		width = max(width*maxStickerDimension/height, 1)
+		height = maxStickerDimension
+	}
+	return width, height
+}
+
+// fitStickerLimits re-encodes stickers that are larger than what Meta clients accept into WebP, scaling them
+// down to fit in 512x512 and lowering the quality until the file is small enough. Transparency and animation
+// are preserved. Stickers that are already within the limits are returned as-is.
+func fitStickerLimits(ctx context.Context, data []byte, mimeType string, isAnimated bool) ([]byte, string, error) {
+	maxSize := maxStaticStickerSize
+	if isAnimated {
+		maxSize = maxAnimatedStickerSize
+	}
+	width, height, err := probeDimensions(ctx, data, mimeType)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to probe sticker dimensions")
+	} else if len(data) <= maxSize && width <= maxStickerDimension && height <= maxStickerDimension {
+		return data, mimeType, nil
+	}
+	zerolog.Ctx(ctx).Debug().
+		Int("width", width).
+		Int("height", height).
+		Int("size", len(data)).
+		Msg("Re-encoding sticker to fit size limits")
+	for _, quality := range stickerQualitySteps {
+		outputArgs := []string{
+			"-vf", fmt.Sprintf("scale='min(%[1]d,iw)':'min(%[1]d,ih)':force_original_aspect_ratio=decrease", maxStickerDimension),
+			"-c:v", "libwebp", "-pix_fmt", "yuva420p", "-quality", strconv.Itoa(quality), "-an",
+		}
+		if isAnimated {
+			outputArgs = append(outputArgs, "-loop", "0")
+		} else {
+			outputArgs = append(outputArgs, "-frames:v", "1")
+		}
+		converted, err := ffmpeg.ConvertBytes(ctx, data, ".webp", []string{}, outputArgs, mimeType)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w sticker to fit size limits: %w", ErrMediaConvertFailed, err)
+		} else if len(converted) <= maxSize {
+			return converted, "image/webp", nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: sticker is still over %d KiB after re-encoding", ErrMediaTooLarge, maxSize/1024)
+}
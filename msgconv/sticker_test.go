@@ -0,0 +1,99 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestStickerDimensions(t *testing.T) {
+	// Minimal animated WebP header: RIFF container with a VP8X chunk declaring a 300x200 canvas
+	animatedWebP := []byte("RIFF\x16\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\x2b\x01\x00\xc7\x00\x00")
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+	}{
+		{"Small PNG", encodeTestPNG(t, 128, 64), 128, 64},
+		{"Exact max size PNG", encodeTestPNG(t, 512, 512), 512, 512},
+		{"Wide PNG is scaled down", encodeTestPNG(t, 1024, 256), 512, 128},
+		{"Tall PNG is scaled down", encodeTestPNG(t, 100, 1000), 51, 512},
+		{"Animated WebP header", animatedWebP, 300, 200},
+		{"Undecodable data", []byte("not an image"), 512, 512},
+		{"Empty data", nil, 512, 512},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height := stickerDimensions(test.data)
+			if width != test.width || height != test.height {
+				t.Errorf("stickerDimensions() = %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestConvertStickerRejectsLottie(t *testing.T) {
+	lottieJSON := []byte(`{"v":"5.5.2","fr":60,"ip":0,"op":180,"w":512,"h":512,"layers":[]}`)
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+	}{
+		{"Lottie mimetype", lottieJSON, "video/lottie+json"},
+		{"Telegram sticker mimetype", []byte{0x1f, 0x8b, 0x08, 0x00}, "application/x-tgsticker"},
+		{"Gzipped data without mimetype", []byte{0x1f, 0x8b, 0x08, 0x00}, "application/octet-stream"},
+		{"JSON sniffed as text", append([]byte("\n  "), lottieJSON...), "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, err := convertSticker(context.Background(), test.data, test.mimeType)
+			if !errors.Is(err, ErrUnsupportedSticker) {
+				t.Errorf("convertSticker() error = %v, want ErrUnsupportedSticker", err)
+			} else if errors.Is(err, ErrMediaConvertFailed) {
+				t.Errorf("convertSticker() error = %v, shouldn't be a conversion failure", err)
+			}
+		})
+	}
+}
+
+func TestConvertStickerPassesThroughStatic(t *testing.T) {
+	data := encodeTestPNG(t, 64, 64)
+	converted, mimeType, isAnimated, err := convertSticker(context.Background(), data, "image/png")
+	if err != nil {
+		t.Fatalf("convertSticker() error = %v", err)
+	} else if !bytes.Equal(converted, data) || mimeType != "image/png" || isAnimated {
+		t.Errorf("convertSticker() = (%d bytes, %q, %v), want original PNG", len(converted), mimeType, isAnimated)
+	}
+	if isLottie(data, "image/png") {
+		t.Error("isLottie() = true for a PNG")
+	}
+}
@@ -0,0 +1,47 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/util/ffmpeg"
+)
+
+// maxSVGDimension is the maximum width of rasterized SVGs. Smaller SVGs are rasterized at their intrinsic size.
+const maxSVGDimension = 2048
+
+// isSVG checks whether a file is an SVG image. Sniffing detects SVGs as generic XML,
+// so the file extension is also checked in case the client didn't declare a mimetype.
+func isSVG(mimeType, fileName string) bool {
+	return mimeType == "image/svg+xml" || strings.EqualFold(filepath.Ext(fileName), ".svg")
+}
+
+// rasterizeSVG converts an SVG image into a PNG, as Meta clients can't display SVGs.
+// This requires ffmpeg to be built with librsvg.
+func (mc *MessageConverter) rasterizeSVG(ctx context.Context, data []byte) ([]byte, error) {
+	if !mc.FFmpegAvailable {
+		return nil, fmt.Errorf("ffmpeg isn't available")
+	}
+	return ffmpeg.ConvertBytes(ctx, data, ".png", []string{"-f", "svg_pipe"}, []string{
+		"-frames:v", "1",
+		"-filter:v", fmt.Sprintf("scale='min(iw,%d)':-1", maxSVGDimension),
+	}, "image/svg+xml")
+}
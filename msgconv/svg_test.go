@@ -0,0 +1,101 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"os/exec"
+	"testing"
+
+	"go.mau.fi/util/ffmpeg"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+var testSVG = []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="120" height="80"><rect width="120" height="80" fill="red"/></svg>`)
+
+func TestIsSVG(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		fileName string
+		want     bool
+	}{
+		{mimeType: "image/svg+xml", fileName: "image", want: true},
+		{mimeType: "text/xml; charset=utf-8", fileName: "logo.SVG", want: true},
+		{mimeType: "text/xml; charset=utf-8", fileName: "feed.xml"},
+		{mimeType: "image/png", fileName: "logo.png"},
+	}
+	for _, test := range tests {
+		if got := isSVG(test.mimeType, test.fileName); got != test.want {
+			t.Errorf("isSVG(%q, %q) = %t, want %t", test.mimeType, test.fileName, got, test.want)
+		}
+	}
+}
+
+func TestRasterizeSVG(t *testing.T) {
+	if !ffmpeg.Supported() {
+		t.Skip("ffmpeg isn't installed")
+	} else if decoders, _ := exec.Command("ffmpeg", "-hide_banner", "-decoders").Output(); !bytes.Contains(decoders, []byte("librsvg")) {
+		t.Skip("ffmpeg wasn't built with librsvg")
+	}
+	mc := &MessageConverter{FFmpegAvailable: true}
+	data, err := mc.rasterizeSVG(context.Background(), testSVG)
+	if err != nil {
+		t.Fatalf("failed to rasterize SVG: %v", err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("rasterized SVG isn't a PNG: %v", err)
+	}
+	if cfg.Width != 120 || cfg.Height != 80 {
+		t.Errorf("rasterized SVG is %dx%d, want the intrinsic size 120x80", cfg.Width, cfg.Height)
+	}
+}
+
+func TestSVGFallsBackToFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		disable  bool
+	}{
+		{name: "ffmpeg unavailable", mimeType: "image/svg+xml"},
+		{name: "Detected by extension"},
+		{name: "Transcoding disabled", mimeType: "image/svg+xml", disable: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			portal := newTestPortal()
+			portal.data.DisableTranscoding = test.disable
+			// With transcoding disabled, the SVG must not be rasterized even if ffmpeg is available
+			mc := &MessageConverter{PortalMethods: portal, FFmpegAvailable: test.disable}
+			content := &event.MessageEventContent{MsgType: event.MsgImage, Body: "logo.svg", Info: &event.FileInfo{MimeType: test.mimeType}}
+			output := convertTestMessage(t, mc, content, testSVG)
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_DocumentMessage)
+			if !ok {
+				t.Fatalf("expected a document message, got %T", output)
+			}
+			if name := msg.DocumentMessage.GetFileName(); name != "logo.svg" {
+				t.Errorf("file name = %q, want logo.svg", name)
+			}
+			if mimeType := testMediaMimetype(t, output); mimeType != "image/svg+xml" {
+				t.Errorf("mimetype = %q, want image/svg+xml", mimeType)
+			}
+		})
+	}
+}
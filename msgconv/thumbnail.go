@@ -0,0 +1,146 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ffmpeg"
+	"golang.org/x/image/draw"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	maxThumbnailBytes       = 32 * 1024
+	thumbnailDefaultQuality = 80
+	thumbnailMinQuality     = 30
+)
+
+const blurhashAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// validateBlurhash checks that the given string only contains base83 characters and that
+// its length matches the number of components declared in the first character.
+func validateBlurhash(hash string) error {
+	if len(hash) < 6 {
+		return fmt.Errorf("blurhash is too short")
+	}
+	for i := 0; i < len(hash); i++ {
+		if strings.IndexByte(blurhashAlphabet, hash[i]) < 0 {
+			return fmt.Errorf("blurhash contains invalid character %q", hash[i])
+		}
+	}
+	sizeFlag := strings.IndexByte(blurhashAlphabet, hash[0])
+	componentsX, componentsY := sizeFlag%9+1, sizeFlag/9+1
+	if expectedLength := 4 + 2*componentsX*componentsY; len(hash) != expectedLength {
+		return fmt.Errorf("blurhash with %dx%d components should be %d characters, got %d", componentsX, componentsY, expectedLength, len(hash))
+	}
+	return nil
+}
+
+// logUnusedBlurhash logs the blurhash of a Matrix media event if it has one. WhatsApp media doesn't have
+// a field for blurred placeholders (the small JPEG thumbnail serves that purpose), so it can't be bridged.
+func logUnusedBlurhash(ctx context.Context, info *event.FileInfo) {
+	blurhash := info.Blurhash
+	if blurhash == "" {
+		blurhash = info.AnoaBlurhash
+	}
+	if blurhash == "" {
+		return
+	}
+	err := validateBlurhash(blurhash)
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Str("blurhash", blurhash).Msg("Matrix media has an invalid blurhash")
+	} else {
+		zerolog.Ctx(ctx).Debug().Str("blurhash", blurhash).Msg("Not bridging blurhash of Matrix media, WhatsApp doesn't support them")
+	}
+}
+
+// extractVideoFrame grabs a single frame from a video as a JPEG. The frame is taken
+// about a second in to avoid black intro frames, with a fallback to the first frame
+// for videos that are shorter than that.
+func extractVideoFrame(ctx context.Context, data []byte, mimeType string) ([]byte, error) {
+	frame, err := ffmpeg.ConvertBytes(ctx, data, ".jpg", []string{"-ss", "1"}, []string{"-frames:v", "1"}, mimeType)
+	if err == nil && len(frame) > 0 {
+		return frame, nil
+	}
+	return ffmpeg.ConvertBytes(ctx, data, ".jpg", []string{}, []string{"-frames:v", "1"}, mimeType)
+}
+
+// thumbnailQuality returns the configured JPEG quality for thumbnails, clamped to the valid range of 1-100.
+func (mc *MessageConverter) thumbnailQuality() int {
+	switch {
+	case mc.ThumbnailQuality == 0:
+		return thumbnailDefaultQuality
+	case mc.ThumbnailQuality < 1:
+		return 1
+	case mc.ThumbnailQuality > 100:
+		return 100
+	default:
+		return mc.ThumbnailQuality
+	}
+}
+
+// encodeThumbnail encodes the thumbnail as a JPEG, lowering the quality if it's too big.
+// Other formats like WebP can't be used, as the media transport only has a field for JPEG thumbnails.
+func encodeThumbnail(img image.Image, initialQuality int) ([]byte, error) {
+	var buf bytes.Buffer
+	for quality := initialQuality; ; quality -= 10 {
+		buf.Reset()
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		if err != nil {
+			return nil, err
+		} else if buf.Len() <= maxThumbnailBytes || quality <= thumbnailMinQuality {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// createThumbnail generates a small JPEG preview of the given image or video.
+// It returns the thumbnail data along with its dimensions.
+func (mc *MessageConverter) createThumbnail(ctx context.Context, data []byte, mimeType string, isVideo bool) ([]byte, int, int, error) {
+	if isVideo {
+		var err error
+		data, err = extractVideoFrame(ctx, data, mimeType)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to extract video frame: %w", err)
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	// Thumbnails don't have EXIF data, so the rotation needs to be applied to the pixels
+	img = applyOrientation(img, jpegOrientation(data))
+	bounds := img.Bounds()
+	w, h := mc.clampThumbnailSize(bounds.Dx(), bounds.Dy())
+	if w == 0 || h == 0 {
+		return nil, 0, 0, fmt.Errorf("image has invalid dimensions %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	thumbnail, err := encodeThumbnail(scaled, mc.thumbnailQuality())
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return thumbnail, w, h, nil
+}
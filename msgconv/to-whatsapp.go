@@ -19,95 +19,261 @@ package msgconv
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"image"
+	"image/gif"
+	"image/jpeg"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/rs/zerolog"
 	"go.mau.fi/util/ffmpeg"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/binary/armadillo/waMediaTransport"
 	"go.mau.fi/whatsmeow/binary/armadillo/waMsgApplication"
-	"go.mau.fi/whatsmeow/types"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
 	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
 )
 
-func (mc *MessageConverter) TextToWhatsApp(content *event.MessageEventContent) *waCommon.MessageText {
-	// TODO mentions
-	return &waCommon.MessageText{
+func (mc *MessageConverter) TextToWhatsApp(ctx context.Context, content *event.MessageEventContent) *waCommon.MessageText {
+	text := &waCommon.MessageText{
 		Text: content.Body,
 	}
+	if content.Format == event.FormatHTML && content.FormattedBody != "" {
+		parsed, mentions := mc.parseMatrixHTML(ctx, content)
+		if parsed != "" {
+			text.Text, text.MentionedJID = parsed, mentions
+		}
+	}
+	if mc.mentionsRoom(ctx, content) {
+		if offset, length, ok := findRoomMention(text.Text); ok {
+			text.Commands = append(text.Commands, &waCommon.Command{
+				CommandType: waCommon.Command_EVERYONE,
+				Offset:      uint32(offset),
+				Length:      uint32(length),
+			})
+		}
+	}
+	return text
+}
+
+// mediaCaption converts the caption of a Matrix media message, including the JIDs of any users mentioned in it.
+// It returns nil if the message doesn't have a caption, i.e. if the body is just the file name or whitespace.
+func (mc *MessageConverter) mediaCaption(ctx context.Context, content *event.MessageEventContent) *waCommon.MessageText {
+	if !hasMediaCaption(content) {
+		return nil
+	}
+	caption := mc.TextToWhatsApp(ctx, content)
+	trimMessageText(caption)
+	if caption.Text == "" {
+		// The converted formatted body may be just whitespace even if the plaintext body isn't
+		return nil
+	}
+	return caption
+}
+
+// trimMessageText removes leading and trailing whitespace from the text, adjusting the offsets of commands
+// (i.e. room mentions) to match.
+func trimMessageText(text *waCommon.MessageText) {
+	trimmed := strings.TrimLeftFunc(text.Text, unicode.IsSpace)
+	shift := uint32(len(NewUTF16String(text.Text[:len(text.Text)-len(trimmed)])))
+	text.Text = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+	for _, cmd := range text.Commands {
+		cmd.Offset -= shift
+	}
+}
+
+// EditToWhatsApp converts the new content of an edited Matrix message into the text for a WhatsApp edit.
+// Text messages can always be edited. For images and videos, the caption is edited, which requires the
+// original message to have had a caption (i.e. the original and new body aren't just the file name).
+func (mc *MessageConverter) EditToWhatsApp(ctx context.Context, original, edited *event.MessageEventContent) (*waCommon.MessageText, error) {
+	switch edited.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+		return mc.TextToWhatsApp(ctx, edited), nil
+	case event.MsgImage, event.MsgVideo:
+		if original == nil {
+			return nil, fmt.Errorf("%w: failed to get original message", ErrEditNotCaptioned)
+		} else if original.MsgType != edited.MsgType {
+			return nil, fmt.Errorf("%w: original message is %s, not %s", ErrEditNotCaptioned, original.MsgType, edited.MsgType)
+		} else if mc.mediaCaption(ctx, original) == nil {
+			return nil, fmt.Errorf("%w: original message doesn't have a caption", ErrEditNotCaptioned)
+		}
+		if edited.FileName == "" {
+			// Edits usually don't include the file name, but it's needed to tell the caption apart from the body
+			edited.FileName = original.FileName
+		}
+		caption := mc.mediaCaption(ctx, edited)
+		if caption == nil {
+			return nil, fmt.Errorf("%w: removing captions is not supported", ErrEditNotCaptioned)
+		}
+		return caption, nil
+	default:
+		return nil, fmt.Errorf("%w: can't edit %s messages", ErrEditNotCaptioned, edited.MsgType)
+	}
 }
 
+// ToWhatsApp converts a Matrix message into a WhatsApp message. If ConversionTimeout is set, the whole
+// conversion including media downloads, ffmpeg and uploads is cancelled after that long.
 func (mc *MessageConverter) ToWhatsApp(
 	ctx context.Context,
 	evt *event.Event,
 	content *event.MessageEventContent,
 	relaybotFormatted bool,
 ) (*waConsumerApplication.ConsumerApplication, *waMsgApplication.MessageApplication_Metadata, error) {
-	if evt.Type == event.EventSticker {
-		content.MsgType = event.MessageType(event.EventSticker.Type)
+	if mc.ConversionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mc.ConversionTimeout)
+		defer cancel()
 	}
-	if content.MsgType == event.MsgEmote && !relaybotFormatted {
-		content.Body = "/me " + content.Body
-		if content.FormattedBody != "" {
-			content.FormattedBody = "/me " + content.FormattedBody
-		}
+	msgType := conversionMsgType(evt, content)
+	waMsg, waMeta, err := mc.toWhatsApp(ctx, evt, content, relaybotFormatted)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// Media is only cached after a successful upload, so an upload cancelled halfway is simply abandoned
+		err = fmt.Errorf("%w: %w", ErrConversionTimeout, err)
+	}
+	mc.observeConversion(msgType, err)
+	return waMsg, waMeta, err
+}
+
+func (mc *MessageConverter) toWhatsApp(
+	ctx context.Context,
+	evt *event.Event,
+	content *event.MessageEventContent,
+	relaybotFormatted bool,
+) (*waConsumerApplication.ConsumerApplication, *waMsgApplication.MessageApplication_Metadata, error) {
+	err := checkMessageEffect(evt)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = mc.checkRoomMention(ctx, evt, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	mc.routeWhatsAppMsgType(evt, content, relaybotFormatted)
+	// Replies are sent as quoted messages, so the fallback would duplicate the quote. The bridge module
+	// already removes it from normal message events, but this is a no-op if it was already removed.
+	content.RemoveReplyFallback()
+	if !relaybotFormatted {
+		mc.addMsgTypePrefix(ctx, evt.Sender, content)
 	}
 	var waContent waConsumerApplication.ConsumerApplication_Content
 	switch content.MsgType {
 	case event.MsgText, event.MsgNotice, event.MsgEmote:
-		waContent.Content = &waConsumerApplication.ConsumerApplication_Content_MessageText{
-			MessageText: mc.TextToWhatsApp(content),
+		text := mc.TextToWhatsApp(ctx, content)
+		if utf8.RuneCountInString(text.Text) > MaxTextLength {
+			if !mc.SplitLongMessages {
+				return nil, nil, fmt.Errorf("%w: message is %d characters long, maximum is %d", ErrMessageTooLong, utf8.RuneCountInString(text.Text), MaxTextLength)
+			}
+			// The rest of the parts are sent as follow-ups, see FollowUpsToWhatsApp
+			text = splitMessageText(text, MaxTextLength)[0]
+		}
+		if extendedText := mc.LinkPreviewToWhatsApp(ctx, text); extendedText != nil {
+			waContent.Content = &waConsumerApplication.ConsumerApplication_Content_ExtendedTextMessage{
+				ExtendedTextMessage: extendedText,
+			}
+		} else {
+			waContent.Content = &waConsumerApplication.ConsumerApplication_Content_MessageText{
+				MessageText: text,
+			}
 		}
 	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile, event.MessageType(event.EventSticker.Type):
+		if isVCardFile(content) {
+			contactContent, err := mc.VCardToWhatsApp(ctx, content)
+			if err == nil {
+				waContent.Content = contactContent
+				break
+			}
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to convert vCard to contact message, sending as file")
+		}
 		reuploaded, fileName, err := mc.reuploadMediaToWhatsApp(ctx, evt, content)
 		if err != nil {
 			return nil, nil, err
 		}
-		var caption *waCommon.MessageText
-		if content.FileName != "" && content.Body != content.FileName {
-			caption = mc.TextToWhatsApp(content)
-		} else {
+		caption := mc.mediaCaption(ctx, content)
+		if mc.captionPlacement(content) != CaptionAttached {
+			// The caption is sent as a separate message, see CaptionToWhatsApp
+			caption = nil
+		}
+		if caption == nil {
 			caption = &waCommon.MessageText{}
+		} else if content.MsgType == event.MsgFile && len(caption.MentionedJID) > 0 {
+			zerolog.Ctx(ctx).Debug().
+				Strs("mentioned_jids", caption.MentionedJID).
+				Msg("Dropping mentions in caption of file message, as documents don't have captions")
 		}
 		waContent.Content, err = mc.wrapWhatsAppMedia(evt, content, reuploaded, caption, fileName)
 		if err != nil {
 			return nil, nil, err
 		}
+		if isViewOnce, _ := evt.Content.Raw[ViewOnceField].(bool); isViewOnce {
+			waContent.Content = wrapViewOnce(waContent.Content)
+		}
 	case event.MsgLocation:
-		lat, long, err := parseGeoURI(content.GeoURI)
+		lat, long, uncertainty, err := parseGeoURI(content.GeoURI)
 		if err != nil {
 			return nil, nil, err
 		}
+		name, address, isPlace := locationPlace(evt)
+		if !isPlace {
+			name = locationName(content)
+		}
+		if address == "" {
+			address = mc.locationAddress(lat, long, uncertainty)
+		}
 		// TODO does this actually work with any of the messenger clients?
 		waContent.Content = &waConsumerApplication.ConsumerApplication_Content_LocationMessage{
 			LocationMessage: &waConsumerApplication.ConsumerApplication_LocationMessage{
 				Location: &waConsumerApplication.ConsumerApplication_Location{
 					DegreesLatitude:  lat,
 					DegreesLongitude: long,
-					Name:             content.Body,
+					Name:             name,
 				},
-				Address: "Earth",
+				Address: address,
 			},
 		}
+	case event.MessageType(EventUnstableBeacon.Type):
+		liveLocation, err := mc.BeaconToWhatsApp(ctx, evt)
+		if err != nil {
+			return nil, nil, err
+		}
+		waContent.Content = &waConsumerApplication.ConsumerApplication_Content_LiveLocationMessage{
+			LiveLocationMessage: liveLocation,
+		}
+	case event.MessageType(EventUnstablePollStart.Type):
+		pollCreation, err := mc.PollStartToWhatsApp(ctx, evt)
+		if err != nil {
+			return nil, nil, err
+		}
+		waContent.Content = &waConsumerApplication.ConsumerApplication_Content_PollCreationMessage{
+			PollCreationMessage: pollCreation,
+		}
 	default:
-		return nil, nil, fmt.Errorf("%w %s", ErrUnsupportedMsgType, content.MsgType)
-	}
-	var meta waMsgApplication.MessageApplication_Metadata
-	if replyTo := mc.GetMetaReply(ctx, content); replyTo != nil {
-		meta.QuotedMessage = &waMsgApplication.MessageApplication_Metadata_QuotedMessage{
-			StanzaID: replyTo.ReplyMessageId,
-			// TODO: this is hacky since it hardcodes the server
-			// TODO 2: should this be included for DMs?
-			Participant: types.JID{User: strconv.FormatInt(replyTo.ReplySender, 10), Server: types.MessengerServer}.String(),
-			Payload:     nil,
+		if !mc.SendUnsupportedAsText {
+			return nil, nil, fmt.Errorf("%w %s", ErrUnsupportedMsgType, content.MsgType)
 		}
+		text := fmt.Sprintf("[unsupported message: %s]", content.MsgType)
+		if content.Body != "" {
+			text += "\n" + content.Body
+		}
+		waContent.Content = &waConsumerApplication.ConsumerApplication_Content_MessageText{
+			MessageText: &waCommon.MessageText{Text: text},
+		}
+	}
+	meta := mc.newMessageMetadata(ctx)
+	if score := forwardingScore(evt); score > 0 {
+		meta.IsForwarded = true
+		meta.ForwardingScore = score
 	}
+	meta.QuotedMessage = mc.quotedMessageToWhatsApp(ctx, mc.replyTargetID(content))
 	return &waConsumerApplication.ConsumerApplication{
 		Payload: &waConsumerApplication.ConsumerApplication_Payload{
 			Payload: &waConsumerApplication.ConsumerApplication_Payload_Content{
@@ -115,82 +281,580 @@ func (mc *MessageConverter) ToWhatsApp(
 			},
 		},
 		Metadata: nil,
-	}, &meta, nil
+	}, meta, nil
+}
+
+// quotedMessageToWhatsApp builds the quoted message metadata for a reply to the given Matrix event.
+// It returns nil if the event isn't bridged or shouldn't be quoted.
+func (mc *MessageConverter) quotedMessageToWhatsApp(ctx context.Context, replyToID id.EventID) *waMsgApplication.MessageApplication_Metadata_QuotedMessage {
+	replyTo := mc.GetMetaReply(ctx, replyToID)
+	if replyTo == nil {
+		return nil
+	}
+	replySender := replyTo.ReplySender
+	if portal := mc.GetData(ctx); portal.IsSelfChat() {
+		// Everything in a self-chat is sent by the user, so always quote the user's own JID instead of
+		// relying on the stored sender, which may belong to the other half of the DM portal.
+		replySender = portal.Receiver
+	}
+	quoted := &waMsgApplication.MessageApplication_Metadata_QuotedMessage{
+		StanzaID:    replyTo.ReplyMessageId,
+		Participant: mc.UserJID(ctx, replySender).String(),
+		Payload:     mc.quotedMessagePayload(ctx, replyToID),
+	}
+	if replyTo.ReplyChatJID != "" {
+		quoted.RemoteJID = replyTo.ReplyChatJID
+	} else if !mc.IsPrivateChat(ctx) {
+		quoted.RemoteJID = mc.GetData(ctx).JID().String()
+	}
+	return quoted
+}
+
+// EditMetadataToWhatsApp returns the metadata to send with an edit of the given original Matrix message.
+// If the original message was a reply, the quote is attached again so that clients don't lose the reply
+// context when rendering the edited message. It returns nil if there's nothing to attach.
+func (mc *MessageConverter) EditMetadataToWhatsApp(ctx context.Context, original *event.MessageEventContent) *waMsgApplication.MessageApplication_Metadata {
+	if original == nil {
+		return nil
+	}
+	quoted := mc.quotedMessageToWhatsApp(ctx, mc.replyTargetID(original))
+	if quoted == nil {
+		return nil
+	}
+	return &waMsgApplication.MessageApplication_Metadata{QuotedMessage: quoted}
+}
+
+func (mc *MessageConverter) newMessageMetadata(ctx context.Context) *waMsgApplication.MessageApplication_Metadata {
+	var meta waMsgApplication.MessageApplication_Metadata
+	if timer := mc.GetData(ctx).DisappearTimer; timer > 0 {
+		meta.Ephemeral = &waMsgApplication.MessageApplication_Metadata_ChatEphemeralSetting{
+			ChatEphemeralSetting: &waMsgApplication.MessageApplication_EphemeralSetting{
+				EphemeralExpiration: timer,
+			},
+		}
+	}
+	return &meta
+}
+
+// LocationCommentField is the custom field in the content of Matrix location events that contains
+// a comment to send along with the location. The value is an object with the same body, format,
+// formatted_body and m.mentions fields as a normal text message, so the comment can contain mentions.
+const LocationCommentField = "fi.mau.meta.location_comment"
+
+// locationCommentToWhatsApp converts the comment attached to a Matrix location event into a text message.
+// WhatsApp location messages don't have a caption, so the comment has to be sent as a separate message
+// after the location itself. It returns nil if the event doesn't have a comment.
+func (mc *MessageConverter) locationCommentToWhatsApp(ctx context.Context, evt *event.Event) *waCommon.MessageText {
+	rawComment, ok := evt.Content.Raw[LocationCommentField].(map[string]any)
+	if !ok {
+		return nil
+	}
+	var comment event.MessageEventContent
+	err := remarshal(rawComment, &comment)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to parse location comment")
+		return nil
+	} else if strings.TrimSpace(comment.Body) == "" {
+		return nil
+	}
+	return mc.TextToWhatsApp(ctx, &comment)
 }
 
-func parseGeoURI(uri string) (lat, long float64, err error) {
+// FollowUpsToWhatsApp returns the extra text messages that need to be sent after the message returned by
+// ToWhatsApp, i.e. comments of locations and the rest of the parts of long messages that were split.
+// It must be called with the same content after ToWhatsApp.
+func (mc *MessageConverter) FollowUpsToWhatsApp(
+	ctx context.Context,
+	evt *event.Event,
+	content *event.MessageEventContent,
+) ([]*waConsumerApplication.ConsumerApplication, *waMsgApplication.MessageApplication_Metadata) {
+	var texts []*waCommon.MessageText
+	switch content.MsgType {
+	case event.MsgLocation:
+		if comment := mc.locationCommentToWhatsApp(ctx, evt); comment != nil {
+			texts = append(texts, comment)
+		}
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+		if mc.SplitLongMessages {
+			texts = splitMessageText(mc.TextToWhatsApp(ctx, content), MaxTextLength)[1:]
+		}
+	}
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	msgs := make([]*waConsumerApplication.ConsumerApplication, len(texts))
+	for i, text := range texts {
+		msgs[i] = wrapWhatsAppText(text)
+	}
+	return msgs, mc.newMessageMetadata(ctx)
+}
+
+// CaptionToWhatsApp returns the caption of a media message as a separate text message, along with whether it
+// should be sent before or after the media. It returns nil if the caption is attached to the media returned by
+// ToWhatsApp, or if there's no caption. It must be called with the same content after ToWhatsApp.
+func (mc *MessageConverter) CaptionToWhatsApp(
+	ctx context.Context,
+	content *event.MessageEventContent,
+) (*waConsumerApplication.ConsumerApplication, *waMsgApplication.MessageApplication_Metadata, CaptionPlacement) {
+	placement := mc.captionPlacement(content)
+	if placement == CaptionAttached {
+		return nil, nil, CaptionAttached
+	}
+	caption := mc.mediaCaption(ctx, content)
+	if caption == nil {
+		return nil, nil, CaptionAttached
+	}
+	return wrapWhatsAppText(caption), mc.newMessageMetadata(ctx), placement
+}
+
+func wrapWhatsAppText(text *waCommon.MessageText) *waConsumerApplication.ConsumerApplication {
+	return &waConsumerApplication.ConsumerApplication{
+		Payload: &waConsumerApplication.ConsumerApplication_Payload{
+			Payload: &waConsumerApplication.ConsumerApplication_Payload_Content{
+				Content: &waConsumerApplication.ConsumerApplication_Content{
+					Content: &waConsumerApplication.ConsumerApplication_Content_MessageText{
+						MessageText: text,
+					},
+				},
+			},
+		},
+	}
+}
+
+func remarshal(from, to any) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// quotedMessageContent builds a minimal copy of the replied-to message for the preview
+// shown in the quote. Media messages only include the caption, not the media itself.
+func (mc *MessageConverter) quotedMessageContent(ctx context.Context, content *event.MessageEventContent) *waConsumerApplication.ConsumerApplication_Content {
+	caption := mc.mediaCaption(ctx, content)
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+		return &waConsumerApplication.ConsumerApplication_Content{
+			Content: &waConsumerApplication.ConsumerApplication_Content_MessageText{
+				MessageText: mc.TextToWhatsApp(ctx, content),
+			},
+		}
+	case event.MsgImage:
+		imageMsg := &waConsumerApplication.ConsumerApplication_ImageMessage{Caption: caption}
+		// The media is only included if it's still cached, otherwise the quote is shown without a thumbnail
+		if cached := mc.getCachedQuoteMedia(ctx, content); cached != nil {
+			err := imageMsg.Set(&waMediaTransport.ImageTransport{
+				Integral: &waMediaTransport.ImageTransport_Integral{
+					Transport: cached.Transport,
+				},
+				Ancillary: &waMediaTransport.ImageTransport_Ancillary{
+					Height: uint32(cached.Height),
+					Width:  uint32(cached.Width),
+				},
+			})
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to add media to quoted image message")
+			}
+		}
+		return &waConsumerApplication.ConsumerApplication_Content{
+			Content: &waConsumerApplication.ConsumerApplication_Content_ImageMessage{
+				ImageMessage: imageMsg,
+			},
+		}
+	case event.MsgVideo:
+		videoMsg := &waConsumerApplication.ConsumerApplication_VideoMessage{Caption: caption}
+		if cached := mc.getCachedQuoteMedia(ctx, content); cached != nil {
+			err := videoMsg.Set(&waMediaTransport.VideoTransport{
+				Integral: &waMediaTransport.VideoTransport_Integral{
+					Transport: cached.Transport,
+				},
+				Ancillary: &waMediaTransport.VideoTransport_Ancillary{
+					Height:  uint32(cached.Height),
+					Width:   uint32(cached.Width),
+					Seconds: uint32(cached.Duration / 1000),
+				},
+			})
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to add media to quoted video message")
+			}
+		}
+		return &waConsumerApplication.ConsumerApplication_Content{
+			Content: &waConsumerApplication.ConsumerApplication_Content_VideoMessage{
+				VideoMessage: videoMsg,
+			},
+		}
+	case event.MsgAudio:
+		return &waConsumerApplication.ConsumerApplication_Content{
+			Content: &waConsumerApplication.ConsumerApplication_Content_AudioMessage{
+				AudioMessage: &waConsumerApplication.ConsumerApplication_AudioMessage{},
+			},
+		}
+	case event.MsgFile:
+		fileName := mediaFileName(content)
+		return &waConsumerApplication.ConsumerApplication_Content{
+			Content: &waConsumerApplication.ConsumerApplication_Content_DocumentMessage{
+				DocumentMessage: &waConsumerApplication.ConsumerApplication_DocumentMessage{FileName: fileName},
+			},
+		}
+	case event.MessageType(event.EventSticker.Type):
+		return &waConsumerApplication.ConsumerApplication_Content{
+			Content: &waConsumerApplication.ConsumerApplication_Content_StickerMessage{
+				StickerMessage: &waConsumerApplication.ConsumerApplication_StickerMessage{},
+			},
+		}
+	default:
+		return nil
+	}
+}
+
+func (mc *MessageConverter) quotedMessagePayload(ctx context.Context, replyToID id.EventID) *waMsgApplication.MessageApplication_Payload {
+	replyToContent := mc.GetReplyTargetContent(ctx, replyToID)
+	if replyToContent == nil {
+		return nil
+	}
+	quotedContent := mc.quotedMessageContent(ctx, replyToContent)
+	if quotedContent == nil {
+		return nil
+	}
+	consumerMessage := &waMsgApplication.MessageApplication_SubProtocolPayload_ConsumerMessage{}
+	err := consumerMessage.Set(&waConsumerApplication.ConsumerApplication{
+		Payload: &waConsumerApplication.ConsumerApplication_Payload{
+			Payload: &waConsumerApplication.ConsumerApplication_Payload_Content{
+				Content: quotedContent,
+			},
+		},
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to marshal quoted message payload")
+		return nil
+	}
+	return &waMsgApplication.MessageApplication_Payload{
+		Content: &waMsgApplication.MessageApplication_Payload_SubProtocol{
+			SubProtocol: &waMsgApplication.MessageApplication_SubProtocolPayload{
+				SubProtocol: consumerMessage,
+				FutureProof: waCommon.FutureProofBehavior_PLACEHOLDER,
+			},
+		},
+	}
+}
+
+// parseGeoURI parses an RFC 5870 geo URI into the latitude, longitude and the uncertainty from the u parameter.
+// All errors wrap ErrInvalidGeoURI.
+func parseGeoURI(uri string) (lat, long, uncertainty float64, err error) {
+	lat, long, uncertainty, err = parseGeoURIComponents(uri)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrInvalidGeoURI, err)
+	}
+	return
+}
+
+func parseGeoURIComponents(uri string) (lat, long, uncertainty float64, err error) {
+	uri = strings.TrimSpace(uri)
 	if !strings.HasPrefix(uri, "geo:") {
 		err = fmt.Errorf("uri doesn't have geo: prefix")
 		return
 	}
-	// Remove geo: prefix and anything after ;
-	coordinates := strings.Split(strings.TrimPrefix(uri, "geo:"), ";")[0]
+	// Remove geo: prefix and split off parameters after ;
+	parts := strings.Split(strings.TrimPrefix(uri, "geo:"), ";")
+	coordinates := parts[0]
 
-	if splitCoordinates := strings.Split(coordinates, ","); len(splitCoordinates) != 2 {
-		err = fmt.Errorf("didn't find exactly two numbers separated by a comma")
-	} else if lat, err = strconv.ParseFloat(splitCoordinates[0], 64); err != nil {
+	// The optional third component is altitude, which Meta doesn't have a field for, so it's only validated
+	splitCoordinates := strings.Split(coordinates, ",")
+	// Some clients wrongly use commas as the decimal separator, which makes the components ambiguous:
+	//   - Two or three components are always read as latitude, longitude and altitude, as they're also valid
+	//     with period separators. For example, geo:52,3 is 52°N 3°E rather than 52.3°N with no longitude.
+	//   - Four components without any periods can only be comma decimals, so they're joined pairwise, e.g.
+	//     geo:52,3,4,5 is 52.3°N 4.5°E. Parameters after the coordinates don't affect this.
+	//   - Four components that contain a period and anything with more components are rejected.
+	if len(splitCoordinates) == 4 && !strings.Contains(coordinates, ".") {
+		splitCoordinates = []string{
+			strings.TrimSpace(splitCoordinates[0]) + "." + strings.TrimSpace(splitCoordinates[1]),
+			strings.TrimSpace(splitCoordinates[2]) + "." + strings.TrimSpace(splitCoordinates[3]),
+		}
+	}
+	if len(splitCoordinates) != 2 && len(splitCoordinates) != 3 {
+		err = fmt.Errorf("didn't find two or three numbers separated by commas (the decimal separator must be a period)")
+	} else if lat, err = strconv.ParseFloat(strings.TrimSpace(splitCoordinates[0]), 64); err != nil {
 		err = fmt.Errorf("latitude is not a number: %w", err)
-	} else if long, err = strconv.ParseFloat(splitCoordinates[1], 64); err != nil {
+	} else if long, err = strconv.ParseFloat(strings.TrimSpace(splitCoordinates[1]), 64); err != nil {
 		err = fmt.Errorf("longitude is not a number: %w", err)
+	} else if lat < -90 || lat > 90 {
+		err = fmt.Errorf("latitude %g is out of range", lat)
+	} else if long < -180 || long > 180 {
+		err = fmt.Errorf("longitude %g is out of range", long)
+	} else if len(splitCoordinates) == 3 {
+		if _, err = strconv.ParseFloat(strings.TrimSpace(splitCoordinates[2]), 64); err != nil {
+			err = fmt.Errorf("altitude is not a number: %w", err)
+		}
+	}
+	if err != nil {
+		lat, long = 0, 0
+		return
+	}
+	for _, param := range parts[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.EqualFold(strings.TrimSpace(key), "u") {
+			uncertainty, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				lat, long, uncertainty = 0, 0, 0
+				err = fmt.Errorf("uncertainty is not a number: %w", err)
+			}
+			return
+		}
 	}
 	return
 }
 
-func clampTo400(w, h int) (int, int) {
-	if w > 400 {
-		h = h * 400 / w
-		w = 400
+type locationEventContent struct {
+	Location *BeaconLocation `json:"org.matrix.msc3488.location"`
+	Asset    *struct {
+		Type string `json:"type"`
+	} `json:"org.matrix.msc3488.asset"`
+}
+
+// locationPlace returns the name and address of a place from the MSC3488 fields of a location message.
+// The first line of the description is used as the name and the rest as the address, which matches
+// how places from WhatsApp are bridged to Matrix. If the message is a raw pin or a user's own location
+// without a description, isPlace is false.
+func locationPlace(evt *event.Event) (name, address string, isPlace bool) {
+	var parsed locationEventContent
+	err := json.Unmarshal(evt.Content.VeryRaw, &parsed)
+	if err != nil || parsed.Location == nil || (parsed.Asset != nil && parsed.Asset.Type == "m.self") {
+		return "", "", false
+	}
+	description := strings.TrimSpace(parsed.Location.Description)
+	if description == "" {
+		return "", "", false
+	}
+	name, address, _ = strings.Cut(description, "\n")
+	return strings.TrimSpace(name), strings.TrimSpace(address), true
+}
+
+// locationName returns the user-provided label of a location message,
+// or an empty string if the body is just a generic client-generated placeholder.
+func locationName(content *event.MessageEventContent) string {
+	body := strings.TrimSpace(content.Body)
+	lowerBody := strings.ToLower(body)
+	if body == "" || body == content.GeoURI || lowerBody == "location" || strings.HasPrefix(lowerBody, "location geo:") {
+		return ""
+	}
+	return body
+}
+
+// locationAddress returns the configured address for locations, or the formatted coordinates if one isn't set.
+// The address is never left empty, as clients may not render location messages without one.
+func (mc *MessageConverter) locationAddress(lat, long, uncertainty float64) string {
+	if address := strings.TrimSpace(mc.LocationAddress); address != "" {
+		return address
+	}
+	return formatCoordinates(lat, long, uncertainty)
+}
+
+func formatCoordinates(lat, long, uncertainty float64) string {
+	coordinates := strconv.FormatFloat(lat, 'f', 6, 64) + ", " + strconv.FormatFloat(long, 'f', 6, 64)
+	if uncertainty > 0 {
+		coordinates += fmt.Sprintf(" (±%.0f m)", uncertainty)
+	}
+	return coordinates
+}
+
+const defaultMaxThumbnailDimension = 400
+
+func (mc *MessageConverter) maxThumbnailDimension() int {
+	if mc.MaxThumbnailDimension <= 0 {
+		return defaultMaxThumbnailDimension
+	}
+	return mc.MaxThumbnailDimension
+}
+
+// clampThumbnailSize scales the given dimensions down to fit within the configured maximum thumbnail dimension.
+func (mc *MessageConverter) clampThumbnailSize(w, h int) (int, int) {
+	maxSize := mc.maxThumbnailDimension()
+	if w > maxSize {
+		h = h * maxSize / w
+		w = maxSize
 	}
-	if h > 400 {
-		w = w * 400 / h
-		h = 400
+	if h > maxSize {
+		w = w * maxSize / h
+		h = maxSize
 	}
 	return w, h
 }
 
 func (mc *MessageConverter) reuploadMediaToWhatsApp(ctx context.Context, evt *event.Event, content *event.MessageEventContent) (*waMediaTransport.WAMediaTransport, string, error) {
+	// Matrix media events aren't required to have an info object, default to zero dimensions and duration
+	info := content.GetInfo()
+	if cached, fileName, ok := mc.getCachedMedia(ctx, evt, content); ok {
+		zerolog.Ctx(ctx).Debug().Str("object_id", cached.GetAncillary().GetObjectID()).Msg("Using cached WhatsApp media")
+		return cached, fileName, nil
+	}
+	origMsgType := content.MsgType
+	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
+	defer mc.startMediaPresence(ctx, isVoice)()
 	data, mimeType, fileName, err := mc.downloadMatrixMedia(ctx, content)
 	if err != nil {
 		return nil, "", err
 	}
-	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
-	if isVoice {
-		data, err = ffmpeg.ConvertBytes(ctx, data, ".m4a", []string{}, []string{"-c:a", "aac"}, mimeType)
+	origFileName := fileName
+	transcodeStart := time.Now()
+	transcodingDisabled := mc.GetData(ctx).DisableTranscoding
+	var conversion mediaConversion
+	props := mc.readMediaProperties(content.MsgType, data, mimeType, fileName, isVoice)
+	content.MsgType, conversion = mc.routeWhatsAppMedia(ctx, content.MsgType, props)
+	switch conversion {
+	case mediaConversionVoice:
+		data, mimeType, fileName, err = mc.convertVoice(ctx, data, mimeType, fileName)
 		if err != nil {
-			return nil, "", fmt.Errorf("%w voice message to m4a: %w", ErrMediaConvertFailed, err)
-		}
-		mimeType = "audio/mp4"
-		fileName += ".m4a"
-	} else if mimeType == "image/gif" && content.MsgType == event.MsgImage {
-		data, err = ffmpeg.ConvertBytes(ctx, data, ".mp4", []string{"-f", "gif"}, []string{
-			"-pix_fmt", "yuv420p", "-c:v", "libx264", "-movflags", "+faststart",
-			"-filter:v", "crop='floor(in_w/2)*2:floor(in_h/2)*2'",
-		}, mimeType)
+			return nil, "", err
+		}
+	case mediaConversionNativeGIF:
+		setCustomInfo(evt, "fi.mau.gif", true)
+	case mediaConversionGIFFirstFrame:
+		zerolog.Ctx(ctx).Debug().Msg("ffmpeg isn't available, sending first frame of GIF as an image")
+		data, err = gifFirstFrameToJPEG(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w gif to jpeg: %w", ErrMediaConvertFailed, err)
+		}
+		mimeType = "image/jpeg"
+		fileName += ".jpg"
+	case mediaConversionGIFToMP4:
+		inputArgs, outputArgs := mc.gifConvertArgs(ctx)
+		data, err = ffmpeg.ConvertBytes(ctx, data, ".mp4", inputArgs, outputArgs, mimeType)
 		if err != nil {
 			return nil, "", fmt.Errorf("%w gif to mp4: %w", ErrMediaConvertFailed, err)
 		}
 		mimeType = "video/mp4"
 		fileName += ".mp4"
-		content.MsgType = event.MsgVideo
-		customInfo, ok := evt.Content.Raw["info"].(map[string]any)
-		if !ok {
-			customInfo = make(map[string]any)
-			evt.Content.Raw["info"] = customInfo
+		setCustomInfo(evt, "fi.mau.gif", true)
+	case mediaConversionAnimatedWebPToMP4:
+		mp4, err := mc.convertAnimatedWebP(ctx, data)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to convert animated WebP to mp4, sending as image")
+			content.MsgType = event.MsgImage
+		} else {
+			data = mp4
+			mimeType = "video/mp4"
+			fileName += ".mp4"
+			setCustomInfo(evt, "fi.mau.gif", true)
+		}
+	case mediaConversionSilentAudio:
+		data, mimeType, fileName = mc.ensureAudioTrack(ctx, data, mimeType, fileName)
+	case mediaConversionHEICAsFile:
+		if !strings.HasPrefix(mimeType, "image/") {
+			// HEIC isn't sniffed by http.DetectContentType, so it may have only been detected by the extension
+			mimeType = "image/heic"
+		}
+	case mediaConversionHEICToJPEG:
+		jpegData, err := mc.convertHEIC(ctx, data, mimeType)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to convert HEIC image, sending as file")
+			content.MsgType = event.MsgFile
+			if !strings.HasPrefix(mimeType, "image/") {
+				mimeType = "image/heic"
+			}
+		} else {
+			data = jpegData
+			mimeType = "image/jpeg"
+			fileName += ".jpg"
+		}
+	case mediaConversionSVGAsFile:
+		mimeType = "image/svg+xml"
+	case mediaConversionSVGToPNG:
+		png, err := mc.rasterizeSVG(ctx, data)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to rasterize SVG, sending as file")
+			content.MsgType = event.MsgFile
+			mimeType = "image/svg+xml"
+		} else {
+			data = png
+			mimeType = "image/png"
+			fileName += ".png"
+		}
+	case mediaConversionPDFPageCount:
+		if pageCount := countPDFPages(data); pageCount > 0 {
+			setCustomInfo(evt, "fi.mau.page_count", pageCount)
+		}
+	case mediaConversionOriginalSticker:
+		setCustomInfo(evt, "fi.mau.animated_sticker", isAnimatedWebP(data))
+	case mediaConversionSticker:
+		var isAnimated bool
+		data, mimeType, isAnimated, err = convertSticker(ctx, data, mimeType)
+		if err != nil {
+			return nil, "", err
+		}
+		data, mimeType, err = fitStickerLimits(ctx, data, mimeType, isAnimated)
+		if err != nil {
+			return nil, "", err
+		}
+		setCustomInfo(evt, "fi.mau.animated_sticker", isAnimated)
+	case mediaConversionStickerAsImage:
+		zerolog.Ctx(ctx).Debug().Str("mime_type", mimeType).Msg("Transcoding is disabled in the portal, sending non-WebP sticker as an image")
+	}
+	if content.MsgType == event.MsgImage && mc.MaxImageDimension > 0 && !transcodingDisabled {
+		downscaled, downscaledMime, err := downscaleImage(data, mimeType, mc.MaxImageDimension)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to downscale image, sending original")
+		} else if downscaled != nil {
+			zerolog.Ctx(ctx).Debug().
+				Int("original_size", len(data)).
+				Int("downscaled_size", len(downscaled)).
+				Msg("Downscaled image before uploading")
+			if downscaledMime != mimeType {
+				fileName += ".png"
+			}
+			data, mimeType = downscaled, downscaledMime
+		}
+	}
+	mc.observeMediaStep(origMsgType, MediaStepTranscode, transcodeStart, len(data))
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MessageType(event.EventSticker.Type):
+		// The dimensions in the Matrix event may be missing or refer to the file before conversion,
+		// so always read them from the data that's actually being uploaded.
+		width, height, err := probeDimensions(ctx, data, mimeType)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to probe media dimensions")
+		} else {
+			info.Width, info.Height = width, height
+		}
+		if content.MsgType == event.MessageType(event.EventSticker.Type) && (info.Width == 0 || info.Height == 0) {
+			// iOS clients drop stickers without dimensions
+			info.Width, info.Height = stickerDimensions(data)
 		}
-		customInfo["fi.mau.gif"] = true
 	}
-	if content.MsgType == event.MsgImage && content.Info.Width == 0 {
-		cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
-		content.Info.Width, content.Info.Height = cfg.Width, cfg.Height
+	if (content.MsgType == event.MsgAudio || content.MsgType == event.MsgVideo) && info.Duration == 0 {
+		duration, err := probeDuration(ctx, data, mimeType)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to probe media duration")
+		} else {
+			info.Duration = int(duration.Milliseconds())
+		}
+	}
+	if maxSize := maxMediaSize(content.MsgType); len(data) > maxSize {
+		return nil, "", fmt.Errorf("%w: %s is %.1f MiB, maximum is %d MiB", ErrMediaTooLarge, content.MsgType, float64(len(data))/1024/1024, maxSize/1024/1024)
 	}
 	mediaType := msgToMediaType(content.MsgType)
-	uploaded, err := mc.GetE2EEClient(ctx).Upload(ctx, data, mediaType)
+	uploadStart := time.Now()
+	uploaded, err := mc.uploadWithRetry(ctx, data, mediaType)
 	if err != nil {
+		mc.observeMediaStep(origMsgType, MediaStepUpload, uploadStart, 0)
 		return nil, "", fmt.Errorf("%w: %w", ErrMediaUploadFailed, err)
 	}
-	w, h := clampTo400(content.Info.Width, content.Info.Height)
+	mc.observeMediaStep(origMsgType, MediaStepUpload, uploadStart, len(data))
+	w, h := mc.clampThumbnailSize(info.Width, info.Height)
 	if w == 0 && content.MsgType == event.MsgImage {
-		w, h = 400, 400
+		w, h = mc.maxThumbnailDimension(), mc.maxThumbnailDimension()
+	}
+	var thumbnail []byte
+	if content.MsgType == event.MsgImage || content.MsgType == event.MsgVideo {
+		var thumbW, thumbH int
+		thumbnail, thumbW, thumbH, err = mc.createThumbnail(ctx, data, mimeType, content.MsgType == event.MsgVideo)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to generate thumbnail for media")
+		} else {
+			w, h = thumbW, thumbH
+		}
+		logUnusedBlurhash(ctx, info)
 	}
 	mediaTransport := &waMediaTransport.WAMediaTransport{
 		Integral: &waMediaTransport.WAMediaTransport_Integral{
@@ -207,13 +871,21 @@ func (mc *MessageConverter) reuploadMediaToWhatsApp(ctx context.Context, evt *ev
 			// Messenger iOS & Android will refuse to display the media if it's not present.
 			// iOS also requires that width and height are non-empty.
 			Thumbnail: &waMediaTransport.WAMediaTransport_Ancillary_Thumbnail{
+				JPEGThumbnail:   thumbnail,
 				ThumbnailWidth:  uint32(w),
 				ThumbnailHeight: uint32(h),
 			},
 			ObjectID: uploaded.ObjectID,
 		},
 	}
-	fmt.Printf("Uploaded media transport: %+v\n", mediaTransport)
+	zerolog.Ctx(ctx).Debug().
+		Str("mime_type", mimeType).
+		Uint64("file_length", mediaTransport.Ancillary.FileLength).
+		Str("object_id", uploaded.ObjectID).
+		Msg("Uploaded media to WhatsApp")
+	if !IsDryRun(ctx) {
+		mc.cacheMedia(ctx, evt, origMsgType, content, mediaTransport, origFileName, fileName)
+	}
 	return mediaTransport, fileName, nil
 }
 
@@ -224,6 +896,7 @@ func (mc *MessageConverter) wrapWhatsAppMedia(
 	caption *waCommon.MessageText,
 	fileName string,
 ) (output waConsumerApplication.ConsumerApplication_Content_Content, err error) {
+	info := content.GetInfo()
 	switch content.MsgType {
 	case event.MsgImage:
 		imageMsg := &waConsumerApplication.ConsumerApplication_ImageMessage{
@@ -234,20 +907,25 @@ func (mc *MessageConverter) wrapWhatsAppMedia(
 				Transport: reuploaded,
 			},
 			Ancillary: &waMediaTransport.ImageTransport_Ancillary{
-				Height: uint32(content.Info.Height),
-				Width:  uint32(content.Info.Width),
+				Height: uint32(info.Height),
+				Width:  uint32(info.Width),
 			},
 		})
 		output = &waConsumerApplication.ConsumerApplication_Content_ImageMessage{ImageMessage: imageMsg}
 	case event.MessageType(event.EventSticker.Type):
+		// TODO the sticker transport doesn't have fields for the pack name, author or emojis,
+		//      so any sticker pack metadata in the Matrix event can't be bridged.
 		stickerMsg := &waConsumerApplication.ConsumerApplication_StickerMessage{}
+		customInfo, _ := evt.Content.Raw["info"].(map[string]any)
+		isAnimated, _ := customInfo["fi.mau.animated_sticker"].(bool)
 		err = stickerMsg.Set(&waMediaTransport.StickerTransport{
 			Integral: &waMediaTransport.StickerTransport_Integral{
-				Transport: reuploaded,
+				Transport:  reuploaded,
+				IsAnimated: isAnimated,
 			},
 			Ancillary: &waMediaTransport.StickerTransport_Ancillary{
-				Height: uint32(content.Info.Height),
-				Width:  uint32(content.Info.Width),
+				Height: uint32(info.Height),
+				Width:  uint32(info.Width),
 			},
 		})
 		output = &waConsumerApplication.ConsumerApplication_Content_StickerMessage{StickerMessage: stickerMsg}
@@ -255,17 +933,15 @@ func (mc *MessageConverter) wrapWhatsAppMedia(
 		videoMsg := &waConsumerApplication.ConsumerApplication_VideoMessage{
 			Caption: caption,
 		}
-		customInfo, _ := evt.Content.Raw["info"].(map[string]any)
-		isGif, _ := customInfo["fi.mau.gif"].(bool)
-
+		isGif := isGIFVideo(evt)
 		err = videoMsg.Set(&waMediaTransport.VideoTransport{
 			Integral: &waMediaTransport.VideoTransport_Integral{
 				Transport: reuploaded,
 			},
 			Ancillary: &waMediaTransport.VideoTransport_Ancillary{
-				Height:      uint32(content.Info.Height),
-				Width:       uint32(content.Info.Width),
-				Seconds:     uint32(content.Info.Duration / 1000),
+				Height:      uint32(info.Height),
+				Width:       uint32(info.Width),
+				Seconds:     uint32(info.Duration / 1000),
 				GifPlayback: isGif,
 			},
 		})
@@ -279,26 +955,224 @@ func (mc *MessageConverter) wrapWhatsAppMedia(
 			Integral: &waMediaTransport.AudioTransport_Integral{
 				Transport: reuploaded,
 			},
+			// TODO include the MSC1767 waveform once the armadillo protobufs have a field for it.
+			//      Unlike the WAE2E AudioMessage, AudioTransport.Ancillary currently only has the duration.
 			Ancillary: &waMediaTransport.AudioTransport_Ancillary{
-				Seconds: uint32(content.Info.Duration / 1000),
+				Seconds: uint32(info.Duration / 1000),
 			},
 		})
 		output = &waConsumerApplication.ConsumerApplication_Content_AudioMessage{AudioMessage: audioMsg}
 	case event.MsgFile:
+		// Document messages don't have a caption field, so the file name must always be
+		// the actual file name rather than the caption in the body.
 		documentMsg := &waConsumerApplication.ConsumerApplication_DocumentMessage{
 			FileName: fileName,
 		}
+		customInfo, _ := evt.Content.Raw["info"].(map[string]any)
+		pageCount, _ := customInfo["fi.mau.page_count"].(int)
 		err = documentMsg.Set(&waMediaTransport.DocumentTransport{
 			Integral: &waMediaTransport.DocumentTransport_Integral{
 				Transport: reuploaded,
 			},
-			Ancillary: &waMediaTransport.DocumentTransport_Ancillary{},
+			Ancillary: &waMediaTransport.DocumentTransport_Ancillary{
+				PageCount: uint32(pageCount),
+			},
 		})
 		output = &waConsumerApplication.ConsumerApplication_Content_DocumentMessage{DocumentMessage: documentMsg}
 	}
+	if err == nil {
+		err = validateMediaTransport(reuploaded)
+	}
 	return
 }
 
+// validateMediaTransport checks that the fields Meta needs for downloading the media are present,
+// so that broken uploads fail here instead of being silently dropped by the recipient.
+func validateMediaTransport(transport *waMediaTransport.WAMediaTransport) error {
+	integral := transport.GetIntegral()
+	var missing []string
+	if len(integral.GetFileSHA256()) == 0 {
+		missing = append(missing, "file SHA256")
+	}
+	if len(integral.GetMediaKey()) == 0 {
+		missing = append(missing, "media key")
+	}
+	if len(integral.GetFileEncSHA256()) == 0 {
+		missing = append(missing, "encrypted file SHA256")
+	}
+	if integral.GetDirectPath() == "" {
+		missing = append(missing, "direct path")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: media transport is missing %s", ErrMediaUploadFailed, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// gifFirstFrameToJPEG converts the first frame of a GIF into a JPEG, for sending GIFs as static images
+// when ffmpeg isn't available to convert them into videos.
+func gifFirstFrameToJPEG(data []byte) ([]byte, error) {
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ViewOnceField is the custom field in the content of Matrix media events that marks them as view-once media.
+// If it's set to true for an image or video, the message is sent as view-once media, which Meta clients
+// only allow opening once. Other message types are sent normally, as Meta doesn't support view-once for them.
+const ViewOnceField = "fi.mau.meta.view_once"
+
+// ForwardedField is the custom field in the content of Matrix message events that marks them as forwarded.
+// The value is either true, or the number of times the message has been forwarded, which Meta clients use
+// to show a "forwarded many times" label instead of the normal one. Messages without the field or with
+// false or a number below 1 are sent as normal messages.
+const ForwardedField = "fi.mau.meta.forwarded"
+
+func forwardingScore(evt *event.Event) uint32 {
+	switch value := evt.Content.Raw[ForwardedField].(type) {
+	case bool:
+		if value {
+			return 1
+		}
+	case float64:
+		if value >= 1 {
+			return uint32(min(value, math.MaxUint32))
+		}
+	}
+	return 0
+}
+
+func wrapViewOnce(content waConsumerApplication.ConsumerApplication_Content_Content) waConsumerApplication.ConsumerApplication_Content_Content {
+	switch typedContent := content.(type) {
+	case *waConsumerApplication.ConsumerApplication_Content_ImageMessage:
+		return &waConsumerApplication.ConsumerApplication_Content_ViewOnceMessage{
+			ViewOnceMessage: &waConsumerApplication.ConsumerApplication_ViewOnceMessage{
+				ViewOnceContent: &waConsumerApplication.ConsumerApplication_ViewOnceMessage_ImageMessage{
+					ImageMessage: typedContent.ImageMessage,
+				},
+			},
+		}
+	case *waConsumerApplication.ConsumerApplication_Content_VideoMessage:
+		return &waConsumerApplication.ConsumerApplication_Content_ViewOnceMessage{
+			ViewOnceMessage: &waConsumerApplication.ConsumerApplication_ViewOnceMessage{
+				ViewOnceContent: &waConsumerApplication.ConsumerApplication_ViewOnceMessage_VideoMessage{
+					VideoMessage: typedContent.VideoMessage,
+				},
+			},
+		}
+	default:
+		return content
+	}
+}
+
+// fileMimetypeRoutes lists the mimetypes of files that are sent as normal media when RouteFilesByMimetype
+// is enabled. Only formats that WhatsApp clients can reliably display inline are included.
+var fileMimetypeRoutes = map[string]event.MessageType{
+	"image/jpeg": event.MsgImage,
+	"image/png":  event.MsgImage,
+	"image/webp": event.MsgImage,
+	"image/gif":  event.MsgImage,
+	"video/mp4":  event.MsgVideo,
+	"audio/mpeg": event.MsgAudio,
+	"audio/mp4":  event.MsgAudio,
+	"audio/aac":  event.MsgAudio,
+	"audio/ogg":  event.MsgAudio,
+}
+
+// routeWhatsAppMsgType sets the msgtype of the content to the type of WhatsApp message that it will be sent as,
+// before any media is downloaded. Non-message events like stickers and polls get their event type as the msgtype.
+func (mc *MessageConverter) routeWhatsAppMsgType(evt *event.Event, content *event.MessageEventContent, relaybotFormatted bool) {
+	if evt.Type == event.EventSticker || evt.Type == EventUnstablePollStart || evt.Type == EventUnstableBeacon {
+		content.MsgType = event.MessageType(evt.Type.Type)
+	}
+	if content.MsgType == event.MsgText && !relaybotFormatted {
+		mc.customEmojiToSticker(content)
+	} else if content.MsgType == event.MsgFile && mc.RouteFilesByMimetype {
+		routeFileByMimetype(content)
+	}
+}
+
+// routeFileByMimetype changes the msgtype of a Matrix file to image, video or audio based on the mimetype
+// declared in the event. Files without a declared mimetype or with any other mimetype are left as-is.
+func routeFileByMimetype(content *event.MessageEventContent) {
+	if content.Info == nil {
+		return
+	}
+	if msgType, ok := fileMimetypeRoutes[content.Info.MimeType]; ok {
+		content.MsgType = msgType
+	}
+}
+
+// isGIFVideo checks whether a Matrix video should be played like a GIF. The fi.mau.gif flag is set by
+// the GIF conversion in reuploadMediaToWhatsApp, but some Matrix clients also set it (or the looping
+// and autoplay flags) themselves when sending GIFs that were already converted to mp4.
+func isGIFVideo(evt *event.Event) bool {
+	customInfo, _ := evt.Content.Raw["info"].(map[string]any)
+	isGif, _ := customInfo["fi.mau.gif"].(bool)
+	if !isGif {
+		isGif, _ = evt.Content.Raw["fi.mau.gif"].(bool)
+	}
+	if !isGif {
+		isLoop, _ := customInfo["fi.mau.loop"].(bool)
+		isAutoplay, _ := customInfo["fi.mau.autoplay"].(bool)
+		isGif = isLoop && isAutoplay
+	}
+	return isGif
+}
+
+// setCustomInfo stores bridge-internal metadata in the info object of the raw event content,
+// so that it can be passed from the media reupload step to wrapWhatsAppMedia.
+func setCustomInfo(evt *event.Event, key string, value any) {
+	customInfo, ok := evt.Content.Raw["info"].(map[string]any)
+	if !ok {
+		customInfo = make(map[string]any)
+		evt.Content.Raw["info"] = customInfo
+	}
+	customInfo[key] = value
+}
+
+var pdfPageRegex = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// countPDFPages estimates the number of pages in a PDF by counting page objects.
+// It's not exact for every PDF (e.g. ones using compressed object streams), so 0 is returned if no pages are found.
+func countPDFPages(data []byte) int {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return 0
+	}
+	return len(pdfPageRegex.FindAllIndex(data, -1))
+}
+
+// Maximum file sizes accepted by Meta for each type of media.
+const (
+	MaxImageSize    = 25 * 1024 * 1024
+	MaxVideoSize    = 100 * 1024 * 1024
+	MaxAudioSize    = 25 * 1024 * 1024
+	MaxDocumentSize = 100 * 1024 * 1024
+	MaxStickerSize  = 1 * 1024 * 1024
+)
+
+func maxMediaSize(msgType event.MessageType) int {
+	switch msgType {
+	case event.MsgImage:
+		return MaxImageSize
+	case event.MessageType(event.EventSticker.Type):
+		return MaxStickerSize
+	case event.MsgVideo:
+		return MaxVideoSize
+	case event.MsgAudio:
+		return MaxAudioSize
+	default:
+		return MaxDocumentSize
+	}
+}
+
 func msgToMediaType(msgType event.MessageType) whatsmeow.MediaType {
 	switch msgType {
 	case event.MsgImage, event.MessageType(event.EventSticker.Type):
@@ -0,0 +1,358 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waCommon"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"go.mau.fi/whatsmeow/binary/armadillo/waMediaTransport"
+	"maunium.net/go/mautrix/event"
+)
+
+type geoURITest struct {
+	name        string
+	uri         string
+	lat, long   float64
+	uncertainty float64
+	wantErr     bool
+}
+
+func runGeoURITests(t *testing.T, tests []geoURITest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lat, long, uncertainty, err := parseGeoURI(test.uri)
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidGeoURI) {
+					t.Errorf("parseGeoURI(%q) error = %v, want ErrInvalidGeoURI", test.uri, err)
+				}
+				if lat != 0 || long != 0 || uncertainty != 0 {
+					t.Errorf("parseGeoURI(%q) = (%v, %v, %v) on error, want zeros", test.uri, lat, long, uncertainty)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseGeoURI(%q) error = %v", test.uri, err)
+			}
+			if lat != test.lat || long != test.long || uncertainty != test.uncertainty {
+				t.Errorf("parseGeoURI(%q) = (%v, %v, %v), want (%v, %v, %v)",
+					test.uri, lat, long, uncertainty, test.lat, test.long, test.uncertainty)
+			}
+		})
+	}
+}
+
+func TestParseGeoURI(t *testing.T) {
+	runGeoURITests(t, []geoURITest{
+		{name: "Null island", uri: "geo:0,0"},
+		{name: "Six decimal places", uri: "geo:60.169857,24.938379", lat: 60.169857, long: 24.938379},
+		{name: "Negative coordinates", uri: "geo:-33.868820,-151.209296", lat: -33.86882, long: -151.209296},
+		{name: "Negative zero", uri: "geo:-0,-0"},
+		{name: "Range limits", uri: "geo:90,-180", lat: 90, long: -180},
+		{name: "Altitude is ignored", uri: "geo:60.1,24.9,15.5", lat: 60.1, long: 24.9},
+		{name: "Negative altitude", uri: "geo:31.5,35.5,-430", lat: 31.5, long: 35.5},
+		{name: "Uncertainty", uri: "geo:60.1,24.9;u=35", lat: 60.1, long: 24.9, uncertainty: 35},
+		{name: "CRS parameter", uri: "geo:60.1,24.9;crs=wgs84", lat: 60.1, long: 24.9},
+		{name: "CRS and uncertainty", uri: "geo:60.1,24.9,10;crs=wgs84;u=12.5", lat: 60.1, long: 24.9, uncertainty: 12.5},
+		{name: "Uppercase uncertainty key", uri: "geo:60.1,24.9;U=7", lat: 60.1, long: 24.9, uncertainty: 7},
+		{name: "Surrounding whitespace", uri: "  geo:60.1,24.9\n", lat: 60.1, long: 24.9},
+		{name: "Whitespace around components", uri: "geo: 60.1 , 24.9 ; u = 5", lat: 60.1, long: 24.9, uncertainty: 5},
+
+		{name: "Missing prefix", uri: "60.1,24.9", wantErr: true},
+		{name: "Empty", uri: "", wantErr: true},
+		{name: "Missing comma", uri: "geo:60.1", wantErr: true},
+		{name: "Empty coordinates", uri: "geo:", wantErr: true},
+		{name: "Too many components", uri: "geo:1.5,2.5,3.5,4.5", wantErr: true},
+		{name: "Non-numeric latitude", uri: "geo:north,24.9", wantErr: true},
+		{name: "Non-numeric longitude", uri: "geo:60.1,east", wantErr: true},
+		{name: "Non-numeric altitude", uri: "geo:60.1,24.9,high", wantErr: true},
+		{name: "Non-numeric uncertainty", uri: "geo:60.1,24.9;u=far", wantErr: true},
+		{name: "Latitude out of range", uri: "geo:90.5,24.9", wantErr: true},
+		{name: "Negative latitude out of range", uri: "geo:-91,24.9", wantErr: true},
+		{name: "Longitude out of range", uri: "geo:60.1,180.1", wantErr: true},
+		{name: "Negative longitude out of range", uri: "geo:60.1,-200", wantErr: true},
+	})
+}
+
+func TestParseGeoURIAmbiguousDecimalCommas(t *testing.T) {
+	runGeoURITests(t, []geoURITest{
+		// Two or three integer components are valid URIs, so they're never treated as comma decimals
+		{name: "Two integers are latitude and longitude", uri: "geo:52,3", lat: 52, long: 3},
+		{name: "Three integers include an altitude", uri: "geo:52,3,4", lat: 52, long: 3},
+		{name: "Three components with periods", uri: "geo:52,3,4.5", lat: 52, long: 3},
+		{name: "Two integers with uncertainty", uri: "geo:52,3;u=10", lat: 52, long: 3, uncertainty: 10},
+
+		// Four integer components can only be comma decimals
+		{name: "Comma decimals", uri: "geo:52,3,4,5", lat: 52.3, long: 4.5},
+		{name: "Negative comma decimals", uri: "geo:-33,8,151,2", lat: -33.8, long: 151.2},
+		{name: "Comma decimals with spaces", uri: "geo:52, 3, 4, 5", lat: 52.3, long: 4.5},
+		{name: "Comma decimals with uncertainty", uri: "geo:52,3,4,5;u=10", lat: 52.3, long: 4.5, uncertainty: 10},
+		{name: "Comma decimals with crs and uncertainty", uri: "geo:52,3,4,5;crs=wgs84;u=2.5", lat: 52.3, long: 4.5, uncertainty: 2.5},
+		{name: "Comma decimals with comma in parameter", uri: "geo:52,3,4,5;u=2,5", wantErr: true},
+
+		{name: "Four components mixing periods and commas", uri: "geo:52,3,4.5,6", wantErr: true},
+		{name: "Five components", uri: "geo:52,3,4,5,6", wantErr: true},
+		{name: "Comma decimal with non-numeric part", uri: "geo:52,3,4,x", wantErr: true},
+		{name: "Comma decimal latitude out of range", uri: "geo:95,3,4,5", wantErr: true},
+	})
+}
+
+var testPDF = []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n")
+
+// convertTestMessage runs a Matrix message through ToWhatsApp, serving data as the media of the message.
+func convertTestMessage(t *testing.T, mc *MessageConverter, content *event.MessageEventContent, data []byte) waConsumerApplication.ConsumerApplication_Content_Content {
+	t.Helper()
+	if data != nil {
+		content.URL = "mxc://example.com/media"
+		mc.MediaDownloader = fixtureDownloader{content.URL: data}
+		mc.MediaUploader = HashMediaUploader{DirectPath: testDirectPath}
+	}
+	evt := &event.Event{
+		Type:    event.EventMessage,
+		Sender:  "@alice:example.com",
+		ID:      "$message",
+		Content: event.Content{Parsed: content, Raw: map[string]any{}},
+	}
+	waMsg, _, err := mc.ToWhatsApp(context.Background(), evt, content, false)
+	if err != nil {
+		t.Fatalf("failed to convert message: %v", err)
+	}
+	return waMsg.GetPayload().GetContent().GetContent()
+}
+
+// testCaption returns the caption of a converted image or video message. Documents don't have captions,
+// so their file name is returned as the caption text.
+func testCaption(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) *waCommon.MessageText {
+	t.Helper()
+	switch msg := output.(type) {
+	case *waConsumerApplication.ConsumerApplication_Content_ImageMessage:
+		return msg.ImageMessage.GetCaption()
+	case *waConsumerApplication.ConsumerApplication_Content_VideoMessage:
+		return msg.VideoMessage.GetCaption()
+	case *waConsumerApplication.ConsumerApplication_Content_DocumentMessage:
+		return &waCommon.MessageText{Text: msg.DocumentMessage.GetFileName()}
+	default:
+		t.Fatalf("unexpected message type %T", output)
+		return nil
+	}
+}
+
+// testMediaMimetype returns the mimetype of the media in a converted message.
+func testMediaMimetype(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) string {
+	t.Helper()
+	var transport *waMediaTransport.WAMediaTransport
+	var err error
+	switch msg := output.(type) {
+	case *waConsumerApplication.ConsumerApplication_Content_ImageMessage:
+		var image *waMediaTransport.ImageTransport
+		image, err = msg.ImageMessage.Decode()
+		transport = image.GetIntegral().GetTransport()
+	case *waConsumerApplication.ConsumerApplication_Content_VideoMessage:
+		var video *waMediaTransport.VideoTransport
+		video, err = msg.VideoMessage.Decode()
+		transport = video.GetIntegral().GetTransport()
+	case *waConsumerApplication.ConsumerApplication_Content_AudioMessage:
+		var audio *waMediaTransport.AudioTransport
+		audio, err = msg.AudioMessage.Decode()
+		transport = audio.GetIntegral().GetTransport()
+	case *waConsumerApplication.ConsumerApplication_Content_DocumentMessage:
+		var document *waMediaTransport.DocumentTransport
+		document, err = msg.DocumentMessage.Decode()
+		transport = document.GetIntegral().GetTransport()
+	case *waConsumerApplication.ConsumerApplication_Content_StickerMessage:
+		var sticker *waMediaTransport.StickerTransport
+		sticker, err = msg.StickerMessage.Decode()
+		transport = sticker.GetIntegral().GetTransport()
+	default:
+		t.Fatalf("unexpected message type %T", output)
+	}
+	if err != nil {
+		t.Fatalf("failed to decode media transport: %v", err)
+	}
+	return transport.GetAncillary().GetMimetype()
+}
+
+func newTestMediaContent(t *testing.T, msgType event.MessageType, body, fileName string) (*event.MessageEventContent, []byte) {
+	t.Helper()
+	content := &event.MessageEventContent{MsgType: msgType, Body: body, FileName: fileName}
+	switch msgType {
+	case event.MsgImage:
+		content.Info = &event.FileInfo{MimeType: "image/png"}
+		return content, encodeTestPNG(t, 64, 64)
+	case event.MsgVideo:
+		content.Info = &event.FileInfo{MimeType: "video/mp4", Width: 64, Height: 64, Duration: 1000}
+		return content, []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+	default:
+		content.Info = &event.FileInfo{MimeType: "application/pdf"}
+		return content, testPDF
+	}
+}
+
+func TestMediaCaptionWhitespace(t *testing.T) {
+	tests := []struct {
+		msgType  event.MessageType
+		fileName string
+		want     string
+	}{
+		{msgType: event.MsgImage, fileName: "image.png"},
+		{msgType: event.MsgVideo, fileName: "video.mp4"},
+		{msgType: event.MsgFile, fileName: "document.pdf", want: "document.pdf"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.msgType), func(t *testing.T) {
+			content, data := newTestMediaContent(t, test.msgType, "  \n\n \t\n ", test.fileName)
+			mc := &MessageConverter{PortalMethods: newTestPortal()}
+			caption := testCaption(t, convertTestMessage(t, mc, content, data))
+			if caption == nil {
+				t.Fatal("caption is nil, want an empty caption")
+			} else if caption.GetText() != test.want {
+				t.Errorf("caption = %q, want %q", caption.GetText(), test.want)
+			}
+		})
+	}
+}
+
+func TestTrimMessageText(t *testing.T) {
+	text := &waCommon.MessageText{
+		Text: "\n 👍 hi @room \n",
+		Commands: []*waCommon.Command{{
+			CommandType: waCommon.Command_EVERYONE,
+			Offset:      uint32(len(NewUTF16String("\n 👍 hi "))),
+			Length:      5,
+		}},
+	}
+	trimMessageText(text)
+	if text.Text != "👍 hi @room" {
+		t.Errorf("trimmed text = %q, want %q", text.Text, "👍 hi @room")
+	}
+	if offset := text.Commands[0].Offset; offset != uint32(len(NewUTF16String("👍 hi "))) {
+		t.Errorf("room mention offset = %d after trimming, want %d", offset, len(NewUTF16String("👍 hi ")))
+	}
+}
+
+func TestFormattedImageCaption(t *testing.T) {
+	content, data := newTestMediaContent(t, event.MsgImage, "bold and italic", "image.png")
+	content.Format = event.FormatHTML
+	content.FormattedBody = "<b>bold</b> and <i>italic</i>"
+	mc := &MessageConverter{PortalMethods: newTestPortal()}
+	caption := testCaption(t, convertTestMessage(t, mc, content, data))
+	if want := "*bold* and _italic_"; caption.GetText() != want {
+		t.Errorf("caption = %q, want %q", caption.GetText(), want)
+	}
+}
+
+func TestImageCaptionMentions(t *testing.T) {
+	content, data := newTestMediaContent(t, event.MsgImage, "hi Alice", "image.png")
+	content.Format = event.FormatHTML
+	content.FormattedBody = `hi <a href="https://matrix.to/#/@alice:example.com">Alice</a>`
+	portal := newTestPortal()
+	portal.metaIDs["@alice:example.com"] = 1001
+	mc := &MessageConverter{PortalMethods: portal}
+	caption := testCaption(t, convertTestMessage(t, mc, content, data))
+	wantJID := mc.UserJID(context.Background(), 1001).String()
+	if caption.GetText() != "hi @1001" {
+		t.Errorf("caption = %q, want %q", caption.GetText(), "hi @1001")
+	}
+	if jids := caption.GetMentionedJID(); len(jids) != 1 || jids[0] != wantJID {
+		t.Errorf("caption mentions = %v, want [%s]", jids, wantJID)
+	}
+}
+
+func TestMediaWithoutInfo(t *testing.T) {
+	tests := []struct {
+		msgType  event.MessageType
+		data     []byte
+		mimeType string
+	}{
+		{msgType: event.MsgImage, data: encodeTestPNG(t, 64, 32), mimeType: "image/png"},
+		{msgType: event.MsgVideo, data: []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), mimeType: "video/mp4"},
+		{msgType: event.MsgAudio, data: []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), mimeType: "audio/mpeg"},
+		{msgType: event.MsgFile, data: testPDF, mimeType: "application/pdf"},
+		{msgType: event.MessageType(event.EventSticker.Type), data: encodeTestPNG(t, 64, 32), mimeType: "image/png"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.msgType), func(t *testing.T) {
+			content := &event.MessageEventContent{MsgType: test.msgType, Body: "media"}
+			mc := &MessageConverter{PortalMethods: newTestPortal()}
+			output := convertTestMessage(t, mc, content, test.data)
+			// The mimetype is sniffed from the data when the event doesn't declare one
+			if mimeType := testMediaMimetype(t, output); mimeType != test.mimeType {
+				t.Errorf("mimetype = %q, want %q", mimeType, test.mimeType)
+			}
+			if msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_ImageMessage); ok {
+				transport, _ := msg.ImageMessage.Decode()
+				if w, h := transport.GetAncillary().GetWidth(), transport.GetAncillary().GetHeight(); w != 64 || h != 32 {
+					t.Errorf("image dimensions = %dx%d, want 64x32 from the file", w, h)
+				}
+			}
+		})
+	}
+}
+
+func TestClampThumbnailSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxDimension  int
+		width, height int
+		wantW, wantH  int
+	}{
+		{name: "Default landscape", width: 1600, height: 900, wantW: 400, wantH: 225},
+		{name: "Default portrait", width: 900, height: 1600, wantW: 225, wantH: 400},
+		{name: "Default square", width: 1000, height: 1000, wantW: 400, wantH: 400},
+		{name: "Default small image isn't scaled up", width: 120, height: 80, wantW: 120, wantH: 80},
+		{name: "Default zero dimensions", width: 0, height: 0, wantW: 0, wantH: 0},
+		{name: "Negative max uses default", maxDimension: -1, width: 1600, height: 900, wantW: 400, wantH: 225},
+		{name: "Configured landscape", maxDimension: 640, width: 1600, height: 900, wantW: 640, wantH: 360},
+		{name: "Configured portrait", maxDimension: 640, width: 900, height: 1600, wantW: 360, wantH: 640},
+		{name: "Configured square", maxDimension: 640, width: 1000, height: 1000, wantW: 640, wantH: 640},
+		{name: "Configured larger than image", maxDimension: 640, width: 500, height: 300, wantW: 500, wantH: 300},
+		{name: "Configured zero dimensions", maxDimension: 640, width: 0, height: 0, wantW: 0, wantH: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mc := &MessageConverter{MaxThumbnailDimension: test.maxDimension}
+			w, h := mc.clampThumbnailSize(test.width, test.height)
+			if w != test.wantW || h != test.wantH {
+				t.Errorf("clampThumbnailSize(%d, %d) = %dx%d, want %dx%d", test.width, test.height, w, h, test.wantW, test.wantH)
+			}
+		})
+	}
+}
+
+func TestUnknownImageSizeThumbnailFallback(t *testing.T) {
+	for maxDimension, want := range map[int]uint32{0: 400, 640: 640} {
+		content := &event.MessageEventContent{MsgType: event.MsgImage, Body: "photo.avif", Info: &event.FileInfo{MimeType: "image/avif"}}
+		mc := &MessageConverter{PortalMethods: newTestPortal(), MaxThumbnailDimension: maxDimension}
+		output := convertTestMessage(t, mc, content, testAVIF)
+		msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_ImageMessage)
+		if !ok {
+			t.Fatalf("expected an image message, got %T", output)
+		}
+		transport, err := msg.ImageMessage.Decode()
+		if err != nil {
+			t.Fatalf("failed to decode image transport: %v", err)
+		}
+		thumb := transport.GetIntegral().GetTransport().GetAncillary().GetThumbnail()
+		if w, h := thumb.GetThumbnailWidth(), thumb.GetThumbnailHeight(); w != want || h != want {
+			t.Errorf("thumbnail dimensions with max %d = %dx%d, want %dx%d", maxDimension, w, h, want, want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow"
+)
+
+const uploadRetryInitialDelay = 1 * time.Second
+
+var uploadStatusCodeRegex = regexp.MustCompile(`upload failed with status code (\d+)`)
+
+// isTransientUploadError checks whether an upload error is likely to go away by retrying,
+// i.e. it's a network error or a server-side error rather than the media being rejected.
+func isTransientUploadError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// whatsmeow doesn't return typed errors for HTTP status codes, so parse the message
+	if match := uploadStatusCodeRegex.FindStringSubmatch(err.Error()); match != nil {
+		statusCode, _ := strconv.Atoi(match[1])
+		return statusCode >= 500 || statusCode == 429 || statusCode == 408
+	}
+	return false
+}
+
+type contextKey int
+
+const contextKeyDryRun contextKey = iota
+
+// DryRunDirectPath is the direct path of the placeholder transports created in dry run mode.
+const DryRunDirectPath = "/dry-run"
+
+// WithDryRun returns a context in which converting messages to WhatsApp doesn't upload any media.
+// Media messages get placeholder transports instead, so messages converted in dry run mode must never be sent.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKeyDryRun, true)
+}
+
+// IsDryRun checks whether the context was created with WithDryRun.
+func IsDryRun(ctx context.Context) bool {
+	isDryRun, _ := ctx.Value(contextKeyDryRun).(bool)
+	return isDryRun
+}
+
+func dryRunUpload(data []byte) whatsmeow.UploadResponse {
+	resp, _ := HashMediaUploader{DirectPath: DryRunDirectPath}.Upload(context.Background(), data, "")
+	resp.ObjectID = "dry-run"
+	return resp
+}
+
+// MediaUploader uploads media to WhatsApp. *whatsmeow.Client implements it, but a different
+// implementation can be set in MessageConverter.MediaUploader, e.g. to test the conversion
+// pipeline without a connection.
+type MediaUploader interface {
+	Upload(ctx context.Context, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+}
+
+// HashMediaUploader is a MediaUploader that doesn't upload anything. All fields of the response are
+// derived from the data, so the output of the converter is deterministic.
+type HashMediaUploader struct {
+	DirectPath string
+}
+
+var _ MediaUploader = HashMediaUploader{}
+var _ MediaUploader = (*whatsmeow.Client)(nil)
+
+func (u HashMediaUploader) Upload(_ context.Context, data []byte, _ whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	hash := sha256.Sum256(data)
+	return whatsmeow.UploadResponse{
+		DirectPath:    u.DirectPath,
+		ObjectID:      hex.EncodeToString(hash[:8]),
+		MediaKey:      make([]byte, 32),
+		FileEncSHA256: hash[:],
+		FileSHA256:    hash[:],
+		FileLength:    uint64(len(data)),
+	}, nil
+}
+
+func (mc *MessageConverter) mediaUploader(ctx context.Context) MediaUploader {
+	if mc.MediaUploader != nil {
+		return mc.MediaUploader
+	}
+	return mc.GetE2EEClient(ctx)
+}
+
+// UploadAttemptFunc is called when an attempt to upload media to WhatsApp starts, with the zero-based attempt
+// number and the size of the upload. The returned function is called with the result when the attempt finishes.
+// whatsmeow uploads the whole file in one request, so there's no progress to report in between.
+type UploadAttemptFunc func(ctx context.Context, attempt int, size int64) (finished func(err error))
+
+func (mc *MessageConverter) startUploadAttempt(ctx context.Context, attempt int, size int64) func(err error) {
+	if mc.UploadAttempt == nil {
+		return func(error) {}
+	}
+	return mc.UploadAttempt(ctx, attempt, size)
+}
+
+type MediaPresenceState int
+
+const (
+	MediaPresenceDone MediaPresenceState = iota
+	MediaPresenceUploading
+	MediaPresenceRecording
+)
+
+// MediaPresenceFunc is called when the converter starts processing media for WhatsApp, with
+// MediaPresenceRecording for voice messages and MediaPresenceUploading for everything else.
+// It's called again with MediaPresenceDone when the processing finishes, whether it succeeded or not.
+type MediaPresenceFunc func(ctx context.Context, state MediaPresenceState)
+
+// startMediaPresence signals the start of media processing and returns a function that clears the presence.
+func (mc *MessageConverter) startMediaPresence(ctx context.Context, isVoice bool) func() {
+	if mc.MediaPresence == nil {
+		return func() {}
+	}
+	state := MediaPresenceUploading
+	if isVoice {
+		state = MediaPresenceRecording
+	}
+	mc.MediaPresence(ctx, state)
+	return func() {
+		mc.MediaPresence(ctx, MediaPresenceDone)
+	}
+}
+
+// uploadWithRetry uploads media to WhatsApp, retrying transient failures with exponential backoff.
+func (mc *MessageConverter) uploadWithRetry(ctx context.Context, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	if IsDryRun(ctx) {
+		return dryRunUpload(data), nil
+	}
+	delay := uploadRetryInitialDelay
+	for attempt := 0; ; attempt++ {
+		finished := mc.startUploadAttempt(ctx, attempt, int64(len(data)))
+		resp, err := mc.mediaUploader(ctx).Upload(ctx, data, mediaType)
+		finished(err)
+		if err == nil || attempt >= mc.MediaUploadRetries || !isTransientUploadError(err) {
+			return resp, err
+		}
+		zerolog.Ctx(ctx).Debug().Err(err).
+			Int("attempt", attempt+1).
+			Stringer("retry_in", delay).
+			Msg("Media upload failed, retrying")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		}
+		delay *= 2
+	}
+}
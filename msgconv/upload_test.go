@@ -0,0 +1,322 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"go.mau.fi/whatsmeow/binary/armadillo/waMediaTransport"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const testDirectPath = "/test/direct-path"
+
+type fixtureDownloader map[id.ContentURIString][]byte
+
+func (fd fixtureDownloader) DownloadMatrixMedia(_ context.Context, uri id.ContentURIString) ([]byte, error) {
+	data, ok := fd[uri]
+	if !ok {
+		return nil, ErrMediaDownloadFailed
+	}
+	return data, nil
+}
+
+func encodeTestGIF(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	palette := color.Palette{color.Black, color.White}
+	frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+	err := gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+	if err != nil {
+		t.Fatalf("failed to encode test GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+type mediaPipelineTest struct {
+	name     string
+	content  *event.MessageEventContent
+	extra    map[string]any
+	data     []byte
+	disable  bool
+	mimeType string
+	thumbW   uint32
+	thumbH   uint32
+	check    func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content)
+}
+
+// convertTestMedia runs a Matrix media event through the reupload and wrapping steps of ToWhatsApp.
+func convertTestMedia(t *testing.T, test mediaPipelineTest) (*waMediaTransport.WAMediaTransport, waConsumerApplication.ConsumerApplication_Content_Content) {
+	t.Helper()
+	portal := newTestPortal()
+	portal.data.DisableTranscoding = test.disable
+	test.content.URL = "mxc://example.com/" + id.ContentURIString(test.name)
+	mc := &MessageConverter{
+		PortalMethods:   portal,
+		MediaDownloader: fixtureDownloader{test.content.URL: test.data},
+		MediaUploader:   HashMediaUploader{DirectPath: testDirectPath},
+	}
+	raw := map[string]any{}
+	for key, value := range test.extra {
+		raw[key] = value
+	}
+	evt := &event.Event{
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: test.content, Raw: raw},
+	}
+	ctx := context.Background()
+	reuploaded, fileName, err := mc.reuploadMediaToWhatsApp(ctx, evt, test.content)
+	if err != nil {
+		t.Fatalf("failed to reupload media: %v", err)
+	}
+	output, err := mc.wrapWhatsAppMedia(evt, test.content, reuploaded, nil, fileName)
+	if err != nil {
+		t.Fatalf("failed to wrap media: %v", err)
+	}
+	return reuploaded, output
+}
+
+func TestMediaPipelineHashUploader(t *testing.T) {
+	tests := []mediaPipelineTest{{
+		name:     "image",
+		content:  &event.MessageEventContent{MsgType: event.MsgImage, Body: "image.png", Info: &event.FileInfo{MimeType: "image/png"}},
+		data:     encodeTestPNG(t, 800, 400),
+		mimeType: "image/png",
+		thumbW:   400,
+		thumbH:   200,
+		check: func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) {
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_ImageMessage)
+			if !ok {
+				t.Fatalf("expected an image message, got %T", output)
+			}
+			transport, err := msg.ImageMessage.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode image transport: %v", err)
+			}
+			if w, h := transport.GetAncillary().GetWidth(), transport.GetAncillary().GetHeight(); w != 800 || h != 400 {
+				t.Errorf("image dimensions = %dx%d, want 800x400", w, h)
+			}
+		},
+	}, {
+		name: "video",
+		content: &event.MessageEventContent{MsgType: event.MsgVideo, Body: "video.mp4", Info: &event.FileInfo{
+			MimeType: "video/mp4", Width: 1280, Height: 720, Duration: 5000,
+		}},
+		data:     []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"),
+		mimeType: "video/mp4",
+		thumbW:   400,
+		thumbH:   225,
+		check: func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) {
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_VideoMessage)
+			if !ok {
+				t.Fatalf("expected a video message, got %T", output)
+			}
+			transport, err := msg.VideoMessage.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode video transport: %v", err)
+			}
+			anc := transport.GetAncillary()
+			if anc.GetWidth() != 1280 || anc.GetHeight() != 720 || anc.GetSeconds() != 5 {
+				t.Errorf("video info = %dx%d %ds, want 1280x720 5s", anc.GetWidth(), anc.GetHeight(), anc.GetSeconds())
+			}
+			if anc.GetGifPlayback() {
+				t.Error("normal video was sent with GIF playback")
+			}
+		},
+	}, {
+		name:     "gif-transcoding-disabled",
+		content:  &event.MessageEventContent{MsgType: event.MsgImage, Body: "image.gif", Info: &event.FileInfo{MimeType: "image/gif"}},
+		data:     encodeTestGIF(t, 120, 60),
+		disable:  true,
+		mimeType: "image/gif",
+		thumbW:   120,
+		thumbH:   60,
+		check: func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) {
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_VideoMessage)
+			if !ok {
+				t.Fatalf("expected a video message, got %T", output)
+			}
+			transport, err := msg.VideoMessage.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode video transport: %v", err)
+			}
+			if !transport.GetAncillary().GetGifPlayback() {
+				t.Error("GIF was sent without GIF playback")
+			}
+		},
+	}, {
+		name:     "voice",
+		content:  &event.MessageEventContent{MsgType: event.MsgAudio, Body: "voice.ogg", Info: &event.FileInfo{MimeType: "audio/ogg", Duration: 3000}},
+		extra:    map[string]any{"org.matrix.msc3245.voice": map[string]any{}},
+		data:     []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00OpusHead"),
+		mimeType: "audio/ogg",
+		check: func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) {
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_AudioMessage)
+			if !ok {
+				t.Fatalf("expected an audio message, got %T", output)
+			}
+			if !msg.AudioMessage.GetPTT() {
+				t.Error("voice message wasn't sent as PTT")
+			}
+			transport, err := msg.AudioMessage.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode audio transport: %v", err)
+			}
+			if seconds := transport.GetAncillary().GetSeconds(); seconds != 3 {
+				t.Errorf("audio duration = %ds, want 3s", seconds)
+			}
+		},
+	}, {
+		name:     "audio",
+		content:  &event.MessageEventContent{MsgType: event.MsgAudio, Body: "song.mp3", Info: &event.FileInfo{MimeType: "audio/mpeg", Duration: 61000}},
+		data:     []byte("ID3\x04\x00\x00\x00\x00\x00\x00"),
+		mimeType: "audio/mpeg",
+		check: func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) {
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_AudioMessage)
+			if !ok {
+				t.Fatalf("expected an audio message, got %T", output)
+			}
+			if msg.AudioMessage.GetPTT() {
+				t.Error("normal audio was sent as PTT")
+			}
+		},
+	}, {
+		name:     "file",
+		content:  &event.MessageEventContent{MsgType: event.MsgFile, Body: "report.pdf", Info: &event.FileInfo{MimeType: "application/pdf"}},
+		data:     testPDF,
+		mimeType: "application/pdf",
+		check: func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) {
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_DocumentMessage)
+			if !ok {
+				t.Fatalf("expected a document message, got %T", output)
+			}
+			if name := msg.DocumentMessage.GetFileName(); name != "report.pdf" {
+				t.Errorf("file name = %q, want report.pdf", name)
+			}
+			transport, err := msg.DocumentMessage.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode document transport: %v", err)
+			}
+			if pages := transport.GetAncillary().GetPageCount(); pages != 1 {
+				t.Errorf("page count = %d, want 1", pages)
+			}
+		},
+	}, {
+		name:     "sticker",
+		content:  &event.MessageEventContent{MsgType: event.MessageType(event.EventSticker.Type), Body: "sticker", Info: &event.FileInfo{MimeType: "image/webp"}},
+		data:     []byte("RIFF\x16\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\x2b\x01\x00\xc7\x00\x00"),
+		mimeType: "image/webp",
+		thumbW:   300,
+		thumbH:   200,
+		check: func(t *testing.T, output waConsumerApplication.ConsumerApplication_Content_Content) {
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_StickerMessage)
+			if !ok {
+				t.Fatalf("expected a sticker message, got %T", output)
+			}
+			transport, err := msg.StickerMessage.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode sticker transport: %v", err)
+			}
+			if !transport.GetIntegral().GetIsAnimated() {
+				t.Error("animated sticker wasn't marked as animated")
+			}
+			if w, h := transport.GetAncillary().GetWidth(), transport.GetAncillary().GetHeight(); w != 300 || h != 200 {
+				t.Errorf("sticker dimensions = %dx%d, want 300x200", w, h)
+			}
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reuploaded, output := convertTestMedia(t, test)
+			hash := sha256.Sum256(test.data)
+			integral, anc := reuploaded.GetIntegral(), reuploaded.GetAncillary()
+			if integral.GetDirectPath() != testDirectPath {
+				t.Errorf("direct path = %q, want %q", integral.GetDirectPath(), testDirectPath)
+			}
+			if !bytes.Equal(integral.GetFileSHA256(), hash[:]) {
+				t.Errorf("file SHA256 = %x, want %x", integral.GetFileSHA256(), hash)
+			}
+			if anc.GetFileLength() != uint64(len(test.data)) {
+				t.Errorf("file length = %d, want %d", anc.GetFileLength(), len(test.data))
+			}
+			if anc.GetMimetype() != test.mimeType {
+				t.Errorf("mimetype = %q, want %q", anc.GetMimetype(), test.mimeType)
+			}
+			thumb := anc.GetThumbnail()
+			if thumb.GetThumbnailWidth() != test.thumbW || thumb.GetThumbnailHeight() != test.thumbH {
+				t.Errorf("thumbnail dimensions = %dx%d, want %dx%d", thumb.GetThumbnailWidth(), thumb.GetThumbnailHeight(), test.thumbW, test.thumbH)
+			}
+			test.check(t, output)
+		})
+	}
+}
+
+type flakyUploader struct {
+	failures int
+}
+
+func (fu *flakyUploader) Upload(ctx context.Context, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	if fu.failures > 0 {
+		fu.failures--
+		return whatsmeow.UploadResponse{}, errors.New("upload failed with status code 503")
+	}
+	return HashMediaUploader{DirectPath: testDirectPath}.Upload(ctx, data, mediaType)
+}
+
+func TestUploadWithRetryReportsAttempts(t *testing.T) {
+	type attempt struct {
+		number int
+		size   int64
+		err    error
+	}
+	var attempts []attempt
+	mc := &MessageConverter{
+		PortalMethods:      newTestPortal(),
+		MediaUploader:      &flakyUploader{failures: 1},
+		MediaUploadRetries: 2,
+		UploadAttempt: func(ctx context.Context, number int, size int64) func(err error) {
+			return func(err error) {
+				attempts = append(attempts, attempt{number, size, err})
+			}
+		},
+	}
+	resp, err := mc.uploadWithRetry(context.Background(), []byte("hello"), whatsmeow.MediaImage)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	} else if resp.DirectPath != testDirectPath {
+		t.Errorf("direct path = %q, want %q", resp.DirectPath, testDirectPath)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("got %d attempts, want 2", len(attempts))
+	}
+	if attempts[0].number != 0 || attempts[0].size != 5 || attempts[0].err == nil {
+		t.Errorf("unexpected first attempt %+v", attempts[0])
+	}
+	if attempts[1].number != 1 || attempts[1].size != 5 || attempts[1].err != nil {
+		t.Errorf("unexpected second attempt %+v", attempts[1])
+	}
+}
@@ -0,0 +1,162 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"go.mau.fi/whatsmeow/binary/armadillo/waMediaTransport"
+	"maunium.net/go/mautrix/event"
+)
+
+type vCardContact struct {
+	Raw          string
+	DisplayName  string
+	PhoneNumbers []string
+}
+
+func isVCardFile(content *event.MessageEventContent) bool {
+	if content.MsgType != event.MsgFile {
+		return false
+	}
+	switch strings.ToLower(content.GetInfo().MimeType) {
+	case "text/vcard", "text/x-vcard", "text/directory":
+		return true
+	}
+	return strings.EqualFold(filepath.Ext(mediaFileName(content)), ".vcf")
+}
+
+// parseVCards extracts the display name and phone numbers from each vCard in the given data.
+func parseVCards(data string) ([]vCardContact, error) {
+	// Unfold continuation lines as specified in RFC 6350 section 3.2
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var contacts []vCardContact
+	var current *vCardContact
+	var raw strings.Builder
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, _, _ = strings.Cut(strings.ToUpper(key), ";")
+		if dot := strings.LastIndexByte(key, '.'); dot >= 0 {
+			key = key[dot+1:]
+		}
+		if key == "BEGIN" && strings.EqualFold(value, "VCARD") {
+			current = &vCardContact{}
+			raw.Reset()
+		}
+		if current == nil {
+			continue
+		}
+		raw.WriteString(line)
+		raw.WriteString("\n")
+		switch key {
+		case "FN":
+			current.DisplayName = value
+		case "TEL":
+			value = strings.TrimPrefix(value, "tel:")
+			if value != "" {
+				current.PhoneNumbers = append(current.PhoneNumbers, value)
+			}
+		case "END":
+			if strings.EqualFold(value, "VCARD") {
+				current.Raw = raw.String()
+				if current.DisplayName == "" && len(current.PhoneNumbers) == 0 {
+					return nil, fmt.Errorf("vCard doesn't have a name or phone number")
+				}
+				contacts = append(contacts, *current)
+				current = nil
+			}
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("vCard is missing END line")
+	} else if len(contacts) == 0 {
+		return nil, fmt.Errorf("no vCards found")
+	}
+	return contacts, nil
+}
+
+func makeWhatsAppContact(displayName, vcard string) (*waConsumerApplication.ConsumerApplication_ContactMessage, error) {
+	contactMsg := &waConsumerApplication.ConsumerApplication_ContactMessage{}
+	err := contactMsg.Set(&waMediaTransport.ContactTransport{
+		Integral: &waMediaTransport.ContactTransport_Integral{
+			Contact: &waMediaTransport.ContactTransport_Integral_Vcard{Vcard: vcard},
+		},
+		Ancillary: &waMediaTransport.ContactTransport_Ancillary{
+			DisplayName: displayName,
+		},
+	})
+	return contactMsg, err
+}
+
+// VCardToWhatsApp converts a vCard file into a contact message. Contacts with multiple phone numbers
+// are split into a contact array with one entry per phone number.
+func (mc *MessageConverter) VCardToWhatsApp(ctx context.Context, content *event.MessageEventContent) (waConsumerApplication.ConsumerApplication_Content_Content, error) {
+	data, _, _, err := mc.downloadMatrixMedia(ctx, content)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := parseVCards(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(contacts) == 1 && len(contacts[0].PhoneNumbers) <= 1 {
+		contactMsg, err := makeWhatsAppContact(contacts[0].DisplayName, contacts[0].Raw)
+		if err != nil {
+			return nil, err
+		}
+		return &waConsumerApplication.ConsumerApplication_Content_ContactMessage{ContactMessage: contactMsg}, nil
+	}
+	arrayMsg := &waConsumerApplication.ConsumerApplication_ContactsArrayMessage{
+		DisplayName: contacts[0].DisplayName,
+	}
+	for _, contact := range contacts {
+		if len(contact.PhoneNumbers) <= 1 {
+			contactMsg, err := makeWhatsAppContact(contact.DisplayName, contact.Raw)
+			if err != nil {
+				return nil, err
+			}
+			arrayMsg.Contacts = append(arrayMsg.Contacts, contactMsg)
+			continue
+		}
+		for _, phoneNumber := range contact.PhoneNumbers {
+			vcard := fmt.Sprintf("BEGIN:VCARD\nVERSION:3.0\nFN:%s\nTEL:%s\nEND:VCARD\n", contact.DisplayName, phoneNumber)
+			contactMsg, err := makeWhatsAppContact(contact.DisplayName, vcard)
+			if err != nil {
+				return nil, err
+			}
+			arrayMsg.Contacts = append(arrayMsg.Contacts, contactMsg)
+		}
+	}
+	if len(contacts) > 1 {
+		arrayMsg.DisplayName = fmt.Sprintf("%d contacts", len(contacts))
+	}
+	return &waConsumerApplication.ConsumerApplication_Content_ContactsArrayMessage{ContactsArrayMessage: arrayMsg}, nil
+}
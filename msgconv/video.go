@@ -0,0 +1,60 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ffmpeg"
+)
+
+// ensureAudioTrack adds a silent audio track to videos that don't have one, as some Meta clients fail to
+// play them. The video stream is copied as-is if possible. Any errors are logged and the original video
+// is returned, since the video may still be playable without an audio track.
+func (mc *MessageConverter) ensureAudioTrack(ctx context.Context, data []byte, mimeType, fileName string) ([]byte, string, string) {
+	if !mc.FFmpegAvailable {
+		return data, mimeType, fileName
+	}
+	log := zerolog.Ctx(ctx)
+	hasAudio, err := probeHasAudioStream(ctx, data, mimeType)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to check if video has an audio track")
+		return data, mimeType, fileName
+	} else if hasAudio {
+		return data, mimeType, fileName
+	}
+	log.Debug().Msg("Adding silent audio track to video")
+	inputArgs := []string{"-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=44100"}
+	outputArgs := []string{"-map", "1:v:0", "-map", "0:a:0", "-c:v", "copy", "-c:a", "aac", "-shortest", "-movflags", "+faststart"}
+	converted, err := ffmpeg.ConvertBytes(ctx, data, ".mp4", inputArgs, outputArgs, mimeType)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to add silent audio track to video")
+		return data, mimeType, fileName
+	}
+	if mimeType != "video/mp4" {
+		fileName += ".mp4"
+	}
+	return converted, "video/mp4", fileName
+}
+
+// convertAnimatedWebP converts an animated WebP image into an mp4 that can be sent as a GIF. The output
+// args for GIFs are reused, as the input args are specific to the GIF demuxer.
+func (mc *MessageConverter) convertAnimatedWebP(ctx context.Context, data []byte) ([]byte, error) {
+	_, outputArgs := mc.gifConvertArgs(ctx)
+	return ffmpeg.ConvertBytes(ctx, data, ".mp4", []string{}, outputArgs, "image/webp")
+}
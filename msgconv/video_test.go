@@ -0,0 +1,179 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/ffmpeg"
+	"go.mau.fi/whatsmeow/binary/armadillo/waConsumerApplication"
+	"maunium.net/go/mautrix/event"
+)
+
+// The 1x1 lossless WebP images used by Modernizr for detecting WebP support
+var (
+	testStaticWebP   = mustDecodeBase64("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+	testAnimatedWebP = mustDecodeBase64("UklGRlIAAABXRUJQVlA4WAoAAAASAAAAAAAAAAAAQU5JTQYAAAD/////AABBTk1GJgAAAAAAAAAAAAAAAAAAAGQAAABWUDhMDQAAAC8AAAAQBxAREYiI/gcA")
+)
+
+func mustDecodeBase64(data string) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		panic(err)
+	}
+	return decoded
+}
+
+func TestIsAnimatedWebP(t *testing.T) {
+	if !isAnimatedWebP(testAnimatedWebP) {
+		t.Error("animated WebP wasn't detected as animated")
+	}
+	if isAnimatedWebP(testStaticWebP) {
+		t.Error("static WebP was detected as animated")
+	}
+	if isAnimatedWebP(encodeTestGIF(t, 4, 4)) {
+		t.Error("GIF was detected as an animated WebP")
+	}
+}
+
+func TestAnimatedWebPImage(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		ffmpeg        bool
+		disable       bool
+		wantConverted bool
+	}{
+		{name: "Static", data: testStaticWebP, ffmpeg: true},
+		{name: "Animated without ffmpeg", data: testAnimatedWebP},
+		{name: "Animated with transcoding disabled", data: testAnimatedWebP, ffmpeg: true, disable: true},
+		{name: "Animated", data: testAnimatedWebP, ffmpeg: true, wantConverted: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.wantConverted && !ffmpeg.Supported() {
+				t.Skip("ffmpeg isn't installed")
+			}
+			portal := newTestPortal()
+			portal.data.DisableTranscoding = test.disable
+			mc := &MessageConverter{PortalMethods: portal, FFmpegAvailable: test.ffmpeg}
+			content := &event.MessageEventContent{MsgType: event.MsgImage, Body: "image.webp", Info: &event.FileInfo{MimeType: "image/webp"}}
+			output := convertTestMessage(t, mc, content, test.data)
+			if test.wantConverted {
+				msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_VideoMessage)
+				if !ok {
+					t.Fatalf("expected a video message, got %T", output)
+				}
+				transport, err := msg.VideoMessage.Decode()
+				if err != nil {
+					t.Fatalf("failed to decode video transport: %v", err)
+				}
+				if !transport.GetAncillary().GetGifPlayback() {
+					t.Error("converted WebP doesn't have GIF playback enabled")
+				}
+				if mime := transport.GetIntegral().GetTransport().GetAncillary().GetMimetype(); mime != "video/mp4" {
+					t.Errorf("mimetype = %q, want video/mp4", mime)
+				}
+				return
+			}
+			msg, ok := output.(*waConsumerApplication.ConsumerApplication_Content_ImageMessage)
+			if !ok {
+				t.Fatalf("expected an image message, got %T", output)
+			}
+			transport, err := msg.ImageMessage.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode image transport: %v", err)
+			}
+			media := transport.GetIntegral().GetTransport()
+			hash := sha256.Sum256(test.data)
+			if mime := media.GetAncillary().GetMimetype(); mime != "image/webp" {
+				t.Errorf("mimetype = %q, want image/webp", mime)
+			}
+			if string(media.GetIntegral().GetFileSHA256()) != string(hash[:]) {
+				t.Error("WebP image was modified before upload")
+			}
+		})
+	}
+}
+
+// encodeSilentTestVideo generates a two second mp4 video that has no audio track.
+func encodeSilentTestVideo(t *testing.T) []byte {
+	t.Helper()
+	if !ffmpeg.Supported() {
+		t.Skip("ffmpeg isn't installed")
+	} else if _, err := exec.LookPath("ffprobe"); err != nil {
+		t.Skip("ffprobe isn't installed")
+	}
+	path := filepath.Join(t.TempDir(), "silent.mp4")
+	cmd := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", "color=c=black:s=64x64:d=2", "-an", "-c:v", "mpeg4", path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate silent video: %v (%s)", err, output)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read silent video: %v", err)
+	}
+	return data
+}
+
+func TestEnsureAudioTrackFallback(t *testing.T) {
+	data := []byte("not a video")
+	for name, mc := range map[string]*MessageConverter{
+		"ffmpeg unavailable": {FFmpegAvailable: false},
+		"probe failure":      {FFmpegAvailable: true},
+	} {
+		output, mimeType, fileName := mc.ensureAudioTrack(context.Background(), data, "video/webm", "video.webm")
+		if !bytes.Equal(output, data) || mimeType != "video/webm" || fileName != "video.webm" {
+			t.Errorf("%s: ensureAudioTrack() = (%d bytes, %q, %q), want original video", name, len(output), mimeType, fileName)
+		}
+	}
+}
+
+func TestSilentVideo(t *testing.T) {
+	data := encodeSilentTestVideo(t)
+	ctx := context.Background()
+	if hasAudio, err := probeHasAudioStream(ctx, data, "video/mp4"); err != nil {
+		t.Fatalf("failed to probe audio stream: %v", err)
+	} else if hasAudio {
+		t.Fatal("silent video fixture has an audio stream")
+	}
+	duration, err := probeDuration(ctx, data, "video/mp4")
+	if err != nil {
+		t.Fatalf("failed to probe duration of silent video: %v", err)
+	} else if duration < 1900*time.Millisecond || duration > 2100*time.Millisecond {
+		t.Errorf("duration of silent video = %s, want 2s", duration)
+	}
+
+	mc := &MessageConverter{FFmpegAvailable: true}
+	output, mimeType, fileName := mc.ensureAudioTrack(ctx, data, "video/mp4", "video.mp4")
+	if mimeType != "video/mp4" || fileName != "video.mp4" {
+		t.Errorf("ensureAudioTrack() returned %q as %q, want video.mp4 as video/mp4", fileName, mimeType)
+	}
+	if hasAudio, err := probeHasAudioStream(ctx, output, mimeType); err != nil {
+		t.Fatalf("failed to probe audio stream of converted video: %v", err)
+	} else if !hasAudio {
+		t.Error("converted video doesn't have an audio stream")
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.mau.fi/util/ffmpeg"
 	"go.mau.fi/util/variationselector"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/binary/armadillo/waArmadilloApplication"
@@ -186,6 +187,13 @@ type portalMetaMessage struct {
 type portalMatrixMessage struct {
 	evt  *event.Event
 	user *User
+	// album is the already converted message if the event was sent as a part of an album.
+	album *convertedAlbumItem
+}
+
+type convertedAlbumItem struct {
+	msg  *waConsumerApplication.ConsumerApplication
+	meta *waMsgApplication.MessageApplication_Metadata
 }
 
 type Portal struct {
@@ -208,6 +216,13 @@ type Portal struct {
 	pendingMessages     map[int64]id.EventID
 	pendingMessagesLock sync.Mutex
 
+	scheduledMessages     map[id.EventID]*scheduledMessage
+	scheduledMessagesLock sync.Mutex
+	// stopped is closed when the bridge is stopping or the portal is deleted,
+	// after which held scheduled messages are never queued for handling.
+	stopped  chan struct{}
+	stopOnce sync.Once
+
 	backfillLock      sync.Mutex
 	backfillCollector *BackfillCollector
 
@@ -233,12 +248,52 @@ func (br *MetaBridge) NewPortal(dbPortal *database.Portal) *Portal {
 		metaMessages:   make(chan portalMetaMessage, br.Config.Bridge.PortalMessageBuffer),
 		matrixMessages: make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
 
-		pendingMessages: make(map[int64]id.EventID),
+		pendingMessages:   make(map[int64]id.EventID),
+		scheduledMessages: make(map[id.EventID]*scheduledMessage),
+		stopped:           make(chan struct{}),
 	}
 	portal.MsgConv = &msgconv.MessageConverter{
-		PortalMethods:        portal,
-		ConvertVoiceMessages: true,
-		MaxFileSize:          br.MediaConfig.UploadSize,
+		PortalMethods:           portal,
+		BridgeMode:              br.Config.Meta.Mode,
+		ConvertVoiceMessages:    true,
+		FFmpegAvailable:         ffmpeg.Supported(),
+		MaxFileSize:             br.MediaConfig.UploadSize,
+		MediaUploadRetries:      br.Config.Bridge.MediaUploadRetries,
+		ConversionTimeout:       br.Config.Bridge.ConversionTimeout,
+		URLPreviews:             br.Config.Bridge.URLPreviews.Enabled,
+		URLPreviewTimeout:       br.Config.Bridge.URLPreviews.Timeout,
+		SendUnsupportedAsText:   br.Config.Bridge.SendUnsupportedAsText,
+		EmotePrefix:             br.Config.Bridge.EmotePrefix,
+		NoticePrefix:            br.Config.Bridge.NoticePrefix,
+		LocationAddress:         br.Config.Bridge.LocationAddress,
+		MediaCache:              br.MediaCache,
+		MaxThumbnailDimension:   br.Config.Bridge.ThumbnailMaxDimension,
+		MaxImageDimension:       br.Config.Bridge.ImageMaxDimension,
+		ThumbnailQuality:        br.Config.Bridge.ThumbnailQuality,
+		SpoilerStyle:            br.Config.Bridge.SpoilerStyle,
+		NativeGIFs:              br.Config.Bridge.NativeGIFs.Enabled,
+		MaxNativeGIFSize:        br.Config.Bridge.NativeGIFs.MaxSize,
+		MaxNativeGIFDimension:   br.Config.Bridge.NativeGIFs.MaxDimension,
+		StickerLikeImages:       br.Config.Bridge.StickerLikeImages.Enabled,
+		MaxStickerLikeSize:      br.Config.Bridge.StickerLikeImages.MaxSize,
+		MaxStickerLikeDimension: br.Config.Bridge.StickerLikeImages.MaxDimension,
+		CustomEmojiStickers:     br.Config.Bridge.CustomEmojiStickers,
+		SplitLongMessages:       br.Config.Bridge.SplitLongMessages,
+		TranscodeVoiceMessages:  br.Config.Bridge.TranscodeVoiceMessages,
+		VoiceCodec:              msgconv.VoiceCodec(br.Config.Bridge.VoiceCodec),
+		AddSilentAudio:          br.Config.Bridge.AddSilentAudio,
+		RouteFilesByMimetype:    br.Config.Bridge.RouteFilesByMimetype,
+		ThreadsAsReplies:        br.Config.Bridge.ThreadsAsReplies,
+		CaptionPlacement:        msgconv.CaptionPlacement(br.Config.Bridge.CaptionPlacement),
+		GIFConvertArgs:          br.Config.Bridge.FFmpegArgs.GIFToMP4,
+		VoiceConvertArgs:        br.Config.Bridge.FFmpegArgs.VoiceToM4A,
+		VoiceOpusConvertArgs:    br.Config.Bridge.FFmpegArgs.VoiceToOgg,
+		UploadAttempt:           portal.logUploadAttempt,
+		MediaPresence:           portal.sendMediaPresence,
+	}
+	if br.Metrics != nil {
+		// Only set when enabled, as a nil *MetricsHandler in the interface wouldn't be detected as unset
+		portal.MsgConv.Metrics = br.Metrics
 	}
 	go portal.messageLoop()
 
@@ -248,6 +303,9 @@ func (br *MetaBridge) NewPortal(dbPortal *database.Portal) *Portal {
 func init() {
 	event.TypeMap[event.StateBridge] = reflect.TypeOf(CustomBridgeInfoContent{})
 	event.TypeMap[event.StateHalfShotBridge] = reflect.TypeOf(CustomBridgeInfoContent{})
+	event.TypeMap[msgconv.EventUnstablePollStart] = reflect.TypeOf(event.MessageEventContent{})
+	event.TypeMap[msgconv.EventUnstablePollResponse] = reflect.TypeOf(event.MessageEventContent{})
+	event.TypeMap[msgconv.EventUnstableBeacon] = reflect.TypeOf(event.MessageEventContent{})
 }
 
 var (
@@ -370,14 +428,103 @@ func (portal *Portal) UpdateBridgeInfo(ctx context.Context) {
 }
 
 func (portal *Portal) messageLoop() {
+	var next *portalMatrixMessage
 	for {
+		var msg portalMatrixMessage
+		if next != nil {
+			msg, next = *next, nil
+		} else {
+			select {
+			case msg = <-portal.matrixMessages:
+			case metaMsg := <-portal.metaMessages:
+				portal.handleMetaMessage(metaMsg)
+				continue
+			}
+		}
+		if portal.isAlbumItem(msg) {
+			var album []portalMatrixMessage
+			album, next = portal.collectAlbum(msg)
+			if len(album) > 1 {
+				portal.handleMatrixAlbum(album)
+				continue
+			}
+		}
+		portal.handleMatrixMessages(msg)
+	}
+}
+
+// maxAlbumSize is the maximum number of media messages that are grouped into a single album.
+const maxAlbumSize = 30
+
+// isAlbumItem checks if the Matrix event is a new image or video that could be sent as a part of an album.
+func (portal *Portal) isAlbumItem(msg portalMatrixMessage) bool {
+	if portal.bridge.Config.Bridge.AlbumWindow <= 0 || !portal.ThreadType.IsWhatsApp() || msg.evt.Type != event.EventMessage {
+		return false
+	}
+	content, ok := msg.evt.Content.Parsed.(*event.MessageEventContent)
+	return ok && msgconv.IsAlbumMsgType(content.MsgType) &&
+		content.RelatesTo.GetReplaceID() == "" &&
+		msgconv.ScheduledSendTime(msg.evt).IsZero() &&
+		msg.user.IsLoggedIn()
+}
+
+// collectAlbum waits for more images and videos from the same sender to group with the first one.
+// If a different message is received while waiting, it's returned separately so that it can be handled next.
+func (portal *Portal) collectAlbum(first portalMatrixMessage) (album []portalMatrixMessage, next *portalMatrixMessage) {
+	album = []portalMatrixMessage{first}
+	timer := time.NewTimer(portal.bridge.Config.Bridge.AlbumWindow)
+	defer timer.Stop()
+	for len(album) < maxAlbumSize {
 		select {
 		case msg := <-portal.matrixMessages:
-			portal.handleMatrixMessages(msg)
-		case msg := <-portal.metaMessages:
-			portal.handleMetaMessage(msg)
+			if msg.evt.Sender != first.evt.Sender || msg.user != first.user || !portal.isAlbumItem(msg) {
+				return album, &msg
+			}
+			album = append(album, msg)
+			timer.Reset(portal.bridge.Config.Bridge.AlbumWindow)
+		case metaMsg := <-portal.metaMessages:
+			portal.handleMetaMessage(metaMsg)
+		case <-timer.C:
+			return album, nil
+		}
+	}
+	return album, nil
+}
+
+// handleMatrixAlbum converts a batch of media messages into an album and then handles each message normally.
+// If the album can't be converted, the messages are handled individually without the grouping.
+func (portal *Portal) handleMatrixAlbum(album []portalMatrixMessage) {
+	log := portal.log.With().
+		Str("action", "handle matrix album").
+		Str("first_event_id", album[0].evt.ID.String()).
+		Int("album_size", len(album)).
+		Logger()
+	ctx := log.WithContext(context.TODO())
+	ctx = context.WithValue(ctx, msgconvContextKeyE2EEClient, album[0].user.E2EEClient)
+	if deadline := portal.bridge.Config.Bridge.MessageHandlingTimeout.Deadline; deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	// The conversion modifies the content, so use copies to leave the originals intact in case it fails
+	items := make([]msgconv.AlbumItem, len(album))
+	for i, msg := range album {
+		content := *msg.evt.Content.AsMessage()
+		items[i] = msgconv.AlbumItem{Event: msg.evt, Content: &content}
+	}
+	log.Debug().Msg("Converting Matrix media messages into an album")
+	waMsgs, waMetas, err := portal.MsgConv.ToWhatsAppAlbum(ctx, items, false)
+	if err != nil {
+		log.Err(err).Msg("Failed to convert album, sending media individually")
+	} else {
+		for i := range album {
+			album[i].evt.Content.Parsed = items[i].Content
+			album[i].album = &convertedAlbumItem{msg: waMsgs[i], meta: waMetas[i]}
 		}
 	}
+	for _, msg := range album {
+		portal.handleMatrixMessages(msg)
+	}
 }
 
 func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
@@ -389,6 +536,20 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 	ctx := log.WithContext(context.TODO())
 
 	evtTS := time.UnixMilli(msg.evt.Timestamp)
+	if sendAt := msgconv.ScheduledSendTime(msg.evt); !sendAt.IsZero() {
+		if until := time.Until(sendAt); until > 0 {
+			if maxDelay := portal.bridge.Config.Bridge.MaxScheduleDelay; maxDelay > 0 && until > maxDelay {
+				log.Warn().Time("send_at", sendAt).Msg("Rejecting message scheduled too far in the future")
+				portal.sendMessageStatusCheckpointFailed(ctx, msg.evt, fmt.Errorf("%w (maximum is %s)", errScheduledTooFar, maxDelay))
+				return
+			}
+			log.Debug().Time("send_at", sendAt).Msg("Holding scheduled message until its send time")
+			portal.holdScheduledMessage(ctx, msg, until)
+			return
+		}
+		// Count the message age from the scheduled time so that the handling timeouts don't drop it
+		evtTS = sendAt
+	}
 	timings := messageTimings{
 		initReceive:  msg.evt.Mautrix.ReceivedAt.Sub(evtTS),
 		decrypt:      msg.evt.Mautrix.DecryptionDuration,
@@ -401,17 +562,92 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 	timings.implicitRR = time.Since(implicitRRStart)
 
 	switch msg.evt.Type {
-	case event.EventMessage, event.EventSticker:
-		portal.handleMatrixMessage(ctx, msg.user, msg.evt, timings)
+	case event.EventMessage, event.EventSticker, msgconv.EventUnstablePollStart, msgconv.EventUnstableBeacon:
+		portal.handleMatrixMessage(ctx, msg.user, msg.evt, msg.album, timings)
 	case event.EventRedaction:
 		portal.handleMatrixRedaction(ctx, msg.user, msg.evt)
 	case event.EventReaction:
 		portal.handleMatrixReaction(ctx, msg.user, msg.evt)
+	case msgconv.EventUnstablePollResponse:
+		portal.handleMatrixPollResponse(ctx, msg.user, msg.evt)
 	default:
 		log.Warn().Str("type", msg.evt.Type.Type).Msg("Unhandled matrix message type")
 	}
 }
 
+type scheduledMessage struct {
+	msg   portalMatrixMessage
+	timer *time.Timer
+}
+
+// holdScheduledMessage queues the message for handling again after the given delay.
+func (portal *Portal) holdScheduledMessage(ctx context.Context, msg portalMatrixMessage, delay time.Duration) {
+	select {
+	case <-portal.stopped:
+		portal.sendMessageStatusCheckpointFailed(ctx, msg.evt, errScheduledSendInterrupted)
+		return
+	default:
+	}
+	portal.scheduledMessagesLock.Lock()
+	defer portal.scheduledMessagesLock.Unlock()
+	portal.scheduledMessages[msg.evt.ID] = &scheduledMessage{
+		msg: msg,
+		timer: time.AfterFunc(delay, func() {
+			portal.scheduledMessagesLock.Lock()
+			_, stillHeld := portal.scheduledMessages[msg.evt.ID]
+			delete(portal.scheduledMessages, msg.evt.ID)
+			portal.scheduledMessagesLock.Unlock()
+			if !stillHeld {
+				// The message was cancelled while the timer was firing
+				return
+			}
+			select {
+			case portal.matrixMessages <- msg:
+			case <-portal.stopped:
+				ctx := portal.log.With().Stringer("event_id", msg.evt.ID).Logger().WithContext(context.Background())
+				portal.sendMessageStatusCheckpointFailed(ctx, msg.evt, errScheduledSendInterrupted)
+			}
+		}),
+	}
+}
+
+// cancelScheduledMessage stops a held scheduled message from being sent. It returns false if the event
+// isn't a held scheduled message, e.g. because it was already sent.
+func (portal *Portal) cancelScheduledMessage(evtID id.EventID) bool {
+	portal.scheduledMessagesLock.Lock()
+	defer portal.scheduledMessagesLock.Unlock()
+	scheduled, ok := portal.scheduledMessages[evtID]
+	if ok {
+		scheduled.timer.Stop()
+		delete(portal.scheduledMessages, evtID)
+	}
+	return ok
+}
+
+// isScheduledMessage checks whether the given event is a scheduled message that hasn't been sent yet.
+func (portal *Portal) isScheduledMessage(evtID id.EventID) bool {
+	portal.scheduledMessagesLock.Lock()
+	defer portal.scheduledMessagesLock.Unlock()
+	_, ok := portal.scheduledMessages[evtID]
+	return ok
+}
+
+// stopScheduledMessages cancels all held scheduled messages and sends a failure status for them.
+// Held messages are only kept in memory, so this is called when the bridge is stopping or the portal
+// is deleted to let the senders know that the messages won't be sent.
+func (portal *Portal) stopScheduledMessages(ctx context.Context) {
+	portal.stopOnce.Do(func() {
+		close(portal.stopped)
+	})
+	portal.scheduledMessagesLock.Lock()
+	defer portal.scheduledMessagesLock.Unlock()
+	for evtID, scheduled := range portal.scheduledMessages {
+		scheduled.timer.Stop()
+		delete(portal.scheduledMessages, evtID)
+		portal.sendMessageStatusCheckpointFailed(ctx, scheduled.msg.evt, errScheduledSendInterrupted)
+	}
+}
+
 func (portal *Portal) HandleMatrixReadReceipt(brUser bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
 	user := brUser.(*User)
 	log := portal.log.With().
@@ -463,56 +699,36 @@ func (portal *Portal) handleMatrixReadReceiptForWhatsApp(ctx context.Context, se
 		return
 	}
 
-	maxTimestamp := receiptTimestamp
 	// Implicit read receipts don't have an event ID that's already bridged
-	if isExplicit {
-		if message, err := portal.bridge.DB.Message.GetByMXID(ctx, eventID); err != nil {
-			log.Err(err).Msg("Failed to get read receipt target message")
-		} else if message != nil {
-			maxTimestamp = message.Timestamp
-		}
+	if !isExplicit {
+		eventID = ""
 	}
-
 	prevTimestamp := sender.GetLastReadTS(ctx, portal.PortalKey)
-	lastReadIsZero := false
-	if prevTimestamp.IsZero() {
-		prevTimestamp = maxTimestamp.Add(-2 * time.Second)
-		lastReadIsZero = true
+	receipts, readUpTo, err := portal.MsgConv.MarkReadToWhatsApp(ctx, sender.MetaID, eventID, prevTimestamp, receiptTimestamp)
+	if errors.Is(err, msgconv.ErrReceiptTargetNotBridged) {
+		log.Debug().Err(err).Msg("Read receipt target isn't bridged, marking messages up to the receipt time as read")
+		receipts, readUpTo, err = portal.MsgConv.MarkReadToWhatsApp(ctx, sender.MetaID, "", prevTimestamp, receiptTimestamp)
 	}
-
-	messages, err := portal.bridge.DB.Message.GetAllBetweenTimestamps(ctx, portal.PortalKey, prevTimestamp, maxTimestamp)
 	if err != nil {
-		log.Err(err).Msg("Failed to get messages for read receipt")
+		log.Err(err).Msg("Failed to convert read receipt")
 		return
 	}
-	if len(messages) > 0 {
-		sender.SetLastReadTS(ctx, portal.PortalKey, messages[len(messages)-1].Timestamp)
-	}
-	groupedMessages := make(map[types.JID][]types.MessageID)
-	for _, msg := range messages {
-		var key types.JID
-		if msg.Sender == sender.MetaID || msg.IsUnencrypted() {
-			// Don't send read receipts for own messages or unencrypted messages
-			continue
-		} else if !portal.IsPrivateChat() {
-			// TODO: this is hacky since it hardcodes the server
-			key = types.JID{User: strconv.FormatInt(msg.Sender, 10), Server: types.MessengerServer}
-		} // else: blank key (participant field isn't needed in direct chat read receipts)
-		groupedMessages[key] = append(groupedMessages[key], msg.ID)
+	if !readUpTo.IsZero() {
+		sender.SetLastReadTS(ctx, portal.PortalKey, readUpTo)
 	}
 	// For explicit read receipts, log even if there are no targets. For implicit ones only log when there are targets
-	if len(groupedMessages) > 0 || isExplicit {
+	if len(receipts) > 0 || isExplicit {
 		log.Debug().
 			Time("last_read", prevTimestamp).
-			Bool("last_read_was_zero", lastReadIsZero).
+			Bool("last_read_was_zero", prevTimestamp.IsZero()).
 			Bool("explicit", isExplicit).
-			Any("receipts", groupedMessages).
+			Any("receipts", receipts).
 			Msg("Sending read receipts")
 	}
-	for messageSender, ids := range groupedMessages {
-		err = sender.E2EEClient.MarkRead(ids, receiptTimestamp, portal.JID(), messageSender)
+	for _, receipt := range receipts {
+		err = sender.E2EEClient.MarkRead(receipt.IDs, receipt.Timestamp, receipt.Chat, receipt.Sender)
 		if err != nil {
-			log.Err(err).Strs("ids", ids).Msg("Failed to mark messages as read")
+			log.Err(err).Strs("ids", receipt.IDs).Msg("Failed to mark messages as read")
 		}
 	}
 }
@@ -520,7 +736,7 @@ func (portal *Portal) handleMatrixReadReceiptForWhatsApp(ctx context.Context, se
 const MaxEditCount = 5
 const MaxEditTime = 15 * time.Minute
 
-func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt *event.Event, timings messageTimings) {
+func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt *event.Event, album *convertedAlbumItem, timings messageTimings) {
 	log := zerolog.Ctx(ctx)
 	start := time.Now()
 
@@ -605,7 +821,12 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 	var err error
 	if portal.ThreadType.IsWhatsApp() {
 		ctx = context.WithValue(ctx, msgconvContextKeyE2EEClient, sender.E2EEClient)
-		waMsg, waMeta, err = portal.MsgConv.ToWhatsApp(ctx, evt, content, relaybotFormatted)
+		if album != nil && !isRelay {
+			// Albums are converted all at once before handling the individual messages
+			waMsg, waMeta = album.msg, album.meta
+		} else {
+			waMsg, waMeta, err = portal.MsgConv.ToWhatsApp(ctx, evt, content, relaybotFormatted)
+		}
 	} else {
 		ctx = context.WithValue(ctx, msgconvContextKeyClient, sender.Client)
 		tasks, otid, err = portal.MsgConv.ToMeta(ctx, evt, content, relaybotFormatted)
@@ -630,18 +851,52 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 	timings.convert = time.Since(start)
 	start = time.Now()
 
+	if msgconv.IsDryRun(ctx) {
+		// This should never happen, but make sure placeholder media from dry runs can't be sent
+		log.Error().Msg("Refusing to send message converted in dry run mode")
+		go ms.sendMessageMetrics(evt, errDryRunMessage, "Error sending", true)
+		return
+	}
 	if waMsg != nil {
 		messageID := sender.E2EEClient.GenerateMessageID()
 		log.UpdateContext(func(c zerolog.Context) zerolog.Context {
 			return c.Str("message_id", messageID)
 		})
 		log.Debug().Msg("Sending Matrix message to WhatsApp")
+		// Like follow-ups, separate captions aren't stored in the database
+		captionMsg, captionMeta, captionPlacement := portal.MsgConv.CaptionToWhatsApp(ctx, content)
+		if captionPlacement == msgconv.CaptionBefore {
+			_, captionErr := sender.E2EEClient.SendFBMessage(ctx, portal.JID(), captionMsg, captionMeta)
+			if captionErr != nil {
+				log.Err(captionErr).Msg("Failed to send caption to WhatsApp")
+			}
+		}
 		var resp whatsmeow.SendResponse
 		resp, err = sender.E2EEClient.SendFBMessage(ctx, portal.JID(), waMsg, waMeta, whatsmeow.SendRequestExtra{
 			ID: messageID,
 		})
 		// TODO save message in db before sending and only update timestamp later
-		portal.storeMessageInDB(ctx, evt.ID, messageID, 0, sender.MetaID, resp.Timestamp, 0)
+		portal.storeMessageInDB(ctx, evt.ID, messageID, 0, sender.MetaID, resp.Timestamp, 0, database.MessageSubtypeNone)
+		if err == nil && evt.Type == msgconv.EventUnstablePollStart {
+			portal.storePoll(ctx, evt, messageID, waMsg)
+		}
+		if err == nil && captionPlacement == msgconv.CaptionAfter {
+			_, captionErr := sender.E2EEClient.SendFBMessage(ctx, portal.JID(), captionMsg, captionMeta)
+			if captionErr != nil {
+				log.Err(captionErr).Msg("Failed to send caption to WhatsApp")
+			}
+		}
+		if err == nil {
+			// Follow-ups aren't stored in the database, so reactions and redactions will only target the first message
+			followUps, followUpMeta := portal.MsgConv.FollowUpsToWhatsApp(ctx, evt, content)
+			for i, followUp := range followUps {
+				_, followUpErr := sender.E2EEClient.SendFBMessage(ctx, portal.JID(), followUp, followUpMeta)
+				if followUpErr != nil {
+					log.Err(followUpErr).Int("follow_up_index", i).Msg("Failed to send follow-up message to WhatsApp")
+					break
+				}
+			}
+		}
 	} else {
 		log.UpdateContext(func(c zerolog.Context) zerolog.Context {
 			return c.Int64("otid", otid)
@@ -664,7 +919,7 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 				for _, failed := range resp.LSMarkOptimisticMessageFailed {
 					if failed.OTID == otidStr {
 						log.Warn().Str("message", failed.Message).Msg("Sending message failed")
-						go ms.sendMessageMetrics(evt, fmt.Errorf("%w: %s", errServerRejected, failed.Message), "Error sending", true)
+						go ms.sendMessageMetrics(evt, portal.metaSendFailure(content, failed.Message), "Error sending", true)
 						return
 					}
 				}
@@ -682,7 +937,7 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 			portal.pendingMessagesLock.Lock()
 			_, ok = portal.pendingMessages[otid]
 			if ok {
-				portal.storeMessageInDB(ctx, evt.ID, msgID, otid, sender.MetaID, messageTS, 0)
+				portal.storeMessageInDB(ctx, evt.ID, msgID, otid, sender.MetaID, messageTS, 0, database.MessageSubtypeNone)
 				delete(portal.pendingMessages, otid)
 			} else {
 				log.Debug().Msg("Not storing message send response: pending message was already removed from map")
@@ -695,6 +950,19 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 	go ms.sendMessageMetrics(evt, err, "Error sending", true)
 }
 
+// metaSendFailure converts a send failure reported by Meta into an error for the message status.
+// Business threads like marketplace conversations may not allow media depending on the thread state,
+// so failed media sends there get a more specific error than the generic server rejection.
+func (portal *Portal) metaSendFailure(content *event.MessageEventContent, message string) error {
+	if portal.ThreadType == table.MARKETPLACE {
+		switch content.MsgType {
+		case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+			return fmt.Errorf("%w: %s", errMediaNotAllowed, message)
+		}
+	}
+	return fmt.Errorf("%w: %s", errServerRejected, message)
+}
+
 func (portal *Portal) redactFailedEdit(ctx context.Context, evtID id.EventID, reason string) {
 	_, err := portal.MainIntent().RedactEvent(ctx, portal.MXID, evtID, mautrix.ReqRedact{
 		Reason: reason,
@@ -707,6 +975,10 @@ func (portal *Portal) redactFailedEdit(ctx context.Context, evtID id.EventID, re
 func (portal *Portal) handleMatrixEdit(ctx context.Context, sender *User, isRelay bool, realSenderMXID id.UserID, ms *metricSender, evt *event.Event, content *event.MessageEventContent) {
 	log := zerolog.Ctx(ctx)
 	editTarget := content.RelatesTo.GetReplaceID()
+	if portal.isScheduledMessage(editTarget) {
+		go ms.sendMessageMetrics(evt, errEditScheduledMessage, "Error converting", true)
+		return
+	}
 	editTargetMsg, err := portal.bridge.DB.Message.GetByMXID(ctx, editTarget)
 	if err != nil {
 		log.Err(err).Stringer("edit_target_mxid", editTarget).Msg("Failed to get edit target message")
@@ -732,19 +1004,41 @@ func (portal *Portal) handleMatrixEdit(ctx context.Context, sender *User, isRela
 		content = content.NewContent
 		evt.Content.Parsed = content
 	}
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+	case event.MsgImage, event.MsgVideo:
+		if !portal.ThreadType.IsWhatsApp() {
+			// Non-E2EE Messenger chats only support editing the text of plain text messages
+			go ms.sendMessageMetrics(evt, errEditCaptionUnsupported, "Error converting", true)
+			return
+		}
+	default:
+		go ms.sendMessageMetrics(evt, errEditCaptionUnsupported, "Error converting", true)
+		return
+	}
 
 	if isRelay {
 		portal.addRelaybotFormat(ctx, realSenderMXID, evt, content)
 	}
 	newEditCount := editTargetMsg.EditCount + 1
 	if portal.ThreadType.IsWhatsApp() {
+		// The original content is needed to check captions and to keep the reply when editing replies
+		originalContent := portal.GetReplyTargetContent(ctx, editTarget)
+		var editText *waCommon.MessageText
+		editText, err = portal.MsgConv.EditToWhatsApp(ctx, originalContent, content)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to convert edit")
+			go ms.sendMessageMetrics(evt, err, "Error converting", true)
+			return
+		}
 		consumerMsg := wrapEdit(&waConsumerApplication.ConsumerApplication_EditMessage{
 			Key:         portal.buildMessageKey(sender, editTargetMsg),
-			Message:     portal.MsgConv.TextToWhatsApp(content),
+			Message:     editText,
 			TimestampMS: evt.Timestamp,
 		})
 		var resp whatsmeow.SendResponse
-		resp, err = sender.E2EEClient.SendFBMessage(ctx, portal.JID(), consumerMsg, nil)
+		editMeta := portal.MsgConv.EditMetadataToWhatsApp(ctx, originalContent)
+		resp, err = sender.E2EEClient.SendFBMessage(ctx, portal.JID(), consumerMsg, editMeta)
 		log.Trace().Any("response", resp).Msg("WhatsApp delete response")
 	} else {
 		editTask := &socket.EditMessageTask{
@@ -783,6 +1077,12 @@ func (portal *Portal) handleMatrixEdit(ctx context.Context, sender *User, isRela
 
 func (portal *Portal) handleMatrixRedaction(ctx context.Context, sender *User, evt *event.Event) {
 	log := zerolog.Ctx(ctx)
+	if portal.cancelScheduledMessage(evt.Redacts) {
+		// The message was never sent to Meta, so there's nothing to delete there
+		log.Debug().Stringer("redacts", evt.Redacts).Msg("Cancelled scheduled message that was redacted before its send time")
+		portal.sendMessageStatusCheckpointSuccess(ctx, evt)
+		return
+	}
 	dbMessage, err := portal.bridge.DB.Message.GetByMXID(ctx, evt.Redacts)
 	if err != nil {
 		log.Err(err).Msg("Failed to get redaction target message")
@@ -927,11 +1227,19 @@ func wrapReaction(message *waConsumerApplication.ConsumerApplication_ReactionMes
 	}
 }
 
+// userJID returns the WhatsApp JID of the given Meta user.
+func (portal *Portal) userJID(ctx context.Context, userID int64) types.JID {
+	server := portal.GetUserWhatsAppServer(ctx, userID)
+	if server == "" {
+		server = types.MessengerServer
+	}
+	return types.JID{User: strconv.FormatInt(userID, 10), Server: server}
+}
+
 func (portal *Portal) buildMessageKey(user *User, targetMsg *database.Message) *waCommon.MessageKey {
 	var messageKeyParticipant string
 	if !portal.IsPrivateChat() {
-		// TODO: this is hacky since it hardcodes the server
-		messageKeyParticipant = types.JID{User: strconv.FormatInt(targetMsg.Sender, 10), Server: types.MessengerServer}.String()
+		messageKeyParticipant = portal.userJID(context.TODO(), targetMsg.Sender).String()
 	}
 	return &waCommon.MessageKey{
 		RemoteJID:   portal.JID().String(),
@@ -943,11 +1251,7 @@ func (portal *Portal) buildMessageKey(user *User, targetMsg *database.Message) *
 
 func (portal *Portal) sendReaction(ctx context.Context, sender *User, targetMsg *database.Message, metaEmoji string, timestamp int64) error {
 	if !targetMsg.IsUnencrypted() {
-		consumerMsg := wrapReaction(&waConsumerApplication.ConsumerApplication_ReactionMessage{
-			Key:               portal.buildMessageKey(sender, targetMsg),
-			Text:              metaEmoji,
-			SenderTimestampMS: timestamp,
-		})
+		consumerMsg := wrapReaction(portal.MsgConv.ReactionToWhatsApp(portal.buildMessageKey(sender, targetMsg), metaEmoji, timestamp))
 		resp, err := sender.E2EEClient.SendFBMessage(ctx, portal.JID(), consumerMsg, nil)
 		zerolog.Ctx(ctx).Trace().Any("response", resp).Msg("WhatsApp reaction response")
 		return err
@@ -967,6 +1271,89 @@ func (portal *Portal) sendReaction(ctx context.Context, sender *User, targetMsg
 	}
 }
 
+// storePoll saves the encryption key and option hashes of a poll sent to WhatsApp, which are needed for bridging votes.
+func (portal *Portal) storePoll(ctx context.Context, evt *event.Event, messageID string, waMsg *waConsumerApplication.ConsumerApplication) {
+	optionHashes, err := msgconv.PollOptionHashes(evt)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get poll option hashes")
+		return
+	}
+	dbPoll := portal.bridge.DB.Poll.New()
+	dbPoll.MessageID = messageID
+	dbPoll.ThreadReceiver = portal.Receiver
+	dbPoll.EncKey = waMsg.GetPayload().GetContent().GetPollCreationMessage().GetEncKey()
+	dbPoll.OptionHashes = optionHashes
+	err = dbPoll.Insert(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to insert poll into database")
+	}
+}
+
+func (portal *Portal) handleMatrixPollResponse(ctx context.Context, sender *User, evt *event.Event) {
+	log := zerolog.Ctx(ctx)
+	if !sender.IsLoggedIn() {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, errCantRelayPollVotes)
+		return
+	} else if !portal.ThreadType.IsWhatsApp() {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, fmt.Errorf("%w %s in this chat", msgconv.ErrUnsupportedMsgType, evt.Type.Type))
+		return
+	}
+	pollEventID, err := msgconv.PollResponseTarget(evt)
+	if err != nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, err)
+		log.Warn().Err(err).Msg("Failed to get poll response target")
+		return
+	}
+	targetMsg, err := portal.bridge.DB.Message.GetByMXID(ctx, pollEventID)
+	if err != nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, err)
+		log.Err(err).Msg("Failed to get poll response target message")
+		return
+	} else if targetMsg == nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, errPollTargetNotFound)
+		log.Warn().Msg("Poll response target message not found")
+		return
+	}
+	poll, err := portal.bridge.DB.Poll.GetByMessageID(ctx, targetMsg.ID, portal.Receiver)
+	if err != nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, err)
+		log.Err(err).Msg("Failed to get poll from database")
+		return
+	} else if poll == nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, errPollTargetNotFound)
+		log.Warn().Str("target_message_id", targetMsg.ID).Msg("Poll response target isn't a bridged poll")
+		return
+	}
+	pollUpdate, err := portal.MsgConv.PollResponseToWhatsApp(
+		ctx, evt, poll, portal.buildMessageKey(sender, targetMsg),
+		portal.userJID(ctx, targetMsg.Sender), portal.userJID(ctx, sender.MetaID),
+	)
+	if err != nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, err)
+		log.Warn().Err(err).Msg("Failed to convert poll response")
+		return
+	}
+	consumerMsg := &waConsumerApplication.ConsumerApplication{
+		Payload: &waConsumerApplication.ConsumerApplication_Payload{
+			Payload: &waConsumerApplication.ConsumerApplication_Payload_Content{
+				Content: &waConsumerApplication.ConsumerApplication_Content{
+					Content: &waConsumerApplication.ConsumerApplication_Content_PollUpdateMessage{
+						PollUpdateMessage: pollUpdate,
+					},
+				},
+			},
+		},
+	}
+	resp, err := sender.E2EEClient.SendFBMessage(ctx, portal.JID(), consumerMsg, nil)
+	log.Trace().Any("response", resp).Msg("WhatsApp poll vote response")
+	if err != nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, err)
+		log.Err(err).Msg("Failed to send poll vote")
+		return
+	}
+	portal.sendMessageStatusCheckpointSuccess(ctx, evt)
+}
+
 func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *User, evt *event.Event) {
 	log := zerolog.Ctx(ctx)
 	if !sender.IsLoggedIn() {
@@ -984,9 +1371,12 @@ func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *User, ev
 		log.Warn().Msg("Reaction target message not found")
 		return
 	}
-	emoji := evt.Content.AsReaction().RelatesTo.Key
-	metaEmoji := variationselector.Remove(emoji)
-
+	metaEmoji, err := msgconv.ReactionToMeta(ctx, evt)
+	if err != nil {
+		portal.sendMessageStatusCheckpointFailed(ctx, evt, err)
+		log.Warn().Err(err).Msg("Failed to convert reaction")
+		return
+	}
 	err = portal.sendReaction(ctx, sender, targetMsg, metaEmoji, evt.Timestamp)
 	if err != nil {
 		portal.sendMessageStatusCheckpointFailed(ctx, evt, err)
@@ -1143,8 +1533,7 @@ func (portal *Portal) GetMatrixReply(ctx context.Context, replyToID string, repl
 	return
 }
 
-func (portal *Portal) GetMetaReply(ctx context.Context, content *event.MessageEventContent) *socket.ReplyMetaData {
-	replyToID := content.RelatesTo.GetReplyTo()
+func (portal *Portal) GetMetaReply(ctx context.Context, replyToID id.EventID) *socket.ReplyMetaData {
 	if len(replyToID) == 0 {
 		return nil
 	}
@@ -1154,20 +1543,136 @@ func (portal *Portal) GetMetaReply(ctx context.Context, content *event.MessageEv
 			Str("reply_to_mxid", replyToID.String()).
 			Msg("Failed to get reply target message from database")
 	} else if replyToMsg == nil {
-		zerolog.Ctx(ctx).Warn().
+		// Reactions and redacted messages aren't in the message table, so they're never used as reply targets
+		if reaction, _ := portal.bridge.DB.Reaction.GetByMXID(ctx, replyToID); reaction != nil {
+			zerolog.Ctx(ctx).Debug().
+				Str("reply_to_mxid", replyToID.String()).
+				Msg("Reply target is a reaction, sending message without reply")
+		} else {
+			zerolog.Ctx(ctx).Warn().
+				Str("reply_to_mxid", replyToID.String()).
+				Msg("Reply target message not found")
+		}
+	} else if replyToMsg.Subtype == database.MessageSubtypeAdmin {
+		// Meta rejects quotes of messages that weren't sent by a user, so it's better to send the message without one
+		zerolog.Ctx(ctx).Debug().
 			Str("reply_to_mxid", replyToID.String()).
-			Msg("Reply target message not found")
+			Msg("Reply target is an admin message, sending message without reply")
 	} else {
-		return &socket.ReplyMetaData{
+		reply := &socket.ReplyMetaData{
 			ReplyMessageId:  replyToMsg.ID,
 			ReplySourceType: 1,
 			ReplyType:       0,
 			ReplySender:     replyToMsg.Sender,
 		}
+		if replyToMsg.ThreadID != portal.ThreadID {
+			// The reply target was bridged in another chat (e.g. it's the original of a forwarded message),
+			// so the quote must point at that chat rather than this one.
+			targetPortal := portal.bridge.GetExistingPortalByThreadID(replyToMsg.PortalKey())
+			if targetPortal != nil {
+				reply.ReplyChatJID = targetPortal.JID().String()
+			}
+		}
+		return reply
 	}
 	return nil
 }
 
+func (portal *Portal) GetReplyTargetContent(ctx context.Context, eventID id.EventID) *event.MessageEventContent {
+	log := zerolog.Ctx(ctx).With().
+		Str("reply_to_mxid", eventID.String()).
+		Logger()
+	evt, err := portal.MainIntent().GetEvent(ctx, portal.MXID, eventID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get reply target event")
+		return nil
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil {
+		log.Err(err).Msg("Failed to parse reply target event content")
+		return nil
+	}
+	if evt.Type == event.EventEncrypted {
+		if portal.bridge.Crypto == nil {
+			return nil
+		}
+		evt, err = portal.bridge.Crypto.Decrypt(ctx, evt)
+		if err != nil {
+			log.Err(err).Msg("Failed to decrypt reply target event")
+			return nil
+		}
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return nil
+	}
+	if evt.Type == event.EventSticker {
+		content.MsgType = event.MessageType(event.EventSticker.Type)
+	}
+	content.RemoveReplyFallback()
+	return content
+}
+
+func (portal *Portal) CanMentionRoom(ctx context.Context, userID id.UserID) bool {
+	pl, err := portal.MainIntent().PowerLevels(ctx, portal.MXID)
+	if err != nil {
+		// Room mentions are allowed if the power levels can't be fetched, rather than failing the whole message
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get power levels to check room mention permission")
+		return true
+	}
+	return pl.GetUserLevel(userID) >= pl.Notifications.Room()
+}
+
+func (portal *Portal) GetMessageByMXID(ctx context.Context, eventID id.EventID) *database.Message {
+	msg, err := portal.bridge.DB.Message.GetByMXID(ctx, eventID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("target_mxid", eventID).Msg("Failed to get message by MXID")
+		return nil
+	}
+	return msg
+}
+
+func (portal *Portal) logUploadAttempt(ctx context.Context, attempt int, size int64) func(err error) {
+	log := zerolog.Ctx(ctx).With().Int("attempt", attempt+1).Int64("size", size).Logger()
+	log.Debug().Msg("Uploading media to WhatsApp")
+	start := time.Now()
+	return func(err error) {
+		if err != nil {
+			log.Warn().Err(err).Dur("duration", time.Since(start)).Msg("Media upload attempt failed")
+		} else {
+			log.Debug().Dur("duration", time.Since(start)).Msg("Finished uploading media to WhatsApp")
+		}
+	}
+}
+
+// sendMediaPresence shows the user as typing or recording audio in the WhatsApp chat while their media is being bridged.
+func (portal *Portal) sendMediaPresence(ctx context.Context, state msgconv.MediaPresenceState) {
+	client, _ := ctx.Value(msgconvContextKeyE2EEClient).(*whatsmeow.Client)
+	if client == nil || msgconv.IsDryRun(ctx) {
+		return
+	}
+	presence, media := types.ChatPresencePaused, types.ChatPresenceMediaText
+	switch state {
+	case msgconv.MediaPresenceUploading:
+		presence = types.ChatPresenceComposing
+	case msgconv.MediaPresenceRecording:
+		presence, media = types.ChatPresenceComposing, types.ChatPresenceMediaAudio
+	}
+	err := client.SendChatPresence(portal.JID(), presence, media)
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Failed to send media chat presence")
+	}
+}
+
+func (portal *Portal) GetMessagesBetween(ctx context.Context, min, max time.Time) []*database.Message {
+	messages, err := portal.bridge.DB.Message.GetAllBetweenTimestamps(ctx, portal.PortalKey, min, max)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get messages between timestamps")
+		return nil
+	}
+	return messages
+}
+
 func (portal *Portal) GetUserMXID(ctx context.Context, userID int64) id.UserID {
 	user := portal.bridge.GetUserByMetaID(userID)
 	if user != nil {
@@ -1176,6 +1681,47 @@ func (portal *Portal) GetUserMXID(ctx context.Context, userID int64) id.UserID {
 	return portal.bridge.FormatPuppetMXID(userID)
 }
 
+func (portal *Portal) GetUserMetaID(ctx context.Context, userID id.UserID) int64 {
+	if metaID, ok := portal.bridge.ParsePuppetMXID(userID); ok {
+		return metaID
+	}
+	user := portal.bridge.GetUserByMXIDIfExists(userID)
+	if user != nil {
+		return user.MetaID
+	}
+	return 0
+}
+
+func (portal *Portal) GetMatrixDisplayname(ctx context.Context, userID id.UserID) string {
+	member := portal.MainIntent().Member(ctx, portal.MXID, userID)
+	if member == nil || member.Displayname == "" {
+		return userID.Localpart()
+	}
+	return member.Displayname
+}
+
+func (portal *Portal) GetUserWhatsAppServer(ctx context.Context, userID int64) string {
+	if userID == 0 {
+		return ""
+	}
+	puppet := portal.bridge.GetPuppetByID(userID)
+	if puppet == nil {
+		return ""
+	}
+	return puppet.WhatsAppServer
+}
+
+func (portal *Portal) GetUserUsername(ctx context.Context, userID int64) string {
+	if userID == 0 {
+		return ""
+	}
+	puppet := portal.bridge.GetPuppetByID(userID)
+	if puppet == nil {
+		return ""
+	}
+	return puppet.Username
+}
+
 func (portal *Portal) handleMetaMessage(portalMessage portalMetaMessage) {
 	switch typedEvt := portalMessage.evt.(type) {
 	case *events.FBMessage:
@@ -1250,7 +1796,7 @@ func (portal *Portal) checkPendingMessage(ctx context.Context, messageID string,
 	if !ok {
 		return false
 	}
-	portal.storeMessageInDB(ctx, pendingEventID, messageID, otid, sender, timestamp, 0)
+	portal.storeMessageInDB(ctx, pendingEventID, messageID, otid, sender, timestamp, 0, database.MessageSubtypeNone)
 	delete(portal.pendingMessages, otid)
 	zerolog.Ctx(ctx).Debug().Stringer("pending_event_id", pendingEventID).Msg("Saved pending message ID")
 	return true
@@ -1319,6 +1865,16 @@ func (portal *Portal) handleEncryptedMessage(source *User, evt *events.FBMessage
 		Logger()
 	ctx := log.WithContext(context.TODO())
 	sender.FetchAndUpdateInfoIfNecessary(ctx, source)
+	if sender.WhatsAppServer != evt.Info.Sender.Server {
+		sender.WhatsAppServer = evt.Info.Sender.Server
+		err := sender.Update(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to save puppet WhatsApp server")
+		}
+	}
+	if ephemeralSetting := evt.Application.GetMetadata().GetChatEphemeralSetting(); ephemeralSetting != nil {
+		portal.updateDisappearTimer(ctx, ephemeralSetting.GetEphemeralExpiration())
+	}
 
 	switch typedMsg := evt.Message.(type) {
 	case *waConsumerApplication.ConsumerApplication:
@@ -1439,7 +1995,7 @@ func (portal *Portal) handleMetaOrWhatsAppMessage(ctx context.Context, source *U
 			log.Err(err).Int("part_index", i).Msg("Failed to send message to Matrix")
 			continue
 		}
-		portal.storeMessageInDB(ctx, resp.EventID, messageID, otidInt, sender.ID, messageTime, i)
+		portal.storeMessageInDB(ctx, resp.EventID, messageID, otidInt, sender.ID, messageTime, i, part.Subtype)
 	}
 }
 
@@ -1727,6 +2283,21 @@ func (portal *Portal) handleMetaTypingIndicator(typing *table.LSUpdateTypingIndi
 	}
 }
 
+func (portal *Portal) updateDisappearTimer(ctx context.Context, timer uint32) {
+	if portal.DisappearTimer == timer {
+		return
+	}
+	zerolog.Ctx(ctx).Debug().
+		Uint32("old_timer", portal.DisappearTimer).
+		Uint32("new_timer", timer).
+		Msg("Updating disappearing message timer")
+	portal.DisappearTimer = timer
+	err := portal.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal in database after disappearing timer change")
+	}
+}
+
 func (portal *Portal) handleMetaNameChange(typedEvt *table.LSSyncUpdateThreadName) {
 	log := portal.log.With().
 		Str("action", "meta name change").
@@ -1755,7 +2326,7 @@ func (portal *Portal) handleMetaAvatarChange(evt *table.LSSetThreadImageURL) {
 	}
 }
 
-func (portal *Portal) storeMessageInDB(ctx context.Context, eventID id.EventID, messageID string, otid, senderID int64, timestamp time.Time, partIndex int) {
+func (portal *Portal) storeMessageInDB(ctx context.Context, eventID id.EventID, messageID string, otid, senderID int64, timestamp time.Time, partIndex int, subtype database.MessageSubtype) {
 	dbMessage := portal.bridge.DB.Message.New()
 	dbMessage.MXID = eventID
 	dbMessage.RoomID = portal.MXID
@@ -1766,6 +2337,7 @@ func (portal *Portal) storeMessageInDB(ctx context.Context, eventID id.EventID,
 	dbMessage.PartIndex = partIndex
 	dbMessage.ThreadID = portal.ThreadID
 	dbMessage.ThreadReceiver = portal.Receiver
+	dbMessage.Subtype = subtype
 	err := dbMessage.Insert(ctx)
 	if err != nil {
 		portal.log.Err(err).Msg("Failed to insert message into database")
@@ -2144,6 +2716,7 @@ func (portal *Portal) addRelaybotFormat(ctx context.Context, userID id.UserID, e
 }
 
 func (portal *Portal) Delete() {
+	portal.stopScheduledMessages(portal.log.WithContext(context.TODO()))
 	err := portal.Portal.Delete(context.TODO())
 	if err != nil {
 		portal.log.Err(err).Msg("Failed to delete portal from db")
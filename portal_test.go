@@ -0,0 +1,221 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-meta/config"
+	"go.mau.fi/mautrix-meta/database"
+	"go.mau.fi/mautrix-meta/messagix"
+	"go.mau.fi/mautrix-meta/messagix/table"
+)
+
+func newTestDatabase(t *testing.T) *database.Database {
+	t.Helper()
+	rawDB, err := dbutil.NewWithDialect("file::memory:", "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// Every connection to an in-memory database gets its own empty database
+	rawDB.RawDB.SetMaxOpenConns(1)
+	db := database.New(rawDB)
+	if err = db.Upgrade(context.Background()); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func TestGetMetaReplyTargets(t *testing.T) {
+	db := newTestDatabase(t)
+	var logs bytes.Buffer
+	ctx := zerolog.New(&logs).WithContext(context.Background())
+	portalKey := database.PortalKey{ThreadID: 100, Receiver: 1}
+	portal := &Portal{Portal: &database.Portal{PortalKey: portalKey}, bridge: &MetaBridge{DB: db}}
+
+	msg := db.Message.New()
+	msg.ID, msg.ThreadID, msg.ThreadReceiver, msg.Sender = "mid.1", portalKey.ThreadID, portalKey.Receiver, 2
+	msg.MXID, msg.RoomID, msg.Timestamp = "$message", "!room:example.com", time.Now()
+	if err := msg.Insert(ctx); err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+	reaction := db.Reaction.New()
+	reaction.MessageID, reaction.ThreadID, reaction.ThreadReceiver, reaction.Sender = msg.ID, portalKey.ThreadID, portalKey.Receiver, 3
+	reaction.Emoji, reaction.MXID, reaction.RoomID = "👍", "$reaction", msg.RoomID
+	if err := reaction.Insert(ctx); err != nil {
+		t.Fatalf("failed to insert reaction: %v", err)
+	}
+
+	if reply := portal.GetMetaReply(ctx, "$message"); reply == nil || reply.ReplyMessageId != "mid.1" || reply.ReplySender != 2 {
+		t.Errorf("reply to message = %+v, want a reply to mid.1 from 2", reply)
+	}
+	story := db.Message.New()
+	story.ID, story.ThreadID, story.ThreadReceiver, story.Sender = "mid.2", portalKey.ThreadID, portalKey.Receiver, 2
+	story.MXID, story.RoomID, story.Timestamp, story.Subtype = "$story", msg.RoomID, time.Now(), database.MessageSubtypeStory
+	if err := story.Insert(ctx); err != nil {
+		t.Fatalf("failed to insert story: %v", err)
+	}
+	// Story replies can't be sent reliably yet, so replies to shared stories are sent as normal replies
+	if reply := portal.GetMetaReply(ctx, "$story"); reply == nil || reply.ReplyMessageId != "mid.2" || reply.ReplySourceType != 1 {
+		t.Errorf("reply to story = %+v, want a normal reply to mid.2", reply)
+	}
+	tests := []struct {
+		name       string
+		target     string
+		wantLogMsg string
+	}{
+		{name: "Reaction", target: "$reaction", wantLogMsg: "Reply target is a reaction"},
+		{name: "Redacted or unknown event", target: "$unknown", wantLogMsg: "Reply target message not found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs.Reset()
+			if reply := portal.GetMetaReply(ctx, id.EventID(test.target)); reply != nil {
+				t.Errorf("reply = %+v, want nil", reply)
+			}
+			if !strings.Contains(logs.String(), test.wantLogMsg) {
+				t.Errorf("logs %q don't contain %q", logs.String(), test.wantLogMsg)
+			}
+		})
+	}
+}
+
+func TestCancelScheduledMessage(t *testing.T) {
+	portal := &Portal{
+		matrixMessages:    make(chan portalMatrixMessage, 1),
+		scheduledMessages: make(map[id.EventID]*scheduledMessage),
+		stopped:           make(chan struct{}),
+	}
+	ctx := context.Background()
+	portal.holdScheduledMessage(ctx, portalMatrixMessage{evt: &event.Event{ID: "$cancelled"}}, 20*time.Millisecond)
+	portal.holdScheduledMessage(ctx, portalMatrixMessage{evt: &event.Event{ID: "$sent"}}, 20*time.Millisecond)
+	if !portal.isScheduledMessage("$cancelled") {
+		t.Fatal("held message isn't marked as scheduled")
+	}
+	if !portal.cancelScheduledMessage("$cancelled") {
+		t.Fatal("failed to cancel held message")
+	} else if portal.cancelScheduledMessage("$cancelled") {
+		t.Error("cancelled message was cancelled twice")
+	}
+	select {
+	case msg := <-portal.matrixMessages:
+		if msg.evt.ID != "$sent" {
+			t.Errorf("%s was queued after it was cancelled", msg.evt.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scheduled message wasn't queued at its send time")
+	}
+	select {
+	case msg := <-portal.matrixMessages:
+		t.Errorf("%s was queued after it was cancelled", msg.evt.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if portal.isScheduledMessage("$sent") {
+		t.Error("sent message is still marked as scheduled")
+	}
+}
+
+func newTestAlbumMessage(user *User, sender id.UserID, evtID id.EventID, msgType event.MessageType) portalMatrixMessage {
+	return portalMatrixMessage{user: user, evt: &event.Event{
+		ID:      evtID,
+		Sender:  sender,
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: msgType, Body: "media"}},
+	}}
+}
+
+func TestCollectAlbum(t *testing.T) {
+	br := &MetaBridge{Config: &config.Config{}}
+	br.Config.Bridge.AlbumWindow = 50 * time.Millisecond
+	portal := &Portal{
+		Portal:         &database.Portal{ThreadType: table.ENCRYPTED_OVER_WA_GROUP},
+		bridge:         br,
+		matrixMessages: make(chan portalMatrixMessage, 10),
+	}
+	alice := &User{Client: &messagix.Client{}}
+	bob := &User{Client: &messagix.Client{}}
+	portal.matrixMessages <- newTestAlbumMessage(alice, "@alice:example.com", "$video", event.MsgVideo)
+	portal.matrixMessages <- newTestAlbumMessage(alice, "@alice:example.com", "$image2", event.MsgImage)
+	portal.matrixMessages <- newTestAlbumMessage(bob, "@bob:example.com", "$bob", event.MsgImage)
+	portal.matrixMessages <- newTestAlbumMessage(alice, "@alice:example.com", "$image3", event.MsgImage)
+
+	first := newTestAlbumMessage(alice, "@alice:example.com", "$image1", event.MsgImage)
+	if !portal.isAlbumItem(first) {
+		t.Fatal("image isn't an album item")
+	}
+	album, next := portal.collectAlbum(first)
+	var albumIDs []id.EventID
+	for _, msg := range album {
+		albumIDs = append(albumIDs, msg.evt.ID)
+	}
+	if want := []id.EventID{"$image1", "$video", "$image2"}; !slices.Equal(albumIDs, want) {
+		t.Errorf("album = %v, want %v", albumIDs, want)
+	}
+	if next == nil || next.evt.ID != "$bob" {
+		t.Errorf("next message = %v, want $bob", next)
+	}
+
+	album, next = portal.collectAlbum(*next)
+	if len(album) != 1 || next == nil || next.evt.ID != "$image3" {
+		t.Errorf("got album of %d and next %v, want album of 1 and $image3 next", len(album), next)
+	}
+	portal.matrixMessages <- newTestAlbumMessage(alice, "@alice:example.com", "$image4", event.MsgImage)
+	album, next = portal.collectAlbum(*next)
+	if len(album) != 2 || next != nil {
+		t.Errorf("got album of %d and next %v after the window, want album of 2 and no next message", len(album), next)
+	}
+}
+
+func TestIsAlbumItem(t *testing.T) {
+	br := &MetaBridge{Config: &config.Config{}}
+	br.Config.Bridge.AlbumWindow = time.Second
+	portal := &Portal{Portal: &database.Portal{ThreadType: table.ENCRYPTED_OVER_WA_ONE_TO_ONE}, bridge: br}
+	user := &User{Client: &messagix.Client{}}
+	if portal.isAlbumItem(newTestAlbumMessage(user, "@alice:example.com", "$file", event.MsgFile)) {
+		t.Error("file is an album item")
+	}
+	if portal.isAlbumItem(newTestAlbumMessage(&User{}, "@alice:example.com", "$image", event.MsgImage)) {
+		t.Error("image from a logged out user is an album item")
+	}
+	edit := newTestAlbumMessage(user, "@alice:example.com", "$edit", event.MsgImage)
+	edit.evt.Content.AsMessage().SetEdit("$image")
+	if portal.isAlbumItem(edit) {
+		t.Error("edit is an album item")
+	}
+	portal.ThreadType = table.ONE_TO_ONE
+	if portal.isAlbumItem(newTestAlbumMessage(user, "@alice:example.com", "$image", event.MsgImage)) {
+		t.Error("image in an unencrypted chat is an album item")
+	}
+	portal.ThreadType = table.ENCRYPTED_OVER_WA_ONE_TO_ONE
+	br.Config.Bridge.AlbumWindow = 0
+	if portal.isAlbumItem(newTestAlbumMessage(user, "@alice:example.com", "$image", event.MsgImage)) {
+		t.Error("image is an album item with albums disabled")
+	}
+}